@@ -0,0 +1,380 @@
+package canopus
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxRequestBodySize is the largest request payload the server
+// reassembles from Block1 blocks
+const DefaultMaxRequestBodySize = 1 << 20
+
+// DefaultBlock1Timeout is how long the server keeps a partial Block1 upload
+// without receiving its next block
+const DefaultBlock1Timeout = 60 * time.Second
+
+var ErrRequestEntityIncomplete = errors.New("Request Entity Incomplete, blocks are missing (4.08)")
+var ErrRequestEntityTooLarge = errors.New("Request Entity Too Large (4.13)")
+
+func newBlock1Uploads(maxBodySize int, timeout time.Duration) *block1Uploads {
+	return &block1Uploads{
+		maxBodySize: maxBodySize,
+		timeout:     timeout,
+		uploads:     make(map[block1Key]*block1Upload),
+		streams:     make(map[block1Key]*block1Stream),
+	}
+}
+
+// block1Uploads reassembles the request payloads received in Block1 blocks,
+// or passes them on to the handlers streaming them. Uploads are told apart by
+// endpoint and request, i.e. method and URI, so that an endpoint may upload
+// to several resources at once
+type block1Uploads struct {
+	mu          sync.Mutex
+	maxBodySize int
+	timeout     time.Duration
+	uploads     map[block1Key]*block1Upload
+	streams     map[block1Key]*block1Stream
+}
+
+type block1Key struct {
+	endpoint string
+	request  string
+}
+
+type block1Upload struct {
+	body     []byte
+	lastSeen time.Time
+}
+
+// holds tells whether a block was already received at the given offset
+func (up *block1Upload) holds(offset int, payload []byte) bool {
+	if up == nil || offset+len(payload) > len(up.body) {
+		return false
+	}
+	return bytes.Equal(up.body[offset:offset+len(payload)], payload)
+}
+
+// block1Stream is an upload read by its handler as the blocks arrive
+type block1Stream struct {
+	mu       sync.Mutex
+	w        *io.PipeWriter
+	received uint32
+	lastSeen time.Time
+
+	// the handler's response, once it has returned
+	resp chan Response
+}
+
+// write passes a block on to the handler, blocking until it has been read.
+// Retransmitted blocks are skipped, and a block following a gap fails with
+// ErrRequestEntityIncomplete
+func (st *block1Stream) write(block *Block1Option, payload []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	offset := block.Sequence() * block.BlockSizeLength()
+	if offset > st.received {
+		return ErrRequestEntityIncomplete
+	}
+
+	if skip := st.received - offset; skip < uint32(len(payload)) {
+		n, err := st.w.Write(payload[skip:])
+		st.received += uint32(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newBlock1Key(endpoint string, msg Message) block1Key {
+	request := MethodString(msg.GetCode()) + " " + msg.GetURIPath()
+	if query := msg.GetOptionsAsString(OptionURIQuery); len(query) > 0 {
+		request += "?" + strings.Join(query, "&")
+	}
+
+	return block1Key{endpoint, request}
+}
+
+// add stores a block of an upload, returning the whole payload once the last
+// block is received. Blocks received again are acknowledged without being
+// stored twice, but a block following a gap, or differing from the one
+// received earlier, fails with ErrRequestEntityIncomplete and a payload larger
+// than the maximum body size, or the announced Size1, with
+// ErrRequestEntityTooLarge. The upload is discarded on error
+func (u *block1Uploads) add(endpoint string, msg Message, block *Block1Option) (body []byte, done bool, err error) {
+	key := newBlock1Key(endpoint, msg)
+
+	var payload []byte
+	if msg.GetPayload() != nil {
+		payload = msg.GetPayload().GetBytes()
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	upload := u.uploads[key]
+	if upload != nil && time.Since(upload.lastSeen) > u.timeout {
+		delete(u.uploads, key)
+		upload = nil
+	}
+
+	if block.Sequence() == 0 && !upload.holds(0, payload) {
+		if opt := msg.GetOption(OptionSize1); opt != nil {
+			if size, ok := opt.GetValue().(uint32); ok && int64(size) > int64(u.maxBodySize) {
+				delete(u.uploads, key)
+				return nil, false, ErrRequestEntityTooLarge
+			}
+		}
+		upload = &block1Upload{}
+		u.uploads[key] = upload
+	}
+
+	if upload == nil {
+		return nil, false, ErrRequestEntityIncomplete
+	}
+
+	offset := int(block.Sequence() * block.BlockSizeLength())
+	if offset != len(upload.body) {
+		// a retransmitted block is acknowledged again, without being stored
+		// twice
+		if upload.holds(offset, payload) {
+			upload.lastSeen = time.Now()
+			return nil, false, nil
+		}
+		delete(u.uploads, key)
+		return nil, false, ErrRequestEntityIncomplete
+	}
+
+	upload.body = append(upload.body, payload...)
+	if len(upload.body) > u.maxBodySize {
+		delete(u.uploads, key)
+		return nil, false, ErrRequestEntityTooLarge
+	}
+	upload.lastSeen = time.Now()
+
+	if block.HasMore() {
+		return nil, false, nil
+	}
+
+	delete(u.uploads, key)
+	return upload.body, true, nil
+}
+
+func (u *block1Uploads) setMaxBodySize(size int) {
+	u.mu.Lock()
+	u.maxBodySize = size
+	u.mu.Unlock()
+}
+
+func (u *block1Uploads) setTimeout(timeout time.Duration) {
+	u.mu.Lock()
+	u.timeout = timeout
+	u.mu.Unlock()
+}
+
+func (u *block1Uploads) getMaxBodySize() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.maxBodySize
+}
+
+// startStream registers a new streamed upload, aborting any previous one
+func (u *block1Uploads) startStream(key block1Key, w *io.PipeWriter) *block1Stream {
+	st := &block1Stream{
+		w:        w,
+		lastSeen: time.Now(),
+		resp:     make(chan Response, 1),
+	}
+
+	u.mu.Lock()
+	previous := u.streams[key]
+	u.streams[key] = st
+	u.mu.Unlock()
+
+	if previous != nil {
+		previous.w.CloseWithError(ErrRequestEntityIncomplete)
+	}
+
+	return st
+}
+
+// getStream returns the streamed upload a block belongs to, if any
+func (u *block1Uploads) getStream(key block1Key) *block1Stream {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	st := u.streams[key]
+	if st == nil || time.Since(st.lastSeen) > u.timeout {
+		return nil
+	}
+	st.lastSeen = time.Now()
+
+	return st
+}
+
+func (u *block1Uploads) removeStream(key block1Key, st *block1Stream) {
+	u.mu.Lock()
+	if u.streams[key] == st {
+		delete(u.streams, key)
+	}
+	u.mu.Unlock()
+}
+
+// purge drops the uploads which haven't received a block within the timeout.
+// Handlers reading a dropped stream get ErrRequestEntityIncomplete
+func (u *block1Uploads) purge() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for key, upload := range u.uploads {
+		if time.Since(upload.lastSeen) > u.timeout {
+			delete(u.uploads, key)
+		}
+	}
+
+	for key, st := range u.streams {
+		if time.Since(st.lastSeen) > u.timeout {
+			delete(u.streams, key)
+			st.w.CloseWithError(ErrRequestEntityIncomplete)
+		}
+	}
+}
+
+// requestedBlock1 returns the Block1 option of a request, if any
+func requestedBlock1(req Message) *Block1Option {
+	opt := req.GetOption(OptionBlock1)
+	if opt == nil || opt.GetValue() == nil {
+		return nil
+	}
+	return Block1OptionFromOption(opt)
+}
+
+// reassembledBlock1Message builds the request passed to handlers once all
+// blocks of an upload have been received
+func reassembledBlock1Message(msg Message, body []byte) Message {
+	full := NewMessage(msg.GetMessageType(), msg.GetCode(), msg.GetMessageId())
+	full.SetToken(msg.GetToken())
+	for _, opt := range msg.GetAllOptions() {
+		switch opt.GetCode() {
+		case OptionBlock1, OptionSize1:
+		default:
+			full.AddOptions([]Option{opt})
+		}
+	}
+	full.SetPayload(NewBytesPayload(body))
+
+	return full
+}
+
+// handleReqBlock1 handles a block of an upload, acknowledging intermediate
+// blocks with 2.31 Continue. It returns the reassembled request once the last
+// block is received, or nil if the request has been answered
+func (s *DefaultCoapServer) handleReqBlock1(msg Message, block *Block1Option, session Session) Message {
+	if block.Exponent() == 7 {
+		s.handleReqBadRequest(msg, session)
+		return nil
+	}
+
+	s.GetEvents().BlockMessage(msg, true)
+
+	body, done, err := s.block1.add(session.GetAddress().String(), msg, block)
+	switch err {
+	case ErrRequestEntityIncomplete:
+		s.sendBlock1Error(RequestEntityIncompleteMessage(msg.GetMessageId(), MessageAcknowledgment), msg, session)
+		return nil
+
+	case ErrRequestEntityTooLarge:
+		resp := RequestEntityTooLargeMessage(msg.GetMessageId(), MessageAcknowledgment)
+		resp.AddOption(OptionSize1, uint32(s.block1.getMaxBodySize()))
+		s.sendBlock1Error(resp, msg, session)
+		return nil
+	}
+
+	if !done {
+		s.handleReqContinue(msg, session)
+		return nil
+	}
+
+	return reassembledBlock1Message(msg, body)
+}
+
+func (s *DefaultCoapServer) sendBlock1Error(resp Message, msg Message, session Session) {
+	if msg.GetMessageType() != MessageConfirmable {
+		resp.SetMessageType(MessageNonConfirmable)
+		resp.SetMessageId(s.nextMessageID(session))
+	}
+	resp.SetToken(msg.GetToken())
+
+	SendMessage(resp, session)
+}
+
+// handleReqBlock1Stream passes a block of an upload to a handler reading the
+// request body as a stream. The handler is started with the first block, and
+// its response is returned with the last one, or as soon as the handler
+// returns without reading the whole body. It returns nil if the block has
+// been answered
+func (s *DefaultCoapServer) handleReqBlock1Stream(route Route, attrs map[string]string, msg Message, block *Block1Option, session Session) Response {
+	if block.Exponent() == 7 {
+		s.handleReqBadRequest(msg, session)
+		return nil
+	}
+
+	s.GetEvents().BlockMessage(msg, true)
+
+	key := newBlock1Key(session.GetAddress().String(), msg)
+	var st *block1Stream
+	if block.Sequence() == 0 {
+		r, w := io.Pipe()
+		st = s.block1.startStream(key, w)
+
+		req := NewClientRequestFromMessage(reassembledBlock1Message(msg, nil), attrs, session).(*CoapRequest)
+		req.body = r
+		go func() {
+			resp := s.handleRoute(route, req)
+
+			// blocks the handler didn't read are discarded
+			r.Close()
+			st.resp <- resp
+		}()
+	} else if st = s.block1.getStream(key); st == nil {
+		s.sendBlock1Error(RequestEntityIncompleteMessage(msg.GetMessageId(), MessageAcknowledgment), msg, session)
+		return nil
+	}
+
+	var payload []byte
+	if msg.GetPayload() != nil {
+		payload = msg.GetPayload().GetBytes()
+	}
+
+	switch err := st.write(block, payload); err {
+	case nil:
+
+	case ErrRequestEntityIncomplete:
+		s.block1.removeStream(key, st)
+		st.w.CloseWithError(err)
+		s.sendBlock1Error(RequestEntityIncompleteMessage(msg.GetMessageId(), MessageAcknowledgment), msg, session)
+		return nil
+
+	default:
+		// the handler returned early
+		s.block1.removeStream(key, st)
+		return <-st.resp
+	}
+
+	if block.HasMore() {
+		s.handleReqContinue(msg, session)
+		return nil
+	}
+
+	s.block1.removeStream(key, st)
+	st.w.Close()
+	return <-st.resp
+}
@@ -0,0 +1,268 @@
+package canopus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlock1Option(t *testing.T) {
+	opt := NewBlock1Option(BlockSize1024, true, 3)
+	assert.Equal(t, uint32(3), opt.Sequence())
+	assert.Equal(t, BlockSize1024, opt.Size())
+	assert.Equal(t, uint32(1024), opt.BlockSizeLength())
+	assert.True(t, opt.HasMore())
+
+	opt = NewBlock1Option(BlockSize16, false, 0)
+	assert.Equal(t, uint32(16), opt.BlockSizeLength())
+	assert.False(t, opt.HasMore())
+}
+
+// ackWithBlock1 answers a block of an upload
+func ackWithBlock1(code CoapCode, block *Block1Option) []Message {
+	msg := NewMessage(MessageAcknowledgment, code, 0)
+	if block != nil {
+		msg.AddOption(OptionBlock1, block.GetValue())
+	}
+	return []Message{msg}
+}
+
+func uploadBlocks(t *testing.T, addr string, payload []byte, szx BlockSizeType) (Response, error) {
+	conn, err := Dial(addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	req := NewRequest(MessageConfirmable, Post)
+	req.SetRequestURI("/upload")
+	req.GetMessage().SetBlock1Option(NewBlock1Option(szx, true, 0))
+	req.SetPayload(payload)
+
+	return conn.Send(req)
+}
+
+// receivedBlocks appends the blocks received by a peer to body, checking
+// they are in sequence
+func receivedBlocks(t *testing.T, rcvd chan Message, body []byte) []byte {
+	for {
+		select {
+		case msg := <-rcvd:
+			block := Block1OptionFromOption(msg.GetOption(OptionBlock1))
+			assert.Equal(t, uint32(len(body)), block.Sequence()*block.BlockSizeLength())
+			body = append(body, msg.GetPayload().GetBytes()...)
+
+		default:
+			return body
+		}
+	}
+}
+
+func TestClientBlock1Upload(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 10)
+
+	// the server asks for 16 byte blocks after the first one
+	peer, rcvd := startTestPeer(t, 0, func(req Message) []Message {
+		block := Block1OptionFromOption(req.GetOption(OptionBlock1))
+		if block.HasMore() {
+			return ackWithBlock1(CoapCodeContinue, NewBlock1Option(BlockSize16, true, block.Sequence()))
+		}
+		return ackWithBlock1(CoapCodeChanged, NewBlock1Option(block.Size(), false, block.Sequence()))
+	})
+	defer peer.Close()
+
+	resp, err := uploadBlocks(t, peer.LocalAddr().String(), payload, BlockSize32)
+	assert.Nil(t, err)
+	assert.Equal(t, CoapCodeChanged, resp.GetMessage().GetCode())
+
+	first := <-rcvd
+	assert.Equal(t, uint32(len(payload)), first.GetOption(OptionSize1).GetValue())
+	assert.Equal(t, BlockSize32, Block1OptionFromOption(first.GetOption(OptionBlock1)).Size())
+	assert.Equal(t, payload[:32], first.GetPayload().GetBytes())
+
+	assert.Equal(t, payload, receivedBlocks(t, rcvd, payload[:32]))
+}
+
+func TestClientBlock1RequestEntityTooLarge(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 10)
+
+	// the server only accepts 16 byte blocks
+	peer, rcvd := startTestPeer(t, 0, func(req Message) []Message {
+		block := Block1OptionFromOption(req.GetOption(OptionBlock1))
+		if block.Size() > BlockSize16 {
+			return ackWithBlock1(CoapCodeRequestEntityTooLarge, NewBlock1Option(BlockSize16, false, 0))
+		}
+		if block.HasMore() {
+			return ackWithBlock1(CoapCodeContinue, block)
+		}
+		return ackWithBlock1(CoapCodeChanged, block)
+	})
+	defer peer.Close()
+
+	resp, err := uploadBlocks(t, peer.LocalAddr().String(), payload, BlockSize64)
+	assert.Nil(t, err)
+	assert.Equal(t, CoapCodeChanged, resp.GetMessage().GetCode())
+
+	<-rcvd
+	assert.Equal(t, payload, receivedBlocks(t, rcvd, nil))
+}
+
+func TestClientBlock1Errors(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 10)
+
+	peer, _ := startTestPeer(t, 0, func(req Message) []Message {
+		if Block1OptionFromOption(req.GetOption(OptionBlock1)).Sequence() > 0 {
+			return ackWithBlock1(CoapCodeRequestEntityIncomplete, nil)
+		}
+		return ackWithBlock1(CoapCodeContinue, nil)
+	})
+	defer peer.Close()
+
+	resp, err := uploadBlocks(t, peer.LocalAddr().String(), payload, BlockSize16)
+	assert.Equal(t, ErrRequestEntityIncomplete, err)
+	assert.Equal(t, CoapCodeRequestEntityIncomplete, resp.GetMessage().GetCode())
+
+	peer, _ = startTestPeer(t, 0, func(req Message) []Message {
+		return ackWithBlock1(CoapCodeRequestEntityTooLarge, nil)
+	})
+	defer peer.Close()
+
+	_, err = uploadBlocks(t, peer.LocalAddr().String(), payload, BlockSize16)
+	assert.Equal(t, ErrRequestEntityTooLarge, err)
+}
+
+func newUploadServer(t *testing.T) (CoapServer, chan string) {
+	s := NewServer()
+	uploaded := make(chan string, 10)
+	s.Put("/files/:name", func(req Request) Response {
+		uploaded <- req.GetAttribute("name") + ":" + req.GetMessage().GetPayload().String()
+		return NewResponseWithMessage(ChangedMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+	})
+
+	return s, uploaded
+}
+
+func TestServerBlock1Reassembly(t *testing.T) {
+	s, uploaded := newUploadServer(t)
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	a := bytes.Repeat([]byte("a"), 40)
+	b := bytes.Repeat([]byte("b"), 20)
+
+	// two uploads from the same endpoint, interleaved
+	resp := sendRequest(t, s, session, peer, Put, "/files/a", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 0)), withPayload(a[:16]))
+	assert.Equal(t, CoapCodeContinue, resp.GetCode())
+	assert.Equal(t, uint32(0), Block1OptionFromOption(resp.GetOption(OptionBlock1)).Sequence())
+
+	resp = sendRequest(t, s, session, peer, Put, "/files/b", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 0)), withPayload(b[:16]))
+	assert.Equal(t, CoapCodeContinue, resp.GetCode())
+
+	resp = sendRequest(t, s, session, peer, Put, "/files/a", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 1)), withPayload(a[16:32]))
+	assert.Equal(t, CoapCodeContinue, resp.GetCode())
+
+	// retransmitted with another message id
+	resp = sendRequest(t, s, session, peer, Put, "/files/a", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 1)), withPayload(a[16:32]))
+	assert.Equal(t, CoapCodeContinue, resp.GetCode())
+
+	// an earlier block retransmitted doesn't truncate what follows it
+	resp = sendRequest(t, s, session, peer, Put, "/files/a", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 0)), withPayload(a[:16]))
+	assert.Equal(t, CoapCodeContinue, resp.GetCode())
+
+	resp = sendRequest(t, s, session, peer, Put, "/files/b", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, false, 1)), withPayload(b[16:]))
+	assert.Equal(t, CoapCodeChanged, resp.GetCode())
+	assert.Equal(t, "b:"+string(b), <-uploaded)
+
+	resp = sendRequest(t, s, session, peer, Put, "/files/a", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, false, 2)), withPayload(a[32:]))
+	assert.Equal(t, CoapCodeChanged, resp.GetCode())
+	block := Block1OptionFromOption(resp.GetOption(OptionBlock1))
+	assert.Equal(t, uint32(2), block.Sequence())
+	assert.False(t, block.HasMore())
+	assert.Equal(t, "a:"+string(a), <-uploaded)
+}
+
+func TestServerBlock1Errors(t *testing.T) {
+	s, uploaded := newUploadServer(t)
+	s.SetMaxRequestBodySize(32)
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	block := bytes.Repeat([]byte("x"), 16)
+
+	// a block is missing
+	sendRequest(t, s, session, peer, Put, "/files/gap", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 0)), withPayload(block))
+	resp := sendRequest(t, s, session, peer, Put, "/files/gap", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, false, 2)), withPayload(block))
+	assert.Equal(t, CoapCodeRequestEntityIncomplete, resp.GetCode())
+
+	// an earlier block differs from the one received
+	sendRequest(t, s, session, peer, Put, "/files/changed", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 0)), withPayload(block))
+	sendRequest(t, s, session, peer, Put, "/files/changed", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 1)), withPayload(block))
+	resp = sendRequest(t, s, session, peer, Put, "/files/changed", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 1)), withPayload(bytes.Repeat([]byte("y"), 16)))
+	assert.Equal(t, CoapCodeRequestEntityIncomplete, resp.GetCode())
+
+	// the upload was never started
+	resp = sendRequest(t, s, session, peer, Put, "/files/none", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, false, 1)), withPayload(block))
+	assert.Equal(t, CoapCodeRequestEntityIncomplete, resp.GetCode())
+
+	// larger than the maximum body size
+	sendRequest(t, s, session, peer, Put, "/files/big", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 0)), withPayload(block))
+	sendRequest(t, s, session, peer, Put, "/files/big", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 1)), withPayload(block))
+	resp = sendRequest(t, s, session, peer, Put, "/files/big", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, false, 2)), withPayload(block))
+	assert.Equal(t, CoapCodeRequestEntityTooLarge, resp.GetCode())
+	assert.Equal(t, uint32(32), resp.GetOption(OptionSize1).GetValue())
+
+	// stale uploads are dropped
+	s.SetBlock1Timeout(10 * time.Millisecond)
+	sendRequest(t, s, session, peer, Put, "/files/stale", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, true, 0)), withPayload(block))
+	time.Sleep(20 * time.Millisecond)
+	resp = sendRequest(t, s, session, peer, Put, "/files/stale", withToken("upload"), withBlock1(NewBlock1Option(BlockSize16, false, 1)), withPayload(block))
+	assert.Equal(t, CoapCodeRequestEntityIncomplete, resp.GetCode())
+
+	assert.Equal(t, 0, len(uploaded))
+}
+
+func TestServerBlock1Size1(t *testing.T) {
+	s, _ := newUploadServer(t)
+	s.SetMaxRequestBodySize(32)
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	req := NewRequestWithMessageId(MessageConfirmable, Put, GenerateMessageID())
+	req.SetRequestURI("/files/big")
+	req.SetToken("upload")
+	req.GetMessage().AddOption(OptionBlock1, NewBlock1Option(BlockSize16, true, 0).GetValue())
+	req.GetMessage().AddOption(OptionSize1, uint32(64))
+	req.SetPayload(bytes.Repeat([]byte("x"), 16))
+	s.(*DefaultCoapServer).handleRequest(req.GetMessage(), session)
+
+	buf := make([]byte, MaxPacketSize)
+	n, _, err := peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	resp, err := BytesToMessage(buf[:n])
+	assert.Nil(t, err)
+	assert.Equal(t, CoapCodeRequestEntityTooLarge, resp.GetCode())
+}
+
+func TestBlock1UploadToServer(t *testing.T) {
+	s, uploaded := newUploadServer(t)
+	addr := startTestServer(t, s)
+	defer s.Stop()
+
+	conn, err := Dial(addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	payload := bytes.Repeat([]byte("0123456789"), 50)
+	req := NewRequest(MessageConfirmable, Put)
+	req.SetRequestURI("/files/upload")
+	req.GetMessage().SetBlock1Option(NewBlock1Option(BlockSize64, true, 0))
+	req.SetPayload(payload)
+
+	resp, err := conn.Send(req)
+	assert.Nil(t, err)
+	assert.Equal(t, CoapCodeChanged, resp.GetMessage().GetCode())
+	assert.Equal(t, "upload:"+string(payload), <-uploaded)
+}
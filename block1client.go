@@ -0,0 +1,154 @@
+package canopus
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrBlock1UnexpectedResponse = errors.New("Unexpected response received during Block1 transfer")
+
+// DefaultBlock1Size is the size of the blocks sent by Upload, unless the
+// request carries a Block1 option
+const DefaultBlock1Size = BlockSize1024
+
+// Upload sends a request with a payload read from body in Block1 blocks, so
+// that only the block being sent is held in memory. Blocks are of the size of
+// the request's Block1 option, or DefaultBlock1Size
+func (c *UDPConnection) Upload(ctx context.Context, req Request, body io.Reader) (Response, error) {
+	szx := DefaultBlock1Size
+	if opt := req.GetMessage().GetOption(OptionBlock1); opt != nil {
+		szx = Block1OptionFromOption(opt).Size()
+	}
+
+	return c.sendBlock1(ctx, req.GetMessage(), body, szx)
+}
+
+// sendBlock1 sends a payload read from body in Block1 blocks, starting with
+// blocks of size 2^(szx + 4). Each block of a Confirmable request waits for
+// the server's 2.31 Continue, and the server may ask for smaller blocks in
+// it. The response to the last block is returned
+func (c *UDPConnection) sendBlock1(ctx context.Context, msg Message, body io.Reader, szx BlockSizeType) (Response, error) {
+	// the size of a body which can be seeked is announced with Size1
+	start, size := int64(0), int64(-1)
+	seeker, seekable := body.(io.Seeker)
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		size = end - start
+	}
+	r := bufio.NewReaderSize(body, int(blockSizeLength(uint32(BlockSize1024))))
+
+	// the server may answer 4.13 with the block size it accepts, in which
+	// case the transfer is restarted once with that size, if body can be
+	// seeked
+	restarted := false
+
+	offset := uint32(0)
+	for {
+		blockLen := blockSizeLength(uint32(szx))
+		block := make([]byte, blockLen)
+		n, err := io.ReadFull(r, block)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		block = block[:n]
+
+		more := false
+		if uint32(n) == blockLen {
+			if _, err = r.Peek(1); err == nil {
+				more = true
+			} else if err != io.EOF {
+				return nil, err
+			}
+		}
+
+		blockMsg := block1Request(msg, offset/blockLen, more, szx, block)
+		if offset == 0 && size >= 0 {
+			blockMsg.AddOption(OptionSize1, uint32(size))
+		}
+
+		var resp Response
+		if more {
+			resp, err = c.mux.send(ctx, blockMsg, c.params)
+		} else {
+			resp, err = c.sendBlockwise(ctx, blockMsg)
+		}
+		if err != nil {
+			return resp, err
+		}
+
+		respMsg := resp.GetMessage()
+		switch respMsg.GetCode() {
+		case CoapCodeRequestEntityIncomplete:
+			return resp, ErrRequestEntityIncomplete
+
+		case CoapCodeRequestEntityTooLarge:
+			opt := respMsg.GetOption(OptionBlock1)
+			if opt == nil || restarted || !seekable || Block1OptionFromOption(opt).Size() >= szx {
+				return resp, ErrRequestEntityTooLarge
+			}
+			if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+			r.Reset(body)
+			szx = Block1OptionFromOption(opt).Size()
+			restarted = true
+			offset = 0
+			continue
+		}
+
+		if !more {
+			return resp, nil
+		}
+
+		switch respMsg.GetCode() {
+		case CoapCodeContinue:
+
+		case CoapCodeEmpty:
+			// Non-confirmable blocks aren't acknowledged
+			if msg.GetMessageType() != MessageNonConfirmable {
+				return resp, ErrBlock1UnexpectedResponse
+			}
+
+		default:
+			// the server refused the request, or answered it early
+			return resp, nil
+		}
+
+		// later blocks are sent with the size chosen by the server, if smaller
+		if opt := respMsg.GetOption(OptionBlock1); opt != nil {
+			if respSzx := Block1OptionFromOption(opt).Size(); respSzx < szx {
+				szx = respSzx
+			}
+		}
+		offset += uint32(n)
+	}
+}
+
+// block1Request builds the request carrying block num of the payload of req
+func block1Request(req Message, num uint32, more bool, szx BlockSizeType, block []byte) Message {
+	msg := NewMessage(req.GetMessageType(), req.GetCode(), GenerateMessageID())
+	msg.SetToken(req.GetToken())
+	for _, opt := range req.GetAllOptions() {
+		switch opt.GetCode() {
+		case OptionBlock1, OptionSize1:
+		default:
+			msg.AddOptions([]Option{opt})
+		}
+	}
+	msg.AddOption(OptionBlock1, encodeBlockValue(szx, more, num))
+	msg.SetPayload(NewBytesPayload(block))
+
+	return msg
+}
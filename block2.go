@@ -0,0 +1,344 @@
+package canopus
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultBlock2Size is the size of the blocks the server splits large
+// responses into, unless the client asks for smaller ones
+const DefaultBlock2Size = BlockSize1024
+
+// DefaultBlock2CacheSize is the maximum number of large representations kept
+// by the server to answer subsequent Block2 requests
+const DefaultBlock2CacheSize = 256
+
+// representations are cached for their Max-Age, 60 seconds by default
+const defaultBlock2CacheLifetime = 60 * time.Second
+
+func newBlock2Cache(maxEntries int) *block2Cache {
+	return &block2Cache{
+		maxEntries: maxEntries,
+		entries:    make(map[block2Key]*block2Entry),
+		latest:     make(map[string]*block2Entry),
+	}
+}
+
+// block2Cache keeps the large representations being transferred blockwise
+// to each endpoint, keyed by their ETag, so that the handler is only called
+// for the first block
+type block2Cache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[block2Key]*block2Entry
+
+	// most recent representation of a resource for an endpoint, used when
+	// the client doesn't echo the ETag in its block requests
+	latest map[string]*block2Entry
+}
+
+type block2Key struct {
+	endpoint string
+	etag     string
+}
+
+type block2Entry struct {
+	key     block2Key
+	path    string
+	msg     Message
+	expires time.Time
+
+	// the representation, read one block at a time
+	mu   sync.Mutex
+	body io.ReadSeeker
+	size int64
+}
+
+// block returns block num, of size 2^(szx + 4), of the representation and
+// whether more blocks follow. It returns nil if there is no such block
+func (e *block2Entry) block(num, szx uint32) ([]byte, bool, error) {
+	size := int64(blockSizeLength(szx))
+	offset := int64(num) * size
+	if num > 0 && offset >= e.size {
+		return nil, false, nil
+	}
+
+	more := offset+size < e.size
+	if !more {
+		size = e.size - offset
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, err := e.body.Seek(offset, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(e.body, b); err != nil {
+		return nil, false, err
+	}
+
+	return b, more, nil
+}
+
+// close releases a representation read from a file or another closable
+// stream once it is no longer cached
+func (e *block2Entry) close() {
+	if c, ok := e.body.(io.Closer); ok {
+		e.mu.Lock()
+		c.Close()
+		e.mu.Unlock()
+	}
+}
+
+func latestKey(endpoint, path string) string {
+	return endpoint + " " + path
+}
+
+func (c *block2Cache) store(endpoint, path, etag string, msg Message, body io.ReadSeeker, size int64) *block2Entry {
+	lifetime := defaultBlock2CacheLifetime
+	if opt := msg.GetOption(OptionMaxAge); opt != nil {
+		lifetime = time.Duration(uintOptionValue(opt)) * time.Second
+	}
+
+	entry := &block2Entry{
+		key:     block2Key{endpoint, etag},
+		path:    path,
+		msg:     msg,
+		expires: time.Now().Add(lifetime),
+		body:    body,
+		size:    size,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.purgeLocked()
+	if previous, ok := c.entries[entry.key]; ok {
+		c.removeLocked(previous)
+	} else if len(c.entries) >= c.maxEntries {
+		var oldest *block2Entry
+		for _, e := range c.entries {
+			if oldest == nil || e.expires.Before(oldest.expires) {
+				oldest = e
+			}
+		}
+		c.removeLocked(oldest)
+	}
+
+	c.entries[entry.key] = entry
+	c.latest[latestKey(endpoint, path)] = entry
+
+	return entry
+}
+
+// get returns the representation with the given ETag, or the latest one of
+// the resource at path if etag is empty
+func (c *block2Cache) get(endpoint, etag, path string) *block2Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entry *block2Entry
+	if etag != "" {
+		entry = c.entries[block2Key{endpoint, etag}]
+	} else {
+		entry = c.latest[latestKey(endpoint, path)]
+	}
+
+	if entry == nil || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+func (c *block2Cache) purge() {
+	c.mu.Lock()
+	c.purgeLocked()
+	c.mu.Unlock()
+}
+
+func (c *block2Cache) purgeLocked() {
+	now := time.Now()
+	for _, entry := range c.entries {
+		if now.After(entry.expires) {
+			c.removeLocked(entry)
+		}
+	}
+}
+
+func (c *block2Cache) removeLocked(entry *block2Entry) {
+	delete(c.entries, entry.key)
+	go entry.close()
+
+	key := latestKey(entry.key.endpoint, entry.path)
+	if c.latest[key] == entry {
+		delete(c.latest, key)
+	}
+}
+
+// generateETag derives an ETag from a representation
+func generateETag(body io.ReadSeeker) (string, error) {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+
+	return string(h.Sum(nil)), nil
+}
+
+// block2Message builds a response carrying a block of a representation
+func block2Message(msg Message, block []byte, etag string, num, szx uint32, more bool, size int64) Message {
+	blockMsg := NewMessage(msg.GetMessageType(), msg.GetCode(), msg.GetMessageId())
+	blockMsg.SetToken(msg.GetToken())
+	for _, opt := range msg.GetAllOptions() {
+		switch opt.GetCode() {
+		case OptionBlock2, OptionSize2, OptionEtag:
+		default:
+			blockMsg.AddOptions([]Option{opt})
+		}
+	}
+	blockMsg.AddOption(OptionEtag, etag)
+	blockMsg.AddOption(OptionBlock2, encodeBlockValue(BlockSizeType(szx), more, num))
+	blockMsg.AddOption(OptionSize2, uint32(size))
+	blockMsg.SetPayload(NewBytesPayload(block))
+
+	return blockMsg
+}
+
+// requestedBlock2 returns the Block2 option of a request, if any
+func requestedBlock2(req Message) *Block2Option {
+	opt := req.GetOption(OptionBlock2)
+	if opt == nil {
+		return nil
+	}
+	return Block2OptionFromOption(opt)
+}
+
+// cachedBlock2Response answers a request for a block other than the first one
+// from the cache, returning nil if the representation is no longer cached
+func (s *DefaultCoapServer) cachedBlock2Response(req Message, session Session) Message {
+	block := requestedBlock2(req)
+	if block == nil || block.Sequence() == 0 {
+		return nil
+	}
+
+	etag := ""
+	if opt := req.GetOption(OptionEtag); opt != nil {
+		etag, _ = opt.GetValue().(string)
+	}
+
+	entry := s.block2.get(session.GetAddress().String(), etag, req.GetURIPath())
+	if entry == nil {
+		return nil
+	}
+
+	return s.block2Response(req, entry, block.Sequence(), block.Exponent())
+}
+
+// blockwise splits a response which doesn't fit in a single block, keeping
+// the representation for subsequent block requests, and returns the block
+// requested by req. Responses already carrying a Block2 option are returned
+// untouched. The representation is the response's payload, or the body of a
+// StreamResponse
+func (s *DefaultCoapServer) blockwise(req Message, resp Response, session Session) Message {
+	msg := resp.GetMessage()
+	if msg.GetOption(OptionBlock2) != nil {
+		return msg
+	}
+
+	var body io.ReadSeeker
+	stream, streamed := resp.(*StreamResponse)
+	if streamed {
+		body = stream.Body()
+	} else if msg.GetPayload() != nil {
+		body = bytes.NewReader(msg.GetPayload().GetBytes())
+	} else {
+		return msg
+	}
+
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		s.GetEvents().Error(err)
+		return InternalServerErrorMessage(msg.GetMessageId(), msg.GetMessageType())
+	}
+
+	szx := uint32(s.block2Size)
+	num := uint32(0)
+	if block := requestedBlock2(req); block != nil {
+		num = block.Sequence()
+		if num > 0 || block.Exponent() < szx {
+			// later blocks are numbered with the size chosen by the client
+			szx = block.Exponent()
+		}
+	}
+
+	etag := ""
+	if opt := msg.GetOption(OptionEtag); opt != nil {
+		etag, _ = opt.GetValue().(string)
+	}
+
+	if num == 0 && size <= int64(blockSizeLength(szx)) {
+		if !streamed {
+			return msg
+		}
+
+		// a small stream is sent as the payload of a single response
+		entry := &block2Entry{msg: msg, body: body, size: size}
+		payload, _, err := entry.block(0, szx)
+		entry.close()
+		if err != nil {
+			s.GetEvents().Error(err)
+			return InternalServerErrorMessage(msg.GetMessageId(), msg.GetMessageType())
+		}
+
+		msg.SetPayload(NewBytesPayload(payload))
+		return msg
+	}
+
+	if etag == "" {
+		if etag, err = generateETag(body); err != nil {
+			s.GetEvents().Error(err)
+			return InternalServerErrorMessage(msg.GetMessageId(), msg.GetMessageType())
+		}
+	}
+
+	entry := s.block2.store(session.GetAddress().String(), req.GetURIPath(), etag, msg, body, size)
+
+	return s.block2Response(req, entry, num, szx)
+}
+
+func (s *DefaultCoapServer) block2Response(req Message, entry *block2Entry, num, szx uint32) Message {
+	resp := entry.msg
+
+	var blockMsg Message
+	block, more, err := entry.block(num, szx)
+	if err != nil {
+		s.GetEvents().Error(err)
+		blockMsg = InternalServerErrorMessage(resp.GetMessageId(), resp.GetMessageType())
+	} else if block == nil {
+		blockMsg = BadOptionMessage(resp.GetMessageId(), resp.GetMessageType())
+		blockMsg.SetStringPayload("Block2 out of range")
+	} else {
+		blockMsg = block2Message(resp, block, entry.key.etag, num, szx, more, entry.size)
+	}
+
+	// a cached representation may have been built for an earlier request
+	blockMsg.SetMessageId(req.GetMessageId())
+	if req.GetMessageType() == MessageConfirmable {
+		blockMsg.SetMessageType(MessageAcknowledgment)
+	} else {
+		blockMsg.SetMessageType(MessageNonConfirmable)
+	}
+
+	s.GetEvents().BlockMessage(blockMsg, false)
+
+	return blockMsg
+}
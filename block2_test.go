@@ -0,0 +1,168 @@
+package canopus
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlock2Option(t *testing.T) {
+	opt := NewBlock2Option(BlockSize1024, true, 5)
+	assert.Equal(t, uint32(5), opt.Sequence())
+	assert.Equal(t, uint32(6), opt.Exponent())
+	assert.Equal(t, uint32(1024), opt.BlockSizeLength())
+	assert.True(t, opt.HasMore())
+
+	// all fields zero is sent as an empty option
+	opt = Block2OptionFromOption(NewOption(OptionBlock2, nil))
+	assert.Equal(t, uint32(0), opt.Sequence())
+	assert.Equal(t, uint32(16), opt.BlockSizeLength())
+	assert.False(t, opt.HasMore())
+}
+
+func TestServerBlock2Response(t *testing.T) {
+	manifest := bytes.Repeat([]byte("0123456789"), 300)
+
+	s := NewServer()
+	calls := 0
+	s.Get("/manifest", func(req Request) Response {
+		calls++
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.AddOption(OptionMaxAge, 30)
+		msg.SetPayload(NewBytesPayload(manifest))
+		return NewResponseWithMessage(msg)
+	})
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	var received []byte
+	var etag interface{}
+	for num := uint32(0); ; num++ {
+		var opts []requestOption
+		if num > 0 {
+			opts = append(opts, withBlock2(NewBlock2Option(BlockSize1024, false, num)))
+		}
+		resp := sendRequest(t, s, session, peer, Get, "/manifest", opts...)
+		assert.Equal(t, CoapCodeContent, resp.GetCode())
+		assert.Equal(t, uint32(len(manifest)), resp.GetOption(OptionSize2).GetValue())
+
+		if num == 0 {
+			etag = resp.GetOption(OptionEtag).GetValue()
+		}
+		assert.Equal(t, etag, resp.GetOption(OptionEtag).GetValue())
+
+		respBlock := Block2OptionFromOption(resp.GetOption(OptionBlock2))
+		assert.Equal(t, num, respBlock.Sequence())
+		assert.Equal(t, uint32(6), respBlock.Exponent())
+
+		received = append(received, resp.GetPayload().GetBytes()...)
+		if !respBlock.HasMore() {
+			break
+		}
+	}
+	assert.Equal(t, manifest, received)
+	assert.Equal(t, 1, calls)
+
+	// smaller block size requested by the client
+	resp := sendRequest(t, s, session, peer, Get, "/manifest", withBlock2(NewBlock2Option(BlockSize64, false, 0)))
+	assert.Equal(t, manifest[:64], resp.GetPayload().GetBytes())
+	assert.True(t, Block2OptionFromOption(resp.GetOption(OptionBlock2)).HasMore())
+	assert.Equal(t, 2, calls)
+
+	resp = sendRequest(t, s, session, peer, Get, "/manifest", withBlock2(NewBlock2Option(BlockSize64, false, 1)))
+	assert.Equal(t, manifest[64:128], resp.GetPayload().GetBytes())
+	assert.Equal(t, 2, calls)
+
+	// beyond the end of the representation
+	resp = sendRequest(t, s, session, peer, Get, "/manifest", withBlock2(NewBlock2Option(BlockSize1024, false, 10)))
+	assert.Equal(t, CoapCodeBadOption, resp.GetCode())
+}
+
+func TestServerBlock2ReservedSize(t *testing.T) {
+	s := NewServer()
+	route := s.Get("/manifest", func(req Request) Response {
+		return NewResponseWithMessage(ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+	})
+	route.(*RegExRoute).AutoAck = true
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	// rejected before being acknowledged or observed
+	resp := sendRequest(t, s, session, peer, Get, "/manifest", withObserve(observeRegister), withBlock2(NewBlock2Option(7, false, 0)))
+	assert.Equal(t, CoapCodeBadRequest, resp.GetCode())
+	assert.False(t, s.HasObservation("/manifest", peer.LocalAddr()))
+}
+
+func TestServerSmallResponseNotSplit(t *testing.T) {
+	s := NewServer()
+	s.Get("/manifest", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.SetStringPayload("small")
+		return NewResponseWithMessage(msg)
+	})
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	resp := sendRequest(t, s, session, peer, Get, "/manifest")
+	assert.Nil(t, resp.GetOption(OptionBlock2))
+	assert.Equal(t, "small", resp.GetPayload().String())
+}
+
+func TestClientBlock2Reassembly(t *testing.T) {
+	manifest := bytes.Repeat([]byte("0123456789"), 300)
+
+	s := NewServer()
+	s.Get("/manifest", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.SetPayload(NewBytesPayload(manifest))
+		return NewResponseWithMessage(msg)
+	})
+
+	// serves blocks itself, with a representation changing after the first
+	s.Get("/changing", func(req Request) Response {
+		num := uint32(0)
+		if block := requestedBlock2(req.GetMessage()); block != nil {
+			num = block.Sequence()
+		}
+
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.AddOption(OptionEtag, fmt.Sprintf("v%d", num))
+		msg.AddOption(OptionBlock2, encodeBlockValue(BlockSize16, true, num))
+		msg.SetPayload(NewBytesPayload(manifest[num*16 : (num+1)*16]))
+		return NewResponseWithMessage(msg)
+	})
+
+	addr := startTestServer(t, s)
+	defer s.Stop()
+
+	conn, err := Dial(addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetBlock2Size(BlockSize256)
+
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/manifest")
+	resp, err := conn.Send(req)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest, resp.GetMessage().GetPayload().GetBytes())
+	assert.Nil(t, resp.GetMessage().GetOption(OptionBlock2))
+
+	req = NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/changing")
+	_, err = conn.Send(req)
+	assert.Equal(t, ErrBlock2ETagChanged, err)
+
+	conn.SetMaxResponseSize(1000)
+	req = NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/manifest")
+	_, err = conn.Send(req)
+	assert.Equal(t, ErrBlock2TooLarge, err)
+}
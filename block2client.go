@@ -0,0 +1,182 @@
+package canopus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// DefaultMaxResponseSize is the largest representation a client reassembles
+// from Block2 responses
+const DefaultMaxResponseSize = 1 << 20
+
+var ErrBlock2ETagChanged = errors.New("Representation changed during Block2 transfer")
+var ErrBlock2TooLarge = errors.New("Block2 representation exceeds the maximum response size")
+var ErrBlock2UnexpectedBlock = errors.New("Unexpected block received during Block2 transfer")
+
+// SetBlock2Size sets the block size asked of servers for responses, sent
+// with the initial request
+func (c *UDPConnection) SetBlock2Size(size BlockSizeType) {
+	c.block2Size = size
+	c.preferBlock2 = true
+}
+
+// SetMaxResponseSize limits the size of representations reassembled from
+// Block2 responses
+func (c *UDPConnection) SetMaxResponseSize(size int) {
+	c.maxResponseSize = size
+}
+
+// sendBlockwise sends a request and, if the response is the first of several
+// Block2 blocks, fetches the remaining ones and returns a single response
+// carrying the whole representation
+func (c *UDPConnection) sendBlockwise(ctx context.Context, msg Message) (Response, error) {
+	resp, err := c.sendBlock2Request(ctx, msg)
+	if err != nil || !hasMoreBlocks(resp.GetMessage()) {
+		return resp, err
+	}
+
+	var body bytes.Buffer
+	resp, done, err := c.fetchBlock2(ctx, msg, resp.GetMessage(), &body, int64(c.maxResponseSize))
+	if done {
+		resp.GetMessage().SetPayload(NewBytesPayload(body.Bytes()))
+	}
+
+	return resp, err
+}
+
+// Download sends a request and writes the payload of the response to w. A
+// response sent in Block2 blocks is written a block at a time, regardless of
+// the maximum response size. The response is returned without its payload
+func (c *UDPConnection) Download(ctx context.Context, req Request, w io.Writer) (Response, error) {
+	msg := req.GetMessage()
+	resp, err := c.sendBlock2Request(ctx, msg)
+	if err != nil {
+		return resp, err
+	}
+
+	first := resp.GetMessage()
+	if !hasMoreBlocks(first) {
+		if first.GetPayload() != nil {
+			if _, err = w.Write(first.GetPayload().GetBytes()); err != nil {
+				return nil, err
+			}
+		}
+		first.SetPayload(NewBytesPayload(nil))
+
+		return resp, nil
+	}
+
+	resp, _, err = c.fetchBlock2(ctx, msg, first, w, -1)
+
+	return resp, err
+}
+
+// sendBlock2Request sends a request, asking for the preferred block size if
+// one was set
+func (c *UDPConnection) sendBlock2Request(ctx context.Context, msg Message) (Response, error) {
+	if c.preferBlock2 && msg.GetOption(OptionBlock2) == nil {
+		msg.AddOption(OptionBlock2, encodeBlockValue(c.block2Size, false, 0))
+	}
+
+	return c.mux.send(ctx, msg, c.params)
+}
+
+// hasMoreBlocks checks if a response is followed by further Block2 blocks
+func hasMoreBlocks(msg Message) bool {
+	opt := msg.GetOption(OptionBlock2)
+
+	return opt != nil && Block2OptionFromOption(opt).HasMore()
+}
+
+// fetchBlock2 writes the payload of the first block of a response to w,
+// followed by those of the remaining blocks as they are fetched. A limit
+// other than -1 caps the size of the representation. Once done, a response
+// with the options of the first block is returned. A response to a block
+// failing on the server is returned as is
+func (c *UDPConnection) fetchBlock2(ctx context.Context, req Message, first Message, w io.Writer, limit int64) (resp Response, done bool, err error) {
+	if size := first.GetOption(OptionSize2); size != nil && limit >= 0 {
+		if total, ok := size.GetValue().(uint32); ok && int64(total) > limit {
+			return nil, false, ErrBlock2TooLarge
+		}
+	}
+	etag := first.GetOption(OptionEtag)
+
+	written := int64(0)
+	blockMsg := first
+	for {
+		block := Block2OptionFromOption(blockMsg.GetOption(OptionBlock2))
+		if int64(block.Sequence())*int64(block.BlockSizeLength()) != written {
+			return nil, false, ErrBlock2UnexpectedBlock
+		}
+
+		if blockMsg.GetPayload() != nil {
+			payload := blockMsg.GetPayload().GetBytes()
+			if limit >= 0 && written+int64(len(payload)) > limit {
+				return nil, false, ErrBlock2TooLarge
+			}
+			if _, err = w.Write(payload); err != nil {
+				return nil, false, err
+			}
+			written += int64(len(payload))
+		}
+
+		if !block.HasMore() {
+			break
+		}
+
+		resp, err = c.mux.send(ctx, nextBlock2Request(req, block.Sequence()+1, block.Exponent()), c.params)
+		if err != nil {
+			return resp, false, err
+		}
+
+		blockMsg = resp.GetMessage()
+		if blockMsg.GetCode() != first.GetCode() {
+			// the server failed to serve a block, leave it to the caller
+			return resp, false, nil
+		}
+		if blockMsg.GetOption(OptionBlock2) == nil {
+			return nil, false, ErrBlock2UnexpectedBlock
+		}
+		if !sameETag(etag, blockMsg.GetOption(OptionEtag)) {
+			return nil, false, ErrBlock2ETagChanged
+		}
+	}
+
+	full := NewMessage(first.GetMessageType(), first.GetCode(), first.GetMessageId())
+	full.SetToken(first.GetToken())
+	for _, opt := range first.GetAllOptions() {
+		if opt.GetCode() != OptionBlock2 {
+			full.AddOptions([]Option{opt})
+		}
+	}
+	full.SetPayload(NewBytesPayload(nil))
+
+	return NewResponse(full, nil), true, nil
+}
+
+// nextBlock2Request builds the request for block num of a response to req,
+// with the same options apart from Observe, which only applies to the first
+// block, and those of a Block1 transfer
+func nextBlock2Request(req Message, num, szx uint32) Message {
+	msg := NewMessage(req.GetMessageType(), req.GetCode(), GenerateMessageID())
+	msg.SetToken(req.GetToken())
+	for _, opt := range req.GetAllOptions() {
+		switch opt.GetCode() {
+		case OptionBlock2, OptionObserve, OptionBlock1, OptionSize1:
+		default:
+			msg.AddOptions([]Option{opt})
+		}
+	}
+	msg.AddOption(OptionBlock2, encodeBlockValue(BlockSizeType(szx), false, num))
+
+	return msg
+}
+
+func sameETag(a, b Option) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.GetValue() == b.GetValue()
+}
@@ -1,7 +1,9 @@
 package canopus
 
 import (
+	"context"
 	"errors"
+	"io"
 	"math/rand"
 	"net"
 	"sync"
@@ -79,6 +81,9 @@ const (
 	Post   CoapCode = 2
 	Put    CoapCode = 3
 	Delete CoapCode = 4
+	Fetch  CoapCode = 5
+	Patch  CoapCode = 6
+	IPatch CoapCode = 7
 
 	// 2.x
 	CoapCodeEmpty    CoapCode = 0
@@ -119,6 +124,10 @@ const DefaultNStart = 1
 const DefaultLeisure = 5
 const DefaultProbingRate = 1
 
+// MaxLatency is the maximum time a datagram is expected to take from the start
+// of its transmission to the completion of its reception (MAX_LATENCY)
+const MaxLatency = 100 * time.Second
+
 const CoapDefaultHost = ""
 const CoapDefaultPort = 5683
 const CoapsDefaultPort = 5684
@@ -131,6 +140,10 @@ const MessageIDPurgeDuration = 60
 
 type RouteHandler func(Request) Response
 
+// Middleware wraps a route handler, running code before and after it or
+// responding in its place
+type Middleware func(RouteHandler) RouteHandler
+
 // Proxy Filter
 type ProxyFilter func(Message, net.Addr) bool
 type ProxyHandler func(c CoapServer, msg Message, session Session)
@@ -160,6 +173,7 @@ const (
 	MediaTypeApplicationSoapFastInfoSet MediaType = 49
 	MediaTypeApplicationJSON            MediaType = 50
 	MediaTypeApplicationXObitBinary     MediaType = 51
+	MediaTypeApplicationCbor            MediaType = 60
 	MediaTypeTextPlainVndOmaLwm2m       MediaType = 1541
 	MediaTypeTlvVndOmaLwm2m             MediaType = 1542
 	MediaTypeJSONVndOmaLwm2m            MediaType = 1543
@@ -173,6 +187,8 @@ const (
 	MethodDelete  = "DELETE"
 	MethodOptions = "OPTIONS"
 	MethodPatch   = "PATCH"
+	MethodFetch   = "FETCH"
+	MethodIPatch  = "iPATCH"
 )
 
 type BlockSizeType byte
@@ -199,6 +215,7 @@ var ErrUnsupportedMethod = errors.New("Unsupported Method")
 var ErrNoMatchingRoute = errors.New("No matching route found")
 var ErrUnsupportedContentFormat = errors.New("Unsupported Content-Format")
 var ErrNoMatchingMethod = errors.New("No matching method")
+var ErrNotAcceptable = errors.New("No route produces the accepted content format")
 var ErrNilMessage = errors.New("Message is nil")
 var ErrNilConn = errors.New("Connection object is nil")
 var ErrNilAddr = errors.New("Address cannot be nil")
@@ -214,8 +231,11 @@ const (
 
 // Interfaces
 type CoapServer interface {
-	ListenAndServe(addr string)
-	ListenAndServeDTLS(addr string)
+	ListenAndServe(addr string) error
+	ListenAndServeDTLS(addr string) error
+	Serve(conn net.PacketConn) error
+	ServeDTLS(conn net.PacketConn) error
+	Shutdown(ctx context.Context) error
 	Stop()
 
 	Get(path string, fn RouteHandler) Route
@@ -226,7 +246,17 @@ type CoapServer interface {
 	Patch(path string, fn RouteHandler) Route
 
 	NewRoute(path string, method CoapCode, fn RouteHandler) Route
+	HandleStream(path string, method CoapCode, fn RouteHandler) Route
+	AddResource(r Resource) []Route
+	Use(mw ...Middleware)
+	Mount(prefix string, router *Router) error
 	NotifyChange(resource, value string, confirm bool)
+	NotifyContent(resource string, payload []byte, format MediaType, confirm bool)
+	NotifyMessage(resource string, tmpl Message, confirm bool)
+	NotifyObservers(resource string, confirm bool)
+	SetNotifyAttributes(resource string, attrs NotifyAttributes)
+	SetObservationStore(store ObservationStore) error
+	SetObserveMaxAge(maxAge uint32)
 
 	OnNotify(fn FnEventNotify)
 	OnStart(fn FnEventStart)
@@ -253,6 +283,12 @@ type CoapServer interface {
 	RemoveObservation(resource string, addr net.Addr)
 
 	HandlePSK(func(id string) []byte)
+	SetTransmissionParams(p TransmissionParams)
+	SetWorkerPool(workers, queueSize int)
+	SetBlock2Size(size BlockSizeType)
+	SetMaxRequestBodySize(size int)
+	SetBlock1Timeout(timeout time.Duration)
+	SetSessionIdleTimeout(timeout time.Duration)
 
 	GetSession(addr string) Session
 	DeleteSession(ssn Session)
@@ -295,6 +331,7 @@ type Request interface {
 	GetAttributeAsInt(o string) int
 	GetMessage() Message
 	GetURIQuery(q string) string
+	Body() io.Reader
 
 	SetProxyURI(uri string)
 	SetMediaType(mt MediaType)
@@ -304,6 +341,8 @@ type Request interface {
 	SetConfirmable(con bool)
 	SetToken(t string)
 	SetURIQuery(k string, v string)
+
+	DeferResponse() *SeparateResponder
 }
 
 type Response interface {
@@ -314,11 +353,14 @@ type Response interface {
 }
 
 type Connection interface {
-	ObserveResource(resource string) (tok string, err error)
-	CancelObserveResource(resource string, token string) (err error)
-	StopObserve(ch chan ObserveMessage)
-	Observe(ch chan ObserveMessage)
+	Observe(ctx context.Context, resource string) (*Subscription, error)
 	Send(req Request) (resp Response, err error)
+	SendContext(ctx context.Context, req Request) (resp Response, err error)
+	Upload(ctx context.Context, req Request, body io.Reader) (Response, error)
+	Download(ctx context.Context, req Request, w io.Writer) (Response, error)
+	SetTransmissionParams(p TransmissionParams)
+	SetBlock2Size(size BlockSizeType)
+	SetMaxResponseSize(size int)
 
 	Write(b []byte) (n int, err error)
 	Read(b []byte) (n int, err error)
@@ -367,10 +409,17 @@ type Message interface {
 type Route interface {
 	GetMethod() string
 	GetMediaTypes() []MediaType
+	GetProducedMediaTypes() []MediaType
+	GetLinkAttributes() LinkAttributes
 	GetConfiguredPath() string
 
 	Matches(path string) (bool, map[string]string)
 	AutoAcknowledge() bool
+	StreamsBody() bool
+	Use(mw ...Middleware) Route
+	Consumes(mt ...MediaType) Route
+	Produces(mt ...MediaType) Route
+	Describe(link LinkAttributes) Route
 	Handle(req Request) Response
 }
 
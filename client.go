@@ -1,16 +1,24 @@
 package canopus
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 func Dial(address string) (conn Connection, err error) {
-	udpConn, err := net.Dial("udp", address)
+	return DialContext(context.Background(), address)
+}
+
+// DialContext connects to a CoAP endpoint, failing if ctx is done before
+// the address could be resolved
+func DialContext(ctx context.Context, address string) (conn Connection, err error) {
+	var d net.Dialer
+	udpConn, err := d.DialContext(ctx, "udp", address)
 	if err != nil {
 		return
 	}
 
-	conn = &UDPConnection{
-		conn: udpConn,
-	}
+	conn = newUDPConnection(udpConn)
 
 	return
 }
@@ -29,6 +37,30 @@ func DialDTLS(address, identity, psk string) (conn Connection, err error) {
 	return
 }
 
+// DialDTLSContext connects to a CoAPS endpoint and performs the DTLS handshake,
+// which is aborted if ctx is done before it completes
+func DialDTLSContext(ctx context.Context, address, identity, psk string) (conn Connection, err error) {
+	var d net.Dialer
+	udpConn, err := d.DialContext(ctx, "udp", address)
+	if err != nil {
+		return
+	}
+
+	conn, err = NewDTLSConnection(udpConn, identity, psk)
+	if err != nil {
+		udpConn.Close()
+		return
+	}
+
+	err = conn.(*DTLSConnection).Handshake(ctx)
+	if err != nil {
+		udpConn.Close()
+		conn = nil
+	}
+
+	return
+}
+
 func NewObserveMessage(r string, val interface{}, msg Message) ObserveMessage {
 	return &CoapObserveMessage{
 		Resource: r,
@@ -53,5 +85,5 @@ func (m *CoapObserveMessage) GetValue() interface{} {
 }
 
 func (m *CoapObserveMessage) GetMessage() Message {
-	return m.GetMessage()
+	return m.Msg
 }
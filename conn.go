@@ -1,9 +1,9 @@
 package canopus
 
 import (
-	"log"
+	"bytes"
+	"context"
 	"net"
-	"sync"
 )
 
 func MessageSizeAllowed(req Request) bool {
@@ -17,184 +17,67 @@ func MessageSizeAllowed(req Request) bool {
 	return true
 }
 
+// UDPConnection is a client connection to a CoAP endpoint. A single reader
+// routes incoming messages, so it is safe to send requests concurrently
 type UDPConnection struct {
-	conn net.Conn
-}
-
-func (c *UDPConnection) ObserveResource(resource string) (tok string, err error) {
-	req := NewRequest(MessageConfirmable, Get)
-	req.SetRequestURI(resource)
-	req.GetMessage().AddOption(OptionObserve, 0)
+	conn   net.Conn
+	params TransmissionParams
+	mux    *clientMux
 
-	resp, err := c.Send(req)
-	tok = string(resp.GetMessage().GetToken())
-
-	return
+	block2Size      BlockSizeType
+	preferBlock2    bool
+	maxResponseSize int
 }
 
-func (c *UDPConnection) CancelObserveResource(resource string, token string) (err error) {
-	req := NewRequest(MessageConfirmable, Get)
-	req.SetRequestURI(resource)
-	req.GetMessage().AddOption(OptionObserve, 1)
-
-	_, err = c.Send(req)
-	return
-}
+func newUDPConnection(c net.Conn) *UDPConnection {
+	conn := &UDPConnection{
+		conn:            c,
+		params:          DefaultTransmissionParams(),
+		maxResponseSize: DefaultMaxResponseSize,
+	}
+	conn.mux = newClientMux(conn)
 
-func (c *UDPConnection) StopObserve(ch chan ObserveMessage) {
-	close(ch)
+	return conn
 }
 
 func (c *UDPConnection) Close() error {
 	return c.conn.Close()
 }
 
-func (c *UDPConnection) Observe(ch chan ObserveMessage) {
-
-	readBuf := make([]byte, MaxPacketSize)
-	for {
-		len, err := c.Read(readBuf)
-		if err == nil {
-			msgBuf := make([]byte, len)
-			copy(msgBuf, readBuf)
-
-			msg, err := BytesToMessage(msgBuf)
-			if msg.GetOption(OptionObserve) != nil {
-				ch <- NewObserveMessage(msg.GetURIPath(), msg.GetPayload(), msg)
-			}
-			if err != nil {
-				log.Println("Error occured reading UDP", err)
-				close(ch)
-			}
-		} else {
-			log.Println("Error occured reading UDP", err)
-			close(ch)
-		}
-	}
+func (c *UDPConnection) Send(req Request) (resp Response, err error) {
+	return c.SendContext(context.Background(), req)
 }
 
-func (c *UDPConnection) Send(req Request) (resp Response, err error) {
+// SendContext sends a request and waits for its response. If ctx is done
+// before the response arrives, retransmission stops and ctx.Err() is returned
+func (c *UDPConnection) SendContext(ctx context.Context, req Request) (resp Response, err error) {
 	msg := req.GetMessage()
-	opt := msg.GetOption(OptionBlock1)
 
-	if opt == nil { // Block1 was not set
-		if MessageSizeAllowed(req) != true {
-			return nil, ErrMessageSizeTooLongBlockOptionValNotSet
+	// a Block1 option with a value asks for the payload to be sent blockwise,
+	// starting with the given block size
+	if opt := msg.GetOption(OptionBlock1); opt != nil && opt.GetValue() != nil {
+		var payload []byte
+		if msg.GetPayload() != nil {
+			payload = msg.GetPayload().GetBytes()
 		}
-	} else { // Block1 was set
-		// log.Println("Block 1 was set")
+		return c.sendBlock1(ctx, msg, bytes.NewReader(payload), Block1OptionFromOption(opt).Size())
 	}
 
-	if opt != nil {
-		blockOpt := Block1OptionFromOption(opt)
-		if blockOpt.Value == nil {
-			if MessageSizeAllowed(req) != true {
-				err = ErrMessageSizeTooLongBlockOptionValNotSet
-				return
-			} else {
-				// - Block # = one and only block (sz = unspecified), whereas 0 = 16bits
-				// - MOre bit = 0
-			}
-		} else { // BLock transfer request
-			payload := msg.GetPayload().GetBytes()
-			payloadLen := uint32(len(payload))
-			blockSize := blockOpt.BlockSizeLength()
-			currSeq := uint32(0)
-			totalBlocks := uint32(payloadLen / blockSize)
-			completed := false
-
-			var wg sync.WaitGroup
-			wg.Add(1)
-
-			for completed == false {
-				if currSeq <= totalBlocks {
-
-					var blockPayloadStart uint32
-					var blockPayloadEnd uint32
-					var blockPayload []byte
-
-					blockPayloadStart = currSeq * uint32(blockSize)
-
-					more := true
-					if currSeq == totalBlocks {
-						more = false
-						blockPayloadEnd = payloadLen
-					} else {
-						blockPayloadEnd = blockPayloadStart + uint32(blockSize)
-					}
-
-					blockPayload = payload[blockPayloadStart : blockPayloadEnd+1]
-
-					blockOpt = NewBlock1Option(blockOpt.Size(), more, currSeq)
-					msg.ReplaceOptions(blockOpt.Code, []Option{blockOpt})
-					modifiedMsg := msg.(*CoapMessage)
-					modifiedMsg.SetMessageId(GenerateMessageID())
-					modifiedMsg.SetPayload(NewBytesPayload(blockPayload))
-
-					// send message
-					_, err2 := c.SendMessage(msg)
-					if err2 != nil {
-						wg.Done()
-						return
-					}
-					currSeq = currSeq + 1
-
-				} else {
-					completed = true
-					wg.Done()
-				}
-			}
-		}
+	if MessageSizeAllowed(req) != true {
+		return nil, ErrMessageSizeTooLongBlockOptionValNotSet
 	}
-	resp, err = c.SendMessage(msg)
-	return
+
+	return c.sendBlockwise(ctx, msg)
 }
 
 func (c *UDPConnection) SendMessage(msg Message) (resp Response, err error) {
-	if msg == nil {
-		return nil, ErrNilMessage
-	}
-
-	b, err := MessageToBytes(msg)
-	if err != nil {
-		return
-	}
-
-	if msg.GetMessageType() == MessageNonConfirmable {
-		go c.Write(b)
-		resp = NewResponse(NewEmptyMessage(msg.GetMessageId()), nil)
-		return
-	}
-
-	_, err = c.Write(b)
-	if err != nil {
-		return
-	}
-
-	msgBuf := make([]byte, 1500)
-	if msg.GetMessageType() == MessageAcknowledgment {
-		resp = NewResponse(NewEmptyMessage(msg.GetMessageId()), nil)
-		return
-	}
-
-	n, err := c.Read(msgBuf)
-	if err != nil {
-		return
-	}
-
-	respMsg, err := BytesToMessage(msgBuf[:n])
-	if err != nil {
-		return
-	}
-	resp = NewResponse(respMsg, nil)
-
-	if msg.GetMessageType() == MessageConfirmable {
-		// TODO: Send out message and wait for a confirm. If confirmation not retrieved,
-		// resend (taking into account timeouts and back-off transmissions
+	return c.mux.send(context.Background(), msg, c.params)
+}
 
-		// c.Send(NewRequestFromMessage(msg))
-	}
-	return
+// SetTransmissionParams overrides the parameters used when retransmitting
+// Confirmable messages
+func (c *UDPConnection) SetTransmissionParams(p TransmissionParams) {
+	c.params = p
 }
 
 func (c *UDPConnection) Write(b []byte) (int, error) {
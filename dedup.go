@@ -0,0 +1,127 @@
+package canopus
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultDedupCacheSize is the maximum number of message IDs remembered by
+// the server for duplicate detection
+const DefaultDedupCacheSize = 16384
+
+func newDedupCache(params TransmissionParams, maxEntries int) *dedupCache {
+	return &dedupCache{
+		params:     params,
+		maxEntries: maxEntries,
+		entries:    make(map[messageKey]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// dedupCache remembers the message IDs received from each endpoint, along
+// with the response sent for them, so that a duplicate Confirmable message
+// can be answered with the same response (RFC 7252 section 4.5). Entries
+// expire after EXCHANGE_LIFETIME for Confirmable messages, NON_LIFETIME for
+// Non-confirmable ones, and the number of entries is bounded, the oldest
+// being evicted first
+type dedupCache struct {
+	mu         sync.Mutex
+	params     TransmissionParams
+	maxEntries int
+	entries    map[messageKey]*list.Element
+	order      *list.List
+}
+
+type dedupEntry struct {
+	key      messageKey
+	expires  time.Time
+	response []byte
+}
+
+// seen records a message received from an endpoint. If its message ID had
+// already been received, true is returned along with the response which was
+// sent for it, if any
+func (c *dedupCache) seen(endpoint string, msg Message) (bool, []byte) {
+	key := messageKey{endpoint, msg.GetMessageId()}
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*dedupEntry)
+		if now.Before(entry.expires) {
+			return true, entry.response
+		}
+		c.removeElement(elem)
+	}
+
+	for c.order.Len() >= c.maxEntries {
+		c.removeElement(c.order.Front())
+	}
+
+	lifetime := c.params.ExchangeLifetime()
+	if msg.GetMessageType() == MessageNonConfirmable {
+		lifetime = c.params.NonLifetime()
+	}
+
+	c.entries[key] = c.order.PushBack(&dedupEntry{
+		key:     key,
+		expires: now.Add(lifetime),
+	})
+
+	return false, nil
+}
+
+// storeResponse keeps the serialized response sent for a message received
+// from an endpoint, so it can be replayed to duplicates. Only the first
+// response is kept
+func (c *dedupCache) storeResponse(endpoint string, msgID uint16, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[messageKey{endpoint, msgID}]; ok {
+		entry := elem.Value.(*dedupEntry)
+		if entry.response == nil {
+			entry.response = b
+		}
+	}
+}
+
+// setParams changes the parameters used to compute how long message IDs
+// received from now on are kept
+func (c *dedupCache) setParams(params TransmissionParams) {
+	c.mu.Lock()
+	c.params = params
+	c.mu.Unlock()
+}
+
+// purge removes expired entries
+func (c *dedupCache) purge() {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// lifetimes differ by message type, so entries are not ordered by expiry
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if !now.Before(elem.Value.(*dedupEntry).expires) {
+			c.removeElement(elem)
+		}
+		elem = next
+	}
+}
+
+func (c *dedupCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *dedupCache) removeElement(elem *list.Element) {
+	delete(c.entries, elem.Value.(*dedupEntry).key)
+	c.order.Remove(elem)
+}
@@ -0,0 +1,138 @@
+package canopus
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupCache(t *testing.T) {
+	c := newDedupCache(DefaultTransmissionParams(), 3)
+	con := func(id uint16) Message {
+		return NewMessageOfType(MessageConfirmable, id, nil)
+	}
+
+	dup, _ := c.seen("a", con(1))
+	assert.False(t, dup)
+
+	dup, resp := c.seen("a", con(1))
+	assert.True(t, dup)
+	assert.Nil(t, resp)
+
+	// same message id from another endpoint
+	dup, _ = c.seen("b", con(1))
+	assert.False(t, dup)
+
+	c.storeResponse("a", 1, []byte("first"))
+	c.storeResponse("a", 1, []byte("second"))
+	dup, resp = c.seen("a", con(1))
+	assert.True(t, dup)
+	assert.Equal(t, "first", string(resp))
+
+	// oldest entry is evicted once full
+	c.seen("a", con(2))
+	c.seen("a", con(3))
+	assert.Equal(t, 3, c.len())
+	dup, _ = c.seen("a", con(1))
+	assert.False(t, dup)
+}
+
+func TestDedupCacheExpiry(t *testing.T) {
+	// EXCHANGE_LIFETIME is dominated by MAX_LATENCY, so it can't be shortened
+	// enough for a test; expire entries by moving them into the past instead
+	c := newDedupCache(DefaultTransmissionParams(), DefaultDedupCacheSize)
+	c.seen("a", NewMessageOfType(MessageConfirmable, 1, nil))
+	c.seen("a", NewMessageOfType(MessageNonConfirmable, 2, nil))
+	c.seen("a", NewMessageOfType(MessageConfirmable, 3, nil))
+
+	con := c.entries[messageKey{"a", 1}].Value.(*dedupEntry)
+	non := c.entries[messageKey{"a", 2}].Value.(*dedupEntry)
+	assert.True(t, con.expires.After(non.expires))
+
+	lifetime := DefaultTransmissionParams().NonLifetime()
+	con.expires = con.expires.Add(-lifetime)
+	non.expires = non.expires.Add(-lifetime)
+	c.purge()
+	assert.Equal(t, 2, c.len())
+
+	dup, _ := c.seen("a", NewMessageOfType(MessageNonConfirmable, 2, nil))
+	assert.False(t, dup)
+	dup, _ = c.seen("a", NewMessageOfType(MessageConfirmable, 1, nil))
+	assert.True(t, dup)
+}
+
+func TestServerReplaysResponseToDuplicate(t *testing.T) {
+	s := NewServer()
+
+	calls := 0
+	s.Get("/dup", func(req Request) Response {
+		calls++
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.SetStringPayload("once")
+		return NewResponseWithMessage(msg)
+	})
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	req := NewRequestWithMessageId(MessageConfirmable, Get, GenerateMessageID())
+	req.SetRequestURI("/dup")
+	msg := req.GetMessage()
+
+	server := s.(*DefaultCoapServer)
+	server.handleRequest(msg, session)
+	server.handleRequest(msg, session)
+
+	buf := make([]byte, MaxPacketSize)
+	n, _, err := peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	first := append([]byte(nil), buf[:n]...)
+
+	n, _, err = peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(first, buf[:n]))
+	assert.Equal(t, 1, calls)
+
+	resp, err := BytesToMessage(first)
+	assert.Nil(t, err)
+	assert.Equal(t, MessageAcknowledgment, int(resp.GetMessageType()))
+	assert.Equal(t, "once", resp.GetPayload().String())
+}
+
+func TestServerSameMessageIDFromTwoEndpoints(t *testing.T) {
+	s := NewServer()
+
+	calls := 0
+	s.Get("/mid", func(req Request) Response {
+		calls++
+		return NewResponseWithMessage(ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+	})
+
+	session1, peer1 := newTestSession(t, s)
+	defer peer1.Close()
+	defer session1.GetConnection().Close()
+
+	session2, peer2 := newTestSession(t, s)
+	defer peer2.Close()
+	defer session2.GetConnection().Close()
+
+	req := NewRequestWithMessageId(MessageConfirmable, Get, 4242)
+	req.SetRequestURI("/mid")
+
+	server := s.(*DefaultCoapServer)
+	server.handleRequest(req.GetMessage(), session1)
+	server.handleRequest(req.GetMessage(), session2)
+
+	buf := make([]byte, MaxPacketSize)
+	for _, peer := range []net.PacketConn{peer1, peer2} {
+		n, _, err := peer.ReadFrom(buf)
+		assert.Nil(t, err)
+		resp, err := BytesToMessage(buf[:n])
+		assert.Nil(t, err)
+		assert.Equal(t, CoapCodeContent, resp.GetCode())
+	}
+	assert.Equal(t, 2, calls)
+}
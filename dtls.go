@@ -150,6 +150,10 @@ static void init_ctx(SSL_CTX *ctx) {
 	SSL_CTX_set_psk_client_callback(ctx,&psk_callback);
 }
 
+static void set_retry_read(BIO* bio) {
+	BIO_set_retry_read(bio);
+}
+
 static void setGoClientId(BIO* bio, unsigned int clientId) {
 	unsigned int * pId = malloc(sizeof(unsigned int));
 	*pId = clientId;
@@ -160,6 +164,7 @@ static void setGoClientId(BIO* bio, unsigned int clientId) {
 import "C"
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"errors"
@@ -170,6 +175,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -213,21 +219,27 @@ type ServerDtlsContext struct {
 
 //export go_session_bio_read
 func go_session_bio_read(bio *C.BIO, buf *C.char, num C.int) C.int {
-	session := DTLS_SERVER_SESSIONS[*(*int32)(C.BIO_get_data(bio))]
-	socketData := <-session.rcvd
+	session := dtlsServerSession(*(*int32)(C.BIO_get_data(bio)))
+
+	// the datagram passed by Read, if not consumed yet
+	if session.datagram == nil {
+		C.set_retry_read(bio)
+		return C.int(-1)
+	}
 
 	data := goSliceFromCString(buf, int(num))
 	if data == nil {
 		return 0
 	}
 
-	wrote := copy(data, socketData)
+	wrote := copy(data, session.datagram)
+	session.datagram = nil
 	return C.int(wrote)
 }
 
 //export go_session_bio_write
 func go_session_bio_write(bio *C.BIO, buf *C.char, num C.int) C.int {
-	session := DTLS_SERVER_SESSIONS[*(*int32)(C.BIO_get_data(bio))]
+	session := dtlsServerSession(*(*int32)(C.BIO_get_data(bio)))
 	data := goSliceFromCString(buf, int(num))
 
 	n, err := session.GetConnection().WriteTo(data, session.GetAddress())
@@ -263,7 +275,7 @@ func go_session_bio_free(bio *C.BIO) C.int {
 //export go_server_psk_callback
 func go_server_psk_callback(ssl *C.SSL, identity *C.char, psk *C.char, max_psk_len C.uint) C.uint {
 	bio := C.SSL_get_rbio(ssl)
-	session := DTLS_SERVER_SESSIONS[*(*int32)(C.BIO_get_data(bio))]
+	session := dtlsServerSession(*(*int32)(C.BIO_get_data(bio)))
 	server := session.GetServer().(*DefaultCoapServer)
 
 	goPskID := C.GoString(identity)
@@ -278,6 +290,10 @@ func go_server_psk_callback(ssl *C.SSL, identity *C.char, psk *C.char, max_psk_l
 		return 0
 	}
 
+	session.identityMu.Lock()
+	session.identity = goPskID
+	session.identityMu.Unlock()
+
 	targetPsk := goSliceFromCString(psk, int(max_psk_len))
 	return C.uint(copy(targetPsk, serverPsk))
 }
@@ -285,7 +301,7 @@ func go_server_psk_callback(ssl *C.SSL, identity *C.char, psk *C.char, max_psk_l
 //export generate_cookie_callback
 func generate_cookie_callback(ssl *C.SSL, cookie *C.uchar, cookie_len *C.uint) C.int {
 	bio := C.SSL_get_rbio(ssl)
-	session := DTLS_SERVER_SESSIONS[*(*int32)(C.BIO_get_data(bio))]
+	session := dtlsServerSession(*(*int32)(C.BIO_get_data(bio)))
 
 	mac := hmac.New(sha256.New, session.GetServer().GetCookieSecret())
 	mac.Write([]byte(session.GetAddress().String()))
@@ -306,7 +322,7 @@ func generate_cookie_callback(ssl *C.SSL, cookie *C.uchar, cookie_len *C.uint) C
 //export verify_cookie_callback
 func verify_cookie_callback(ssl *C.SSL, cookie *C.uchar, cookie_len C.uint) C.int {
 	bio := C.SSL_get_rbio(ssl)
-	session := DTLS_SERVER_SESSIONS[*(*int32)(C.BIO_get_data(bio))]
+	session := dtlsServerSession(*(*int32)(C.BIO_get_data(bio)))
 
 	mac := hmac.New(sha256.New, session.GetServer().GetCookieSecret())
 	mac.Write([]byte(session.GetAddress().String()))
@@ -368,7 +384,7 @@ func getErrorString(code C.ulong) string {
 	var data *C.char
 	var flags C.int
 	if int(C.ERR_get_error_line_data(&file, &line, &data, &flags)) != 0 {
-		msg += fmt.Sprintf("%s:%s", C.GoString(file), int(line))
+		msg += fmt.Sprintf("%s:%d", C.GoString(file), int(line))
 		if flags&C.ERR_TXT_STRING != 0 {
 			msg += ":" + C.GoString(data)
 		}
@@ -396,10 +412,13 @@ func newSslSession(session *DTLSServerSession, ctx *ServerDtlsContext, pskCallba
 	}
 	C.SSL_set_bio(ssl, bio, bio)
 
+	session.id = id
 	session.ssl = ssl
 	session.bio = bio
 
+	dtlsSessionsMu.Lock()
 	DTLS_SERVER_SESSIONS[id] = session
+	dtlsSessionsMu.Unlock()
 
 	C.setGoSessionId(bio, C.uint(id))
 
@@ -412,8 +431,31 @@ func newSslSession(session *DTLSServerSession, ctx *ServerDtlsContext, pskCallba
 
 type DTLSServerSession struct {
 	UDPServerSession
+	id  int32
 	ssl *C.SSL
 	bio *C.BIO
+
+	// closed by Close, releasing any pending read
+	quit chan struct{}
+
+	// guards every use of ssl, and the datagram read by the BIO within
+	// SSL_read
+	sslMu    sync.Mutex
+	closed   bool
+	reads    sync.WaitGroup
+	datagram []byte
+
+	// PSK identity of the client, once the handshake is done
+	identityMu sync.Mutex
+	identity   string
+}
+
+// Identity returns the PSK identity the client authenticated with
+func (s *DTLSServerSession) Identity() string {
+	s.identityMu.Lock()
+	defer s.identityMu.Unlock()
+
+	return s.identity
 }
 
 func (s *DTLSServerSession) GetConnection() ServerConnection {
@@ -421,7 +463,13 @@ func (s *DTLSServerSession) GetConnection() ServerConnection {
 }
 
 func (s *DTLSServerSession) Write(b []byte) (int, error) {
-	// TODO test is connected ?
+	s.sslMu.Lock()
+	defer s.sslMu.Unlock()
+
+	if s.closed {
+		return 0, ErrConnectionClosed
+	}
+
 	length := len(b)
 	ret := C.SSL_write(s.ssl, unsafe.Pointer(&b[0]), C.int(length))
 	if err := s.getError(ret); err != nil {
@@ -430,25 +478,87 @@ func (s *DTLSServerSession) Write(b []byte) (int, error) {
 	return int(ret), nil
 }
 
-func (s *DTLSServerSession) Read(b []byte) (n int, err error) {
-	// TODO test if closed?
-	length := len(b)
-	// s.rcvd <- s.buf
+// Read waits for a datagram without holding the SSL lock, so that writes
+// aren't blocked meanwhile, and then decrypts it
+func (s *DTLSServerSession) Read(b []byte) (int, error) {
+	s.sslMu.Lock()
+	if s.closed {
+		s.sslMu.Unlock()
+		return 0, io.EOF
+	}
+	s.reads.Add(1)
+	s.sslMu.Unlock()
+	defer s.reads.Done()
 
-	ret := C.SSL_read(s.ssl, unsafe.Pointer(&b[0]), C.int(length))
-	if err = s.getError(ret); err != nil {
-		n = 0
-		return
+	for {
+		s.sslMu.Lock()
+		buffered := !s.closed && C.SSL_has_pending(s.ssl) == 1
+		s.sslMu.Unlock()
+
+		var datagram []byte
+		if !buffered {
+			select {
+			case datagram = <-s.rcvd:
+			case <-s.quit:
+				return 0, io.EOF
+			}
+		}
+
+		s.sslMu.Lock()
+		if s.closed {
+			s.sslMu.Unlock()
+			return 0, io.EOF
+		}
+		s.datagram = datagram
+		ret := C.SSL_read(s.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+		s.datagram = nil
+		if ret <= 0 && C.SSL_get_error(s.ssl, ret) == C.SSL_ERROR_WANT_READ {
+			// no application data in the datagram, such as a handshake
+			// record
+			s.sslMu.Unlock()
+			continue
+		}
+		err := s.getError(ret)
+		s.sslMu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+
+		// if there's no error, but a return value of 0
+		// let's say it's an EOF
+		if ret == 0 {
+			return 0, io.EOF
+		}
+
+		return int(ret), nil
 	}
-	// if there's no error, but a return value of 0
-	// let's say it's an EOF
-	if ret == 0 {
-		n = 0
-		err = io.EOF
-		return
+}
+
+// Close sends a close_notify alert to the peer and frees the session, once
+// pending reads have been released
+func (s *DTLSServerSession) Close() error {
+	s.sslMu.Lock()
+	if s.closed {
+		s.sslMu.Unlock()
+		return nil
 	}
-	n = int(ret)
-	return
+	s.closed = true
+	s.sslMu.Unlock()
+
+	close(s.quit)
+	s.reads.Wait()
+
+	s.sslMu.Lock()
+	C.SSL_shutdown(s.ssl)
+	C.SSL_free(s.ssl)
+	s.sslMu.Unlock()
+
+	dtlsSessionsMu.Lock()
+	delete(DTLS_SERVER_SESSIONS, s.id)
+	dtlsSessionsMu.Unlock()
+
+	return nil
 }
 
 func (s *DTLSServerSession) getError(ret C.int) error {
@@ -496,271 +606,211 @@ func NewDTLSConnection(c net.Conn, identity, psk string) (conn Connection, err e
 	// self := DTLSClient{false, 0, C.BIO_new(C.BIO_go()), dtlsCtx.ctx, ssl, conn, nil, nil}
 	bio := C.BIO_new(C.BIO_go())
 
-	conn = &DTLSConnection{
+	id := atomic.AddInt32(&NEXT_SESSION_ID, 1)
+	dtlsConn := &DTLSConnection{
 		UDPConnection: UDPConnection{
-			conn: c,
+			conn:            c,
+			params:          DefaultTransmissionParams(),
+			maxResponseSize: DefaultMaxResponseSize,
 		},
+		id:     id,
 		sslCtx: sslCtx,
 		ssl:    ssl,
 		bio:    bio,
 		psk:    []byte(psk),
 		pskId:  &identity,
 	}
+	dtlsConn.mux = newClientMux(dtlsConn)
+	conn = dtlsConn
 
 	C.SSL_set_bio(ssl, bio, bio)
 
-	id := atomic.AddInt32(&NEXT_SESSION_ID, 1)
 	C.setGoClientId(bio, C.uint(id))
+	dtlsSessionsMu.Lock()
 	DTLS_CLIENT_CONNECTIONS[id] = conn.(*DTLSConnection)
+	dtlsSessionsMu.Unlock()
 
 	return
 }
 
 type DTLSConnection struct {
 	UDPConnection
-	closed    bool
-	connected int32 // connection handshake was done, atomic (0 false, 1 true)
-	sslCtx    *C.SSL_CTX
-	bio       *C.BIO
-	ssl       *C.SSL
-	pskId     *string
-	psk       []byte
-}
-
-func (c *DTLSConnection) ObserveResource(resource string) (tok string, err error) {
-	req := NewRequest(MessageConfirmable, Get)
-	req.SetRequestURI(resource)
-	req.GetMessage().AddOption(OptionObserve, 0)
+	id     int32
+	sslCtx *C.SSL_CTX
+	bio    *C.BIO
+	ssl    *C.SSL
+	pskId  *string
+	psk    []byte
 
-	resp, err := c.Send(req)
-	tok = string(resp.GetMessage().GetToken())
+	// guards every use of ssl, and the fields below which are also used by
+	// the BIO callbacks running within SSL calls
+	sslMu      sync.Mutex
+	closed     bool
+	connected  bool // the handshake was done, successfully or not
+	connectErr error
+	readErr    error
 
-	return
+	// datagram read from the connection and being decrypted, the BIO reading
+	// from it rather than from the connection once the handshake is done
+	datagram []byte
 }
 
-func (c *DTLSConnection) CancelObserveResource(resource string, token string) (err error) {
-	req := NewRequest(MessageConfirmable, Get)
-	req.SetRequestURI(resource)
-	req.GetMessage().AddOption(OptionObserve, 1)
-
-	_, err = c.Send(req)
-	return
+func (c *DTLSConnection) Send(req Request) (resp Response, err error) {
+	return c.SendContext(context.Background(), req)
 }
 
-func (c *DTLSConnection) StopObserve(ch chan ObserveMessage) {
-	close(ch)
-}
+func (c *DTLSConnection) Write(b []byte) (int, error) {
+	if err := c.Handshake(context.Background()); err != nil {
+		return 0, err
+	}
 
-func (c *DTLSConnection) Observe(ch chan ObserveMessage) {
+	c.sslMu.Lock()
+	defer c.sslMu.Unlock()
 
-	readBuf := make([]byte, MaxPacketSize)
-	for {
-		len, err := c.Read(readBuf)
-		if err == nil {
-			msgBuf := make([]byte, len)
-			copy(msgBuf, readBuf)
-
-			msg, err := BytesToMessage(msgBuf)
-			if msg.GetOption(OptionObserve) != nil {
-				ch <- NewObserveMessage(msg.GetURIPath(), msg.GetPayload(), msg)
-			}
-			if err != nil {
-				logMsg("Error occured reading UDP", err)
-				close(ch)
-			}
-		} else {
-			logMsg("Error occured reading UDP", err)
-			close(ch)
-		}
+	if c.closed {
+		return 0, ErrConnectionClosed
 	}
-}
 
-func (c *DTLSConnection) Send(req Request) (resp Response, err error) {
-	msg := req.GetMessage()
-	opt := msg.GetOption(OptionBlock1)
+	length := len(b)
+	ret := C.SSL_write(c.ssl, unsafe.Pointer(&b[0]), C.int(length))
+	if err := c.getError(ret); err != nil {
+		return 0, err
+	}
 
-	if opt == nil { // Block1 was not set
-		if MessageSizeAllowed(req) != true {
-			return nil, ErrMessageSizeTooLongBlockOptionValNotSet
-		}
+	return int(ret), nil
+}
 
-	} else { // Block1 was set
-		// fmt.Println("Block 1 was set")
+// Read waits for a datagram without holding the SSL lock, so that writes
+// aren't blocked meanwhile, and then decrypts it
+func (c *DTLSConnection) Read(b []byte) (int, error) {
+	if err := c.Handshake(context.Background()); err != nil {
+		return 0, err
 	}
 
-	if opt != nil {
-		blockOpt := Block1OptionFromOption(opt)
-
-		if blockOpt.Value == nil {
-			if MessageSizeAllowed(req) != true {
-				err = ErrMessageSizeTooLongBlockOptionValNotSet
-				return
-			} else {
-				// - Block # = one and only block (sz = unspecified), whereas 0 = 16bits
-				// - MOre bit = 0
-			}
-		} else { // BLock transfer request
-			payload := msg.GetPayload().GetBytes()
-			payloadLen := uint32(len(payload))
-			blockSize := blockOpt.BlockSizeLength()
-			currSeq := uint32(0)
-			totalBlocks := uint32(payloadLen / blockSize)
-			completed := false
-
-			var wg sync.WaitGroup
-			wg.Add(1)
-
-			for completed == false {
-				if currSeq <= totalBlocks {
-
-					var blockPayloadStart uint32
-					var blockPayloadEnd uint32
-					var blockPayload []byte
-
-					blockPayloadStart = currSeq*uint32(blockSize) + (currSeq * 1)
-
-					more := true
-					if currSeq == totalBlocks {
-						more = false
-						blockPayloadEnd = payloadLen
-					} else {
-						blockPayloadEnd = blockPayloadStart + uint32(blockSize)
-					}
-
-					blockPayload = payload[blockPayloadStart:blockPayloadEnd]
-
-					blockOpt = NewBlock1Option(blockOpt.Size(), more, currSeq)
-					msg.ReplaceOptions(blockOpt.Code, []Option{blockOpt})
-					modifiedMsg := msg.(*CoapMessage)
-					modifiedMsg.SetMessageId(GenerateMessageID())
-					modifiedMsg.SetPayload(NewBytesPayload(blockPayload))
-
-					// send message
-					_, err2 := c.sendMessage(msg)
-					if err2 != nil {
-						wg.Done()
-						return
-					}
-					currSeq = currSeq + 1
-
-				} else {
-					completed = true
-					wg.Done()
-				}
+	datagram := make([]byte, MaxPacketSize)
+	for {
+		c.sslMu.Lock()
+		buffered := !c.closed && C.SSL_has_pending(c.ssl) == 1
+		c.sslMu.Unlock()
+
+		n := 0
+		if !buffered {
+			var err error
+			if n, err = c.conn.Read(datagram); err != nil {
+				// timeouts are reported so that callers can retransmit
+				return 0, err
 			}
 		}
-	}
-	resp, err = c.sendMessage(msg)
-	return
-}
 
-func (c *DTLSConnection) sendMessage(msg Message) (resp Response, err error) {
-
-	if msg == nil {
-		return nil, ErrNilMessage
-	}
-
-	b, err := MessageToBytes(msg)
-	if err != nil {
-		return
-	}
+		c.sslMu.Lock()
+		if c.closed {
+			c.sslMu.Unlock()
+			return 0, ErrConnectionClosed
+		}
+		c.datagram = datagram[:n]
+		ret := C.SSL_read(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+		c.datagram = nil
+		if ret <= 0 && C.SSL_get_error(c.ssl, ret) == C.SSL_ERROR_WANT_READ {
+			// no application data in the datagram, such as a retransmitted
+			// handshake record
+			c.sslMu.Unlock()
+			continue
+		}
+		err := c.getError(ret)
+		c.sslMu.Unlock()
 
-	if msg.GetMessageType() == MessageNonConfirmable {
-		go c.Write(b)
-		resp = NewResponse(NewEmptyMessage(msg.GetMessageId()), nil)
-		return
-	}
+		if err != nil {
+			return 0, err
+		}
 
-	_, err = c.Write(b)
-	if err != nil {
-		return
-	}
+		// if there's no error, but a return value of 0
+		// let's say it's an EOF
+		if ret == 0 {
+			return 0, io.EOF
+		}
 
-	msgBuf := make([]byte, 1500)
-	if msg.GetMessageType() == MessageAcknowledgment {
-		resp = NewResponse(NewEmptyMessage(msg.GetMessageId()), nil)
-		return
+		return int(ret), nil
 	}
+}
 
-	n, err := c.Read(msgBuf)
-	if err != nil {
-		return
-	}
+// Close sends a close_notify alert to the peer, without waiting for its own,
+// and closes the underlying connection
+func (c *DTLSConnection) Close() error {
+	c.sslMu.Lock()
+	defer c.sslMu.Unlock()
 
-	respMsg, err := BytesToMessage(msgBuf[:n])
-	if err != nil {
-		return
+	if c.closed {
+		return nil
 	}
+	c.closed = true
 
-	resp = NewResponse(respMsg, nil)
+	C.SSL_shutdown(c.ssl)
+	C.SSL_free(c.ssl)
 
-	if msg.GetMessageType() == MessageConfirmable {
-		// TODO: Send out message and wait for a confirm. If confirmation not retrieved,
-		// resend (taking into account timeouts and back-off transmissions
+	dtlsSessionsMu.Lock()
+	delete(DTLS_CLIENT_CONNECTIONS, c.id)
+	dtlsSessionsMu.Unlock()
 
-		// c.Send(NewRequestFromMessage(msg))
-	}
-	return
+	return c.conn.Close()
 }
 
-func (c *DTLSConnection) Write(b []byte) (int, error) {
-	if atomic.CompareAndSwapInt32(&c.connected, 0, 1) {
-		if err := c.connect(); err != nil {
-			return 0, err
-		}
+// Handshake performs the DTLS handshake if it has not been done yet. If ctx is
+// done before the handshake completes, it is aborted and ctx.Err() is
+// returned, the next call starting it over
+func (c *DTLSConnection) Handshake(ctx context.Context) error {
+	c.sslMu.Lock()
+	defer c.sslMu.Unlock()
+
+	if c.closed {
+		return ErrConnectionClosed
 	}
-	length := len(b)
-	ret := C.SSL_write(c.ssl, unsafe.Pointer(&b[0]), C.int(length))
-	if err := c.getError(ret); err != nil {
-		return 0, err
+	if c.connected {
+		return c.connectErr
 	}
 
-	return int(ret), nil
-}
+	var mu sync.Mutex
+	finished := false
+	stop := make(chan struct{})
+	defer close(stop)
 
-func (c *DTLSConnection) Read(b []byte) (int, error) {
-	if atomic.CompareAndSwapInt32(&c.connected, 0, 1) {
-		if err := c.connect(); err != nil {
-			return 0, err
-		}
-	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock the handshake's pending read
+			mu.Lock()
+			if !finished {
+				c.conn.SetDeadline(time.Now())
+			}
+			mu.Unlock()
 
-	length := len(b)
-	ret := C.SSL_read(c.ssl, unsafe.Pointer(&b[0]), C.int(length))
-	if err := c.getError(ret); err != nil {
-		return 0, err
-	}
+		case <-stop:
+		}
+	}()
 
-	// if there's no error, but a return value of 0
-	// let's say it's an EOF
-	if ret == 0 {
-		return 0, io.EOF
-	}
+	err := c.connect()
 
-	return int(ret), nil
-}
+	mu.Lock()
+	finished = true
+	c.conn.SetDeadline(time.Time{})
+	mu.Unlock()
 
-func (c *DTLSConnection) Close() error {
-	if c.closed {
-		return nil
+	if err != nil && ctx.Err() != nil {
+		// aborted, the handshake starts over on the next call
+		C.SSL_clear(c.ssl)
+		return ctx.Err()
 	}
-	c.closed = true
-	defer func() {
-		C.SSL_free(c.ssl)
-	}()
+	c.connected = true
+	c.connectErr = err
 
-	ret := C.SSL_shutdown(c.ssl)
-	if int(ret) == 0 {
-		ret = C.SSL_shutdown(c.ssl)
-		if int(ret) != 1 {
-			return c.getError(ret)
-		}
-	}
-	return nil
+	return err
 }
 
 func (c *DTLSConnection) connect() error {
+	c.readErr = nil
 	ret := C.SSL_connect(c.ssl)
+	if ret <= 0 && c.readErr != nil {
+		return c.readErr
+	}
 	if err := c.getError(ret); err != nil {
 		return err
 	}
@@ -796,7 +846,7 @@ func (c *DTLSConnection) getError(ret C.int) error {
 
 //export go_conn_bio_write
 func go_conn_bio_write(bio *C.BIO, buf *C.char, num C.int) C.int {
-	client := DTLS_CLIENT_CONNECTIONS[*(*int32)(C.BIO_get_data(bio))]
+	client := dtlsClientConnection(*(*int32)(C.BIO_get_data(bio)))
 	data := goSliceFromCString(buf, int(num))
 	n, err := client.conn.Write(data)
 	if err != nil && err != io.EOF {
@@ -817,8 +867,18 @@ func go_conn_bio_write(bio *C.BIO, buf *C.char, num C.int) C.int {
 
 //export go_conn_bio_read
 func go_conn_bio_read(bio *C.BIO, buf *C.char, num C.int) C.int {
-	client := DTLS_CLIENT_CONNECTIONS[*(*int32)(C.BIO_get_data(bio))]
+	client := dtlsClientConnection(*(*int32)(C.BIO_get_data(bio)))
 	data := goSliceFromCString(buf, int(num))
+	if client.connected {
+		if client.datagram == nil {
+			C.set_retry_read(bio)
+			return C.int(-1)
+		}
+		n := copy(data, client.datagram)
+		client.datagram = nil
+		return C.int(n)
+	}
+
 	n, err := client.conn.Read(data)
 	if err == nil {
 		return C.int(n)
@@ -827,6 +887,12 @@ func go_conn_bio_read(bio *C.BIO, buf *C.char, num C.int) C.int {
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return 0
 	}
+
+	if IsTimeoutError(err) {
+		client.readErr = err
+		C.set_retry_read(bio)
+		return C.int(-1)
+	}
 	//We expect either a syscall error
 	//or a netOp error wrapping a syscall error
 
@@ -843,8 +909,7 @@ TESTERR:
 
 //export go_conn_bio_free
 func go_conn_bio_free(bio *C.BIO) C.int {
-	client := DTLS_CLIENT_CONNECTIONS[*(*int32)(C.BIO_get_data(bio))]
-	client.Close()
+	// freed by Close, which releases the connection
 	if C.int(C.BIO_get_shutdown(bio)) != 0 {
 		C.BIO_set_data(bio, nil)
 		C.BIO_set_flags(bio, 0)
@@ -856,7 +921,7 @@ func go_conn_bio_free(bio *C.BIO) C.int {
 //export go_psk_callback
 func go_psk_callback(ssl *C.SSL, hint *C.char, identity *C.char, max_identity_len C.uint, psk *C.char, max_psk_len C.uint) C.uint {
 	bio := C.SSL_get_rbio(ssl)
-	client := DTLS_CLIENT_CONNECTIONS[*(*int32)(C.BIO_get_data(bio))]
+	client := dtlsClientConnection(*(*int32)(C.BIO_get_data(bio)))
 
 	if client.pskId == nil || client.psk == nil {
 		return 0
@@ -0,0 +1,117 @@
+package canopus
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPSK = "secretPSK"
+
+// startTestDTLSServer starts serving DTLS on loopback, accepting testPSK for
+// every identity
+func startTestDTLSServer(t *testing.T, s CoapServer) string {
+	s.HandlePSK(func(id string) []byte {
+		return []byte(testPSK)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go s.ServeDTLS(pc)
+
+	return pc.LocalAddr().String()
+}
+
+func TestDTLSSessionConcurrentReadsAndWrites(t *testing.T) {
+	s := NewServer()
+	s.Get("/reading", textHandler("21"))
+
+	addr := startTestDTLSServer(t, s)
+	defer s.Stop()
+
+	conn, err := DialDTLS(addr, "sensor", testPSK)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	sub, err := conn.Observe(context.Background(), "/reading")
+	if !assert.Nil(t, err) {
+		return
+	}
+	<-sub.Notifications()
+
+	// notifications are written to the session while it reads requests
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.NotifyChange("/reading", strconv.Itoa(i), false)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := NewRequest(MessageConfirmable, Get)
+			req.SetRequestURI("/reading")
+
+			resp, err := conn.Send(req)
+			assert.Nil(t, err)
+			if err == nil {
+				assert.Equal(t, "21", resp.GetMessage().GetPayload().String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDTLSHandshakeCancelled(t *testing.T) {
+	s := NewServer()
+	s.Get("/reading", textHandler("21"))
+	s.HandlePSK(func(id string) []byte {
+		return []byte(testPSK)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	conn, err := DialDTLS(pc.LocalAddr().String(), "sensor", testPSK)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/reading")
+
+	// the server doesn't answer the handshake
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = conn.SendContext(ctx, req)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the handshake starts over once the server answers
+	buf := make([]byte, MaxPacketSize)
+	for {
+		pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, _, err := pc.ReadFrom(buf); err != nil {
+			break
+		}
+	}
+	pc.SetReadDeadline(time.Time{})
+	go s.ServeDTLS(pc)
+	defer s.Stop()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := conn.SendContext(ctx, req)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "21", resp.GetMessage().GetPayload().String())
+	}
+}
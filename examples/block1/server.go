@@ -40,6 +40,7 @@ func main() {
 		// canopus.PrintMessage(msg)
 	})
 
-	server.ListenAndServe(":5683")
-	<-make(chan struct{})
+	if err := server.ListenAndServe(":5683"); err != nil {
+		panic(err.Error())
+	}
 }
@@ -12,7 +12,11 @@ func main() {
 	fmt.Println("Starting up")
 	server := canopus.NewServer()
 
-	server.ListenAndServeDTLS(":5682")
+	go func() {
+		if err := server.ListenAndServeDTLS(":5682"); err != nil {
+			panic(err.Error())
+		}
+	}()
 
 	fmt.Println("New Request..")
 	req := canopus.NewRequest(canopus.MessageConfirmable, canopus.Post, canopus.GenerateMessageID())
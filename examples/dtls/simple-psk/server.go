@@ -22,7 +22,7 @@ func main() {
 		return []byte("secretPSK")
 	})
 
-	server.ListenAndServeDTLS(":5684")
-
-	<-make(chan struct{})
+	if err := server.ListenAndServeDTLS(":5684"); err != nil {
+		panic(err.Error())
+	}
 }
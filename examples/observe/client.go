@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/zubairhamed/canopus"
@@ -8,43 +9,28 @@ import (
 
 func main() {
 	conn, err := canopus.Dial("localhost:5683")
-
-	tok, err := conn.ObserveResource("/watch/this")
 	if err != nil {
 		panic(err.Error())
 	}
 
-	obsChannel := make(chan canopus.ObserveMessage)
-	done := make(chan bool)
-	go conn.Observe(obsChannel)
+	sub, err := conn.Observe(context.Background(), "/watch/this")
+	if err != nil {
+		panic(err.Error())
+	}
 
 	notifyCount := 0
-	go func() {
-		for {
-			select {
-			case obsMsg, open := <-obsChannel:
-				if open {
-					if notifyCount == 5 {
-						fmt.Println("[CLIENT >> ] Canceling observe after 5 notifications..")
-						go conn.CancelObserveResource("watch/this", tok)
-						go conn.StopObserve(obsChannel)
-						done <- true
-						return
-					} else {
-						notifyCount++
-						// msg := obsMsg.Msg\
-						resource := obsMsg.GetResource()
-						val := obsMsg.GetValue()
-
-						fmt.Println("[CLIENT >> ] Got Change Notification for resource and value: ", notifyCount, resource, val)
-					}
-				} else {
-					done <- true
-					return
-				}
-			}
+	for obsMsg := range sub.Notifications() {
+		if notifyCount == 5 {
+			fmt.Println("[CLIENT >> ] Canceling observe after 5 notifications..")
+			sub.Cancel()
+			break
 		}
-	}()
-	<-done
+		notifyCount++
+
+		resource := obsMsg.GetResource()
+		val := obsMsg.GetValue()
+
+		fmt.Println("[CLIENT >> ] Got Change Notification for resource and value: ", notifyCount, resource, val)
+	}
 	fmt.Println("Done")
 }
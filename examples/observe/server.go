@@ -39,6 +39,7 @@ func main() {
 		fmt.Println("[SERVER << ] Observe Requested for " + resource)
 	})
 
-	server.ListenAndServe(":5683")
-	<-make(chan struct{})
+	if err := server.ListenAndServe(":5683"); err != nil {
+		panic(err.Error())
+	}
 }
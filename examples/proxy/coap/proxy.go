@@ -14,6 +14,7 @@ func main() {
 
 		return res
 	})
-	server.ListenAndServe(":5683")
-	<-make(chan struct{})
+	if err := server.ListenAndServe(":5683"); err != nil {
+		panic(err.Error())
+	}
 }
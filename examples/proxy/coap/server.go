@@ -13,6 +13,7 @@ func main() {
 
 		return res
 	})
-	server.ListenAndServe(":5685")
-	<-make(chan struct{})
+	if err := server.ListenAndServe(":5685"); err != nil {
+		panic(err.Error())
+	}
 }
@@ -6,7 +6,8 @@ func main() {
 	server := canopus.NewServer()
 	server.ProxyOverHttp(true)
 
-	server.ListenAndServe(":5683")
-	<-make(chan struct{})
+	if err := server.ListenAndServe(":5683"); err != nil {
+		panic(err.Error())
+	}
 
 }
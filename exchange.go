@@ -0,0 +1,194 @@
+package canopus
+
+import (
+	"sync"
+	"time"
+)
+
+func newExchangeTracker(params TransmissionParams, events Events) *exchangeTracker {
+	return &exchangeTracker{
+		params:    params,
+		events:    events,
+		exchanges: make(map[messageKey]*serverExchange),
+	}
+}
+
+// exchangeTracker keeps track of Confirmable messages sent by the server and
+// retransmits them with an exponential back-off until they are acknowledged
+// or MAX_RETRANSMIT is reached
+type exchangeTracker struct {
+	mu        sync.Mutex
+	params    TransmissionParams
+	events    Events
+	exchanges map[messageKey]*serverExchange
+}
+
+// serverExchange is a Confirmable message awaiting an acknowledgement
+type serverExchange struct {
+	key      messageKey
+	msg      Message
+	data     []byte
+	session  Session
+	ch       chan *CoapResponseChannel
+	timer    *time.Timer
+	timeout  time.Duration
+	attempts int
+}
+
+func (t *exchangeTracker) setParams(params TransmissionParams) {
+	t.mu.Lock()
+	t.params = params
+	t.mu.Unlock()
+}
+
+// send transmits a Confirmable message to a session and schedules its
+// retransmission. The returned channel receives the acknowledgement, or an
+// error once the exchange has timed out
+func (t *exchangeTracker) send(msg Message, data []byte, session Session) chan *CoapResponseChannel {
+	ch := make(chan *CoapResponseChannel, 1)
+
+	t.mu.Lock()
+	ex := &serverExchange{
+		key:      messageKey{session.GetAddress().String(), msg.GetMessageId()},
+		msg:      msg,
+		data:     data,
+		session:  session,
+		ch:       ch,
+		timeout:  t.params.InitialTimeout(),
+		attempts: 1,
+	}
+	t.exchanges[ex.key] = ex
+	ex.timer = time.AfterFunc(ex.timeout, func() {
+		t.retransmit(ex)
+	})
+	t.mu.Unlock()
+
+	if _, err := session.Write(data); err != nil {
+		t.fail(ex, err)
+	}
+
+	return ch
+}
+
+// register adds a channel which is completed when a message with the given id
+// is acknowledged by any endpoint, without retransmitting anything
+func (t *exchangeTracker) register(msgID uint16, ch chan *CoapResponseChannel) {
+	key := messageKey{msgID: msgID}
+
+	t.mu.Lock()
+	t.exchanges[key] = &serverExchange{
+		key: key,
+		ch:  ch,
+	}
+	t.mu.Unlock()
+}
+
+func (t *exchangeTracker) get(key messageKey) *serverExchange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.exchanges[key]
+}
+
+func (t *exchangeTracker) remove(key messageKey) *serverExchange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ex := t.exchanges[key]
+	if ex != nil {
+		delete(t.exchanges, key)
+		if ex.timer != nil {
+			ex.timer.Stop()
+		}
+	}
+	return ex
+}
+
+// complete ends the exchange acknowledged or reset by msg, received from
+// endpoint, returning false if no such exchange was pending
+func (t *exchangeTracker) complete(endpoint string, msg Message) bool {
+	ex := t.remove(messageKey{endpoint, msg.GetMessageId()})
+	if ex == nil {
+		ex = t.remove(messageKey{msgID: msg.GetMessageId()})
+	}
+	if ex == nil {
+		return false
+	}
+
+	ex.ch <- &CoapResponseChannel{
+		Response: NewResponse(msg, nil),
+	}
+	return true
+}
+
+// inflight returns the number of Confirmable messages awaiting an
+// acknowledgement
+func (t *exchangeTracker) inflight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, ex := range t.exchanges {
+		if ex.timer != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// failAll abandons every exchange awaiting an acknowledgement
+func (t *exchangeTracker) failAll(err error) {
+	t.mu.Lock()
+	var pending []*serverExchange
+	for _, ex := range t.exchanges {
+		if ex.timer != nil {
+			pending = append(pending, ex)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, ex := range pending {
+		t.fail(ex, err)
+	}
+}
+
+func (t *exchangeTracker) fail(ex *serverExchange, err error) {
+	t.mu.Lock()
+	if t.exchanges[ex.key] != ex {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.exchanges, ex.key)
+	ex.timer.Stop()
+	t.mu.Unlock()
+
+	t.events.Error(err)
+	ex.ch <- &CoapResponseChannel{
+		Error: err,
+	}
+}
+
+func (t *exchangeTracker) retransmit(ex *serverExchange) {
+	t.mu.Lock()
+	if t.exchanges[ex.key] != ex {
+		t.mu.Unlock()
+		return
+	}
+
+	if ex.attempts > t.params.MaxRetransmit {
+		t.mu.Unlock()
+		t.fail(ex, &TimeoutError{
+			MessageID: ex.msg.GetMessageId(),
+			Attempts:  ex.attempts,
+		})
+		return
+	}
+	ex.attempts++
+	ex.timeout *= 2
+	ex.timer.Reset(ex.timeout)
+	t.mu.Unlock()
+
+	if _, err := ex.session.Write(ex.data); err != nil {
+		t.fail(ex, err)
+	}
+}
@@ -0,0 +1,145 @@
+package canopus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestSession returns a session of the server with a peer on loopback,
+// which reads what the server sends to the session
+func newTestSession(t *testing.T, s CoapServer) (*UDPServerSession, net.PacketConn) {
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	session := &UDPServerSession{
+		addr:   peer.LocalAddr(),
+		conn:   &UDPServerConnection{conn: serverConn},
+		server: s,
+	}
+	return session, peer
+}
+
+// requestOption sets up a request built by sendRequest
+type requestOption func(msg Message)
+
+func withToken(token string) requestOption {
+	return func(msg Message) {
+		msg.SetToken([]byte(token))
+	}
+}
+
+func withOption(code OptionCode, value interface{}) requestOption {
+	return func(msg Message) {
+		msg.AddOption(code, value)
+	}
+}
+
+func withObserve(value uint32) requestOption {
+	return withOption(OptionObserve, value)
+}
+
+func withBlock1(block *Block1Option) requestOption {
+	return withOption(OptionBlock1, block.GetValue())
+}
+
+func withBlock2(block *Block2Option) requestOption {
+	return withOption(OptionBlock2, block.GetValue())
+}
+
+func withPayload(payload []byte) requestOption {
+	return func(msg Message) {
+		msg.SetPayload(NewBytesPayload(payload))
+	}
+}
+
+// sendRequest hands a Confirmable request to the server as if received from
+// the peer of the session, and returns the response read by the peer
+func sendRequest(t *testing.T, s CoapServer, session Session, peer net.PacketConn, code CoapCode, path string, opts ...requestOption) Message {
+	req := NewRequestWithMessageId(MessageConfirmable, code, GenerateMessageID())
+	req.SetRequestURI(path)
+	for _, opt := range opts {
+		opt(req.GetMessage())
+	}
+
+	b, err := MessageToBytes(req.GetMessage())
+	assert.Nil(t, err)
+	msg, err := BytesToMessage(b)
+	assert.Nil(t, err)
+	s.(*DefaultCoapServer).handleRequest(msg, session)
+
+	resp := readMessage(t, peer)
+	assert.Equal(t, msg.GetMessageId(), resp.GetMessageId())
+	assert.Equal(t, msg.GetToken(), resp.GetToken())
+
+	return resp
+}
+
+func readMessage(t *testing.T, peer net.PacketConn) Message {
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, MaxPacketSize)
+	n, _, err := peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	msg, err := BytesToMessage(buf[:n])
+	assert.Nil(t, err)
+
+	return msg
+}
+
+// startTestPeer starts a UDP endpoint standing in for a client or a server.
+// The messages it receives are sent to the returned channel and, after the
+// first 'drop' of them, answered with those returned by respond. The first
+// answer gets the message ID of the message answered, and its token unless
+// empty. Answers are sent concurrently, respond being free to wait
+func startTestPeer(t *testing.T, drop int, respond func(msg Message) []Message) (net.PacketConn, chan Message) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	rcvd := make(chan Message, 100)
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, err := BytesToMessage(append([]byte(nil), buf[:n]...))
+			if err != nil {
+				continue
+			}
+			rcvd <- msg
+
+			if drop > 0 {
+				drop--
+				continue
+			}
+			go func() {
+				for i, answer := range respond(msg) {
+					if i == 0 {
+						answer.SetMessageId(msg.GetMessageId())
+					}
+					if i == 0 && answer.GetCode() != CoapCodeEmpty {
+						answer.SetToken(msg.GetToken())
+					}
+					b, _ := MessageToBytes(answer)
+					pc.WriteTo(b, addr)
+				}
+			}()
+		}
+	}()
+
+	return pc, rcvd
+}
+
+// acknowledge answers Confirmable messages with an empty ACK
+func acknowledge(msg Message) []Message {
+	if msg.GetMessageType() != MessageConfirmable {
+		return nil
+	}
+	return []Message{NewEmptyMessage(0)}
+}
@@ -159,12 +159,12 @@ func BytesToMessage(data []byte) (Message, error) {
 
 			switch optCode {
 			case OptionURIPort, OptionContentFormat, OptionMaxAge, OptionAccept, OptionSize1,
-				OptionSize2, OptionBlock1, OptionBlock2:
+				OptionSize2, OptionBlock1, OptionBlock2, OptionObserve:
 				msg.Options = append(msg.Options, NewOption(optCode, decodeInt(optionValue)))
 				break
 
 			case OptionURIHost, OptionEtag, OptionLocationPath, OptionURIPath, OptionURIQuery,
-				OptionLocationQuery, OptionProxyURI, OptionProxyScheme, OptionObserve:
+				OptionLocationQuery, OptionProxyURI, OptionProxyScheme:
 				msg.Options = append(msg.Options, NewOption(optCode, string(optionValue)))
 				break
 
@@ -378,10 +378,15 @@ func (m *CoapMessage) GetAllOptions() []Option {
 	return m.Options
 }
 
+// GetAcceptedContent returns the content format asked for with the Accept
+// option, or text/plain if the message has none
 func (m *CoapMessage) GetAcceptedContent() MediaType {
-	mediaTypeCode := m.GetOption(OptionAccept).IntValue()
+	opt := m.GetOption(OptionAccept)
+	if opt == nil {
+		return MediaTypeTextPlain
+	}
 
-	return MediaType(mediaTypeCode)
+	return MediaType(opt.IntValue())
 }
 
 func (m *CoapMessage) GetCodeString() string {
@@ -608,6 +613,15 @@ func MethodString(c CoapCode) string {
 
 	case Put:
 		return "PUT"
+
+	case Fetch:
+		return MethodFetch
+
+	case Patch:
+		return MethodPatch
+
+	case IPatch:
+		return MethodIPatch
 	}
 	return ""
 }
@@ -685,6 +699,11 @@ func NotAcceptableMessage(messageID uint16, messageType uint8) Message {
 	return NewMessage(messageType, CoapCodeNotAcceptable, messageID)
 }
 
+// Creates a Non-Confirmable with CoAP Code 408 - Request Entity Incomplete
+func RequestEntityIncompleteMessage(messageID uint16, messageType uint8) Message {
+	return NewMessage(messageType, CoapCodeRequestEntityIncomplete, messageID)
+}
+
 // Creates a Non-Confirmable with CoAP Code 409 - Conflict
 func ConflictMessage(messageID uint16, messageType uint8) Message {
 	return NewMessage(messageType, CoapCodeConflict, messageID)
@@ -0,0 +1,42 @@
+package canopus
+
+// Use adds middleware run around the handlers of all routes, in the order
+// given, the first one being the outermost. Middleware may respond without
+// calling the next handler, e.g. with 4.01 Unauthorized
+func (s *DefaultCoapServer) Use(mw ...Middleware) {
+	s.routesMu.Lock()
+	s.middleware = append(s.middleware, mw...)
+	s.routesMu.Unlock()
+}
+
+// handleRoute runs the handler of a route through the server's middleware.
+// Successful responses without a Content-Format get the one negotiated with
+// the route
+func (s *DefaultCoapServer) handleRoute(route Route, req Request) Response {
+	s.routesMu.RLock()
+	mw := s.middleware
+	s.routesMu.RUnlock()
+
+	resp := chainMiddleware(route.Handle, mw)(req)
+	if resp == nil || resp.GetMessage() == nil {
+		return resp
+	}
+
+	msg := resp.GetMessage()
+	if msg.GetCode() >= CoapCodeCreated && msg.GetCode() <= CoapCodeContinue && msg.GetOption(OptionContentFormat) == nil {
+		if format, ok := contentFormat(route, req.GetMessage()); ok {
+			msg.AddOption(OptionContentFormat, format)
+		}
+	}
+
+	return resp
+}
+
+// chainMiddleware wraps a handler with middleware, the first one being the
+// outermost
+func chainMiddleware(fn RouteHandler, mw []Middleware) RouteHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		fn = mw[i](fn)
+	}
+	return fn
+}
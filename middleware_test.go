@@ -0,0 +1,87 @@
+package canopus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func textHandler(text string) RouteHandler {
+	return func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.SetStringPayload(text)
+		return NewResponseWithMessage(msg)
+	}
+}
+
+func TestServerMiddleware(t *testing.T) {
+	s := NewServer()
+
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next RouteHandler) RouteHandler {
+			return func(req Request) Response {
+				calls = append(calls, name)
+				return next(req)
+			}
+		}
+	}
+	s.Use(trace("global1"), trace("global2"))
+	s.Get("/hello", textHandler("hello")).Use(trace("route"))
+	s.Get("/other", textHandler("other"))
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	resp := sendRequest(t, s, session, peer, Get, "/hello")
+	assert.Equal(t, "hello", resp.GetPayload().String())
+	assert.Equal(t, []string{"global1", "global2", "route"}, calls)
+
+	// route middleware only runs for its route
+	calls = nil
+	resp = sendRequest(t, s, session, peer, Get, "/other")
+	assert.Equal(t, "other", resp.GetPayload().String())
+	assert.Equal(t, []string{"global1", "global2"}, calls)
+}
+
+func TestServerMiddlewareShortCircuit(t *testing.T) {
+	s := NewServer()
+
+	recovery := func(next RouteHandler) RouteHandler {
+		return func(req Request) (resp Response) {
+			defer func() {
+				if recover() != nil {
+					resp = NewResponseWithMessage(InternalServerErrorMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+				}
+			}()
+			return next(req)
+		}
+	}
+	auth := func(next RouteHandler) RouteHandler {
+		return func(req Request) Response {
+			return NewResponseWithMessage(UnauthorizedMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+		}
+	}
+
+	s.Use(recovery)
+	handled := false
+	s.Get("/secret", func(req Request) Response {
+		handled = true
+		return textHandler("secret")(req)
+	}).Use(auth)
+	s.Get("/broken", func(req Request) Response {
+		panic("broken")
+	})
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	resp := sendRequest(t, s, session, peer, Get, "/secret")
+	assert.Equal(t, CoapCodeUnauthorized, resp.GetCode())
+	assert.False(t, handled)
+
+	resp = sendRequest(t, s, session, peer, Get, "/broken")
+	assert.Equal(t, CoapCodeInternalServerError, resp.GetCode())
+}
@@ -0,0 +1,73 @@
+package canopus
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// messageKey identifies a message exchanged with a remote endpoint. Message
+// IDs are only unique per endpoint, so the endpoint is always part of the key
+type messageKey struct {
+	endpoint string
+	msgID    uint16
+}
+
+func newMessageIDGenerator(lifetime time.Duration) *messageIDGenerator {
+	return &messageIDGenerator{
+		lifetime: lifetime,
+		peers:    make(map[string]*peerMessageID),
+	}
+}
+
+// messageIDGenerator generates message IDs for each remote endpoint
+// separately, starting from a random value. A peer which has not been sent
+// anything for EXCHANGE_LIFETIME is forgotten, as its message IDs may then
+// safely be reused
+type messageIDGenerator struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	peers    map[string]*peerMessageID
+}
+
+type peerMessageID struct {
+	current  uint16
+	lastUsed time.Time
+}
+
+// next returns the next message ID to use for an endpoint
+func (g *messageIDGenerator) next(endpoint string) uint16 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	peer, ok := g.peers[endpoint]
+	if !ok {
+		peer = &peerMessageID{
+			current: uint16(rand.Intn(65536)),
+		}
+		g.peers[endpoint] = peer
+	}
+	peer.current++
+	peer.lastUsed = time.Now()
+
+	return peer.current
+}
+
+func (g *messageIDGenerator) setLifetime(lifetime time.Duration) {
+	g.mu.Lock()
+	g.lifetime = lifetime
+	g.mu.Unlock()
+}
+
+// purge forgets the endpoints which have not been sent anything for
+// EXCHANGE_LIFETIME
+func (g *messageIDGenerator) purge() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for endpoint, peer := range g.peers {
+		if time.Since(peer.lastUsed) > g.lifetime {
+			delete(g.peers, endpoint)
+		}
+	}
+}
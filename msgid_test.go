@@ -0,0 +1,56 @@
+package canopus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageIDGeneratorPerEndpoint(t *testing.T) {
+	g := newMessageIDGenerator(time.Minute)
+
+	a := g.next("a")
+	b := g.next("b")
+	for i := 1; i < 70000; i++ {
+		assert.Equal(t, a+uint16(i), g.next("a"))
+	}
+	assert.Equal(t, b+1, g.next("b"))
+
+	g.peers["a"].lastUsed = time.Now().Add(-2 * time.Minute)
+	g.purge()
+	assert.Nil(t, g.peers["a"])
+	assert.NotNil(t, g.peers["b"])
+}
+
+func TestServerExchangeKeyedByEndpoint(t *testing.T) {
+	s := NewServer()
+	s.SetTransmissionParams(testTransmissionParams())
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	other, otherPeer := newTestSession(t, s)
+	defer otherPeer.Close()
+	defer other.GetConnection().Close()
+
+	server := s.(*DefaultCoapServer)
+	msg := NewMessage(MessageConfirmable, CoapCodeContent, server.nextMessageID(session))
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		peer.ReadFrom(buf)
+
+		// an acknowledgement with the same message ID from another endpoint
+		// doesn't complete the exchange
+		ack := NewEmptyMessage(msg.GetMessageId())
+		assert.False(t, server.exchanges.complete(other.GetAddress().String(), ack))
+		server.handleResponse(ack, session)
+	}()
+
+	resp, err := SendMessage(msg, session)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.GetMessageId(), resp.GetMessage().GetMessageId())
+	assert.Nil(t, server.exchanges.get(messageKey{session.GetAddress().String(), msg.GetMessageId()}))
+}
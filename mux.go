@@ -0,0 +1,346 @@
+package canopus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrConnectionClosed = errors.New("Connection closed")
+
+// transport is implemented by client connections able to exchange
+// raw CoAP datagrams with a remote endpoint
+type transport interface {
+	Write(b []byte) (int, error)
+	Read(b []byte) (int, error)
+}
+
+// handshaker is implemented by transports establishing a session with the
+// remote endpoint before exchanging datagrams
+type handshaker interface {
+	Handshake(ctx context.Context) error
+}
+
+func newClientMux(t transport) *clientMux {
+	return &clientMux{
+		t:            t,
+		byMessageID:  make(map[uint16]chan Message),
+		byToken:      make(map[string]chan Message),
+		observations: make(map[string]chan Message),
+		completed:    make(map[completedExchange]time.Time),
+		done:         make(chan struct{}),
+	}
+}
+
+// clientMux owns the single reader of a client connection and routes each
+// incoming message to the request or observation it belongs to, allowing
+// many requests to be in flight at once over one socket
+type clientMux struct {
+	t     transport
+	start sync.Once
+
+	mu           sync.Mutex
+	byMessageID  map[uint16]chan Message
+	byToken      map[string]chan Message
+	observations map[string]chan Message
+	done         chan struct{}
+	err          error
+
+	// Confirmable responses delivered, until their exchange lifetime ends
+	completed map[completedExchange]time.Time
+}
+
+// completedExchange identifies a Confirmable response by its token and
+// message ID
+type completedExchange struct {
+	token     string
+	messageID uint16
+}
+
+// send transmits a message. Confirmable messages are retransmitted with an
+// exponential back-off until the matching acknowledgement is routed back, or
+// MAX_RETRANSMIT is reached, in which case a *TimeoutError is returned. If ctx
+// is done first, retransmission stops and ctx.Err() is returned
+func (m *clientMux) send(ctx context.Context, msg Message, params TransmissionParams) (resp Response, err error) {
+	if msg == nil {
+		return nil, ErrNilMessage
+	}
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	b, err := MessageToBytes(msg)
+	if err != nil {
+		return
+	}
+
+	if msg.GetMessageType() == MessageNonConfirmable {
+		go m.t.Write(b)
+		resp = NewResponse(NewEmptyMessage(msg.GetMessageId()), nil)
+		return
+	}
+
+	if msg.GetMessageType() == MessageAcknowledgment || msg.GetMessageType() == MessageReset {
+		_, err = m.t.Write(b)
+		if err != nil {
+			return
+		}
+		resp = NewResponse(NewEmptyMessage(msg.GetMessageId()), nil)
+		return
+	}
+
+	// the session of a DTLS connection is established before its reader starts
+	if h, ok := m.t.(handshaker); ok {
+		if err = h.Handshake(ctx); err != nil {
+			return
+		}
+	}
+	m.start.Do(func() {
+		go m.run()
+	})
+
+	ch := make(chan Message, 1)
+	if err = m.addPending(msg, ch); err != nil {
+		return
+	}
+	defer m.removePending(msg)
+
+	timeout := params.InitialTimeout()
+	for attempt := 0; attempt <= params.MaxRetransmit; attempt++ {
+		_, err = m.t.Write(b)
+		if err != nil {
+			return
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case respMsg := <-ch:
+			timer.Stop()
+			if isEmptyAcknowledgement(respMsg) {
+				return m.awaitSeparateResponse(ctx, ch, params)
+			}
+			m.complete(respMsg, params)
+			return NewResponse(respMsg, nil), nil
+
+		case <-m.done:
+			timer.Stop()
+			return nil, m.closeErr()
+
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+
+		case <-timer.C:
+		}
+		timeout *= 2
+	}
+
+	return nil, &TimeoutError{
+		MessageID: msg.GetMessageId(),
+		Attempts:  params.MaxRetransmit + 1,
+	}
+}
+
+// awaitSeparateResponse waits for the response to a request which has been
+// acknowledged with an empty ACK. The response carries the request's token and
+// is acknowledged by the reader when it is Confirmable
+func (m *clientMux) awaitSeparateResponse(ctx context.Context, ch chan Message, params TransmissionParams) (Response, error) {
+	timer := time.NewTimer(params.ExchangeLifetime())
+	defer timer.Stop()
+
+	for {
+		select {
+		case respMsg := <-ch:
+			if isEmptyAcknowledgement(respMsg) {
+				// duplicate acknowledgement
+				continue
+			}
+			m.complete(respMsg, params)
+			return NewResponse(respMsg, nil), nil
+
+		case <-m.done:
+			return nil, m.closeErr()
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case <-timer.C:
+			return nil, ErrSeparateResponseTimeout
+		}
+	}
+}
+
+// addPending routes the acknowledgement of msg, and any response carrying
+// its token, to ch
+func (m *clientMux) addPending(msg Message, ch chan Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.byMessageID[msg.GetMessageId()] = ch
+	if msg.GetTokenLength() > 0 {
+		m.byToken[string(msg.GetToken())] = ch
+	}
+	return nil
+}
+
+func (m *clientMux) removePending(msg Message) {
+	m.mu.Lock()
+	delete(m.byMessageID, msg.GetMessageId())
+	if m.byToken[string(msg.GetToken())] != nil {
+		delete(m.byToken, string(msg.GetToken()))
+	}
+	m.mu.Unlock()
+}
+
+// complete keeps a Confirmable response for the exchange lifetime once its
+// request is removed, so that its retransmissions, sent when the
+// acknowledgement is lost, are acknowledged again rather than reset
+func (m *clientMux) complete(msg Message, params TransmissionParams) {
+	if msg.GetMessageType() != MessageConfirmable {
+		return
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	for exchange, expires := range m.completed {
+		if now.After(expires) {
+			delete(m.completed, exchange)
+		}
+	}
+	m.completed[completedExchange{string(msg.GetToken()), msg.GetMessageId()}] = now.Add(params.ExchangeLifetime())
+	m.mu.Unlock()
+}
+
+func (m *clientMux) isCompleted(msg Message) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expires, ok := m.completed[completedExchange{string(msg.GetToken()), msg.GetMessageId()}]
+	return ok && time.Now().Before(expires)
+}
+
+// addObservation routes notifications carrying the given token to ch
+func (m *clientMux) addObservation(token string, ch chan Message) {
+	m.mu.Lock()
+	m.observations[token] = ch
+	m.mu.Unlock()
+}
+
+func (m *clientMux) removeObservation(token string) {
+	m.mu.Lock()
+	delete(m.observations, token)
+	m.mu.Unlock()
+}
+
+func (m *clientMux) closeErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+// run reads messages from the transport until it fails, dispatching each
+// one to whoever is waiting for it
+func (m *clientMux) run() {
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, err := m.t.Read(buf)
+		if err != nil {
+			if IsTimeoutError(err) {
+				continue
+			}
+
+			m.mu.Lock()
+			m.err = ErrConnectionClosed
+			m.mu.Unlock()
+			close(m.done)
+			return
+		}
+
+		msgBuf := make([]byte, n)
+		copy(msgBuf, buf[:n])
+
+		msg, err := BytesToMessage(msgBuf)
+		if err != nil {
+			logMsg("Error parsing message:", err)
+			continue
+		}
+		m.dispatch(msg)
+	}
+}
+
+func (m *clientMux) dispatch(msg Message) {
+	isResponse := msg.GetMessageType() == MessageAcknowledgment || msg.GetMessageType() == MessageReset
+	token := string(msg.GetToken())
+
+	m.mu.Lock()
+	var ch chan Message
+	if isResponse {
+		ch = m.byMessageID[msg.GetMessageId()]
+	} else {
+		ch = m.byToken[token]
+	}
+
+	// the response to a registration ends the exchange, so that notifications
+	// following it go to the observation rather than the pending request
+	if ch != nil && !isEmptyAcknowledgement(msg) && m.observations[token] != nil && m.byToken[token] == ch {
+		delete(m.byToken, token)
+	}
+
+	// responses to a pending registration take precedence over notifications
+	// with the same token
+	var notifications chan Message
+	if !isResponse && ch == nil && msg.GetOption(OptionObserve) != nil {
+		notifications = m.observations[token]
+	}
+	m.mu.Unlock()
+
+	if notifications != nil {
+		if msg.GetMessageType() == MessageConfirmable {
+			m.acknowledge(msg)
+		}
+
+		select {
+		case notifications <- msg:
+		default:
+			// the subscription is busy, a later notification supersedes this one
+		}
+		return
+	}
+
+	if ch != nil {
+		if msg.GetMessageType() == MessageConfirmable {
+			m.acknowledge(msg)
+		}
+
+		select {
+		case ch <- msg:
+		default:
+			// duplicate of a message already delivered
+		}
+		return
+	}
+
+	if msg.GetMessageType() == MessageConfirmable && m.isCompleted(msg) {
+		m.acknowledge(msg)
+		return
+	}
+
+	if msg.GetMessageType() == MessageConfirmable {
+		// unknown exchange, reject it
+		rst := NewMessageOfType(MessageReset, msg.GetMessageId(), nil)
+		b, _ := MessageToBytes(rst)
+		m.t.Write(b)
+	}
+}
+
+func (m *clientMux) acknowledge(msg Message) {
+	ack := NewMessageOfType(MessageAcknowledgment, msg.GetMessageId(), nil)
+	b, _ := MessageToBytes(ack)
+	m.t.Write(b)
+}
@@ -0,0 +1,143 @@
+package canopus
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentRequestsOnOneConnection(t *testing.T) {
+	// answered after a random delay, with the request path as the payload
+	pc, _ := startTestPeer(t, 0, func(msg Message) []Message {
+		time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+		ack := ContentMessage(0, MessageAcknowledgment)
+		ack.SetStringPayload(msg.GetURIPath())
+		return []Message{ack}
+	})
+	defer pc.Close()
+
+	conn, err := Dial(pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTransmissionParams(testTransmissionParams())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			path := "/req/" + strconv.Itoa(i)
+			req := NewRequest(MessageConfirmable, Get)
+			req.SetRequestURI(path)
+
+			resp, err := conn.Send(req)
+			assert.Nil(t, err)
+			if err == nil {
+				assert.Equal(t, path, resp.GetMessage().GetPayload().String())
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestObserveNotificationsAreRoutedByToken(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer pc.Close()
+
+	conn, err := Dial(pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	acks := make(chan Message, 10)
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, _ := BytesToMessage(buf[:n])
+			if msg.GetMessageType() != MessageConfirmable {
+				acks <- msg
+				continue
+			}
+
+			// Registration response followed by a confirmable notification
+			// and a notification for an unknown token
+			ack := ContentMessage(msg.GetMessageId(), MessageAcknowledgment)
+			ack.SetToken(msg.GetToken())
+			ack.AddOption(OptionObserve, 1)
+			b, _ := MessageToBytes(ack)
+			pc.WriteTo(b, addr)
+
+			notification := ContentMessage(GenerateMessageID(), MessageConfirmable)
+			notification.SetToken(msg.GetToken())
+			notification.AddOption(OptionObserve, 2)
+			notification.SetStringPayload("changed")
+			b, _ = MessageToBytes(notification)
+			pc.WriteTo(b, addr)
+
+			unknown := ContentMessage(GenerateMessageID(), MessageConfirmable)
+			unknown.SetToken([]byte("unknown"))
+			unknown.AddOption(OptionObserve, 2)
+			b, _ = MessageToBytes(unknown)
+			pc.WriteTo(b, addr)
+		}
+	}()
+
+	sub, err := conn.Observe(context.Background(), "/watch")
+	assert.Nil(t, err)
+
+	// the registration response comes first
+	obsMsg := <-sub.Notifications()
+	assert.Equal(t, sub.Token(), obsMsg.GetMessage().GetTokenString())
+
+	obsMsg = <-sub.Notifications()
+	assert.Equal(t, sub.Token(), obsMsg.(*CoapObserveMessage).Msg.GetTokenString())
+	assert.Equal(t, "/watch", obsMsg.GetResource())
+	assert.Equal(t, "changed", PayloadAsString(obsMsg.GetValue().(MessagePayload)))
+
+	// The notification is acknowledged, the unknown message is reset
+	types := []uint8{(<-acks).GetMessageType(), (<-acks).GetMessageType()}
+	assert.Contains(t, types, uint8(MessageAcknowledgment))
+	assert.Contains(t, types, uint8(MessageReset))
+}
+
+func TestSendContextCancelled(t *testing.T) {
+	pc, seen := startTestPeer(t, 100, acknowledge)
+	defer pc.Close()
+
+	conn, err := DialContext(context.Background(), pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/slow")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := conn.SendContext(ctx, req)
+	assert.Nil(t, resp)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 1, len(seen))
+
+	mux := conn.(*UDPConnection).mux
+	mux.mu.Lock()
+	assert.Equal(t, 0, len(mux.byMessageID))
+	assert.Equal(t, 0, len(mux.byToken))
+	mux.mu.Unlock()
+
+	_, err = conn.SendContext(ctx, NewRequest(MessageConfirmable, Get))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
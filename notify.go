@@ -0,0 +1,344 @@
+package canopus
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// NotifyChange sends a notification with the new value of a resource to its
+// observers. Notifications are Confirmable if confirm is set, and otherwise
+// once in a while to check that observers are still interested. Observers
+// rejecting a notification, or failing to acknowledge it, are removed
+func (s *DefaultCoapServer) NotifyChange(resource, value string, confirm bool) {
+	tmpl := NewMessage(MessageNonConfirmable, CoapCodeContent, 0)
+	tmpl.SetStringPayload(value)
+
+	s.NotifyMessage(resource, tmpl, confirm)
+}
+
+// NotifyContent notifies the observers of a resource with a representation
+// in the given content format. Observers which asked for another format with
+// the Accept option of their registration are skipped
+func (s *DefaultCoapServer) NotifyContent(resource string, payload []byte, format MediaType, confirm bool) {
+	tmpl := NewMessage(MessageNonConfirmable, CoapCodeContent, 0)
+	tmpl.AddOption(OptionContentFormat, format)
+	tmpl.SetPayload(NewBytesPayload(payload))
+
+	s.NotifyMessage(resource, tmpl, confirm)
+}
+
+// NotifyMessage notifies the observers of a resource with the code, options
+// and payload of a message. Each notification gets the observer's token, its
+// next Observe sequence number and, unless the message has one, the default
+// Max-Age. Observers which asked for another format than the message's
+// Content-Format are skipped. A notification with an error code ends the
+// observations
+func (s *DefaultCoapServer) NotifyMessage(resource string, tmpl Message, confirm bool) {
+	s.notify(resource, confirm, func(req Message, session Session) Response {
+		if !acceptsFormat(req, tmpl) {
+			return nil
+		}
+		return NewResponseWithMessage(tmpl)
+	})
+}
+
+// NotifyObservers runs the GET handler of a resource once for each of its
+// observers, with the observer's registration request, and notifies it with
+// the representation returned. Each observer thus gets the content format it
+// asked for. Handlers are run before NotifyObservers returns
+func (s *DefaultCoapServer) NotifyObservers(resource string, confirm bool) {
+	s.notify(resource, confirm, func(req Message, session Session) Response {
+		resp, err := s.routeRepresentation(req, session)
+		if err != nil {
+			s.GetEvents().Error(err)
+		}
+		return resp
+	})
+}
+
+// routeRepresentation runs the GET handler of an observed resource with the
+// registration request of an observer
+func (s *DefaultCoapServer) routeRepresentation(req Message, session Session) (Response, error) {
+	route, attrs, err := s.matchRoute(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.handleRoute(route, NewClientRequestFromMessage(req, attrs, session)), nil
+}
+
+// notify sends each observer of a resource the notification built from the
+// response to its registration request, subject to the observer's
+// notification attributes. No notification is sent to observers for which
+// build returns nil
+func (s *DefaultCoapServer) notify(resource string, confirm bool, build func(req Message, session Session) Response) {
+	if s.isShuttingDown() {
+		return
+	}
+
+	type observer struct {
+		obs     *Observation
+		req     Message
+		session Session
+	}
+
+	s.observationsMu.RLock()
+	var observers []observer
+	for _, obs := range s.observations[resource] {
+		observers = append(observers, observer{obs, observedRequest(resource, obs.request), obs.Session})
+	}
+	s.observationsMu.RUnlock()
+
+	for _, o := range observers {
+		resp := build(o.req, o.session)
+		if resp == nil {
+			continue
+		}
+		if _, nilresponse := resp.(NilResponse); nilresponse {
+			continue
+		}
+
+		// a large representation is sent in Block2 blocks, the first one with
+		// the notification
+		tmpl := s.blockwise(o.req, resp, o.session)
+
+		s.observationsMu.Lock()
+		if s.holdNotificationLocked(o.obs, tmpl, confirm) {
+			s.observationsMu.Unlock()
+			continue
+		}
+		msg, ended := s.notification(o.obs, tmpl, confirm)
+		s.observationsMu.Unlock()
+
+		s.dispatchNotification(o.obs, msg, ended, o.session)
+	}
+}
+
+// dispatchNotification sends a notification in the background. Nothing is
+// sent if msg is nil, i.e. the observer left in the meantime
+func (s *DefaultCoapServer) dispatchNotification(obs *Observation, msg Message, ended bool, session Session) {
+	if msg == nil {
+		return
+	}
+	if ended {
+		s.writeObservationStore()
+		s.GetEvents().ObserveCancelled(obs.Resource, msg)
+	}
+
+	atomic.AddInt32(&s.notifying, 1)
+	go func() {
+		defer atomic.AddInt32(&s.notifying, -1)
+		s.sendNotification(obs, msg, session)
+	}()
+}
+
+// holdNotificationLocked checks the notification attributes of an observer.
+// It returns true if a change doesn't meet the thresholds, or if it comes
+// within the MinPeriod, in which case it is sent once the period elapses
+// unless superseded. The observations lock must be held
+func (s *DefaultCoapServer) holdNotificationLocked(obs *Observation, tmpl Message, confirm bool) bool {
+	if !s.isObserverLocked(obs) || tmpl.GetCode() < CoapCodeCreated || tmpl.GetCode() > CoapCodeContinue {
+		return false
+	}
+
+	if value, ok := numericValue(tmpl); ok && obs.hasLastValue && obs.attrs.hasThresholds() && !obs.attrs.changed(obs.lastValue, value) {
+		return true
+	}
+
+	wait := obs.attrs.MinPeriod - time.Since(obs.lastNotified)
+	if obs.attrs.MinPeriod <= 0 || wait <= 0 {
+		return false
+	}
+
+	obs.pending = tmpl
+	obs.pendingConfirm = obs.pendingConfirm || confirm
+	if obs.pminTimer == nil {
+		obs.pminTimer = time.AfterFunc(wait, func() {
+			s.flushPending(obs)
+		})
+	}
+
+	return true
+}
+
+// flushPending sends the latest change held back during the MinPeriod
+func (s *DefaultCoapServer) flushPending(obs *Observation) {
+	s.observationsMu.Lock()
+	obs.pminTimer = nil
+	tmpl, confirm := obs.pending, obs.pendingConfirm
+	obs.pending, obs.pendingConfirm = nil, false
+
+	if tmpl == nil || s.isShuttingDown() {
+		s.observationsMu.Unlock()
+		return
+	}
+	msg, ended := s.notification(obs, tmpl, confirm)
+	session := obs.Session
+	s.observationsMu.Unlock()
+
+	s.dispatchNotification(obs, msg, ended, session)
+}
+
+// notifiedLocked records a notification sent to an observer, and schedules
+// the next one after the MaxPeriod. The observations lock must be held
+func (s *DefaultCoapServer) notifiedLocked(obs *Observation, tmpl Message) {
+	obs.lastNotified = time.Now()
+	obs.lastTmpl = tmpl
+	obs.lastValue, obs.hasLastValue = numericValue(tmpl)
+
+	s.scheduleMaxPeriodLocked(obs)
+}
+
+func (s *DefaultCoapServer) scheduleMaxPeriodLocked(obs *Observation) {
+	if obs.pmaxTimer != nil {
+		obs.pmaxTimer.Stop()
+		obs.pmaxTimer = nil
+	}
+
+	if obs.attrs.MaxPeriod > 0 {
+		wait := obs.attrs.MaxPeriod - time.Since(obs.lastNotified)
+		obs.pmaxTimer = time.AfterFunc(wait, func() {
+			s.renotify(obs)
+		})
+	}
+}
+
+// renotify sends the current representation of a resource to an observer
+// which hasn't been notified within the MaxPeriod. The representation is
+// returned by the GET handler of the resource, or is the one last notified
+func (s *DefaultCoapServer) renotify(obs *Observation) {
+	if s.isShuttingDown() {
+		return
+	}
+
+	s.observationsMu.RLock()
+	registered := s.isObserverLocked(obs)
+	req := observedRequest(obs.Resource, obs.request)
+	session := obs.Session
+	tmpl := obs.lastTmpl
+	s.observationsMu.RUnlock()
+
+	if !registered {
+		return
+	}
+
+	if resp, err := s.routeRepresentation(req, session); err == nil && resp != nil {
+		if _, nilresponse := resp.(NilResponse); !nilresponse {
+			tmpl = s.blockwise(req, resp, session)
+		}
+	}
+	if tmpl == nil {
+		return
+	}
+
+	s.observationsMu.Lock()
+	if time.Since(obs.lastNotified) < obs.attrs.MaxPeriod {
+		// notified in the meantime
+		s.observationsMu.Unlock()
+		return
+	}
+	msg, ended := s.notification(obs, tmpl, false)
+	s.observationsMu.Unlock()
+
+	s.dispatchNotification(obs, msg, ended, session)
+}
+
+// observedRequest returns the registration request of an observer, or a GET
+// request of the resource for observers added with AddObservation
+func observedRequest(resource string, req Message) Message {
+	if req != nil {
+		return req
+	}
+
+	r := NewRequest(MessageConfirmable, Get)
+	r.SetRequestURI(resource)
+
+	return r.GetMessage()
+}
+
+// acceptsFormat checks if the Content-Format of a representation is the one
+// asked for with the Accept option of a request. Representations without a
+// Content-Format are accepted
+func acceptsFormat(req, msg Message) bool {
+	accept := req.GetOption(OptionAccept)
+	format := msg.GetOption(OptionContentFormat)
+	if accept == nil || format == nil {
+		return true
+	}
+
+	return uintOptionValue(accept) == uintOptionValue(format)
+}
+
+// notification builds the next notification to an observer from a message.
+// A notification with an error code removes the observer, in which case ended
+// is set. It returns nil if the observer has been removed. The observations
+// lock must be held
+func (s *DefaultCoapServer) notification(obs *Observation, tmpl Message, confirm bool) (msg Message, ended bool) {
+	if !s.isObserverLocked(obs) {
+		return nil, false
+	}
+
+	if obs.nonConfirmable >= ObserveMaxNonConfirmable || time.Since(obs.lastConfirmed) >= ObserveConfirmInterval {
+		confirm = true
+	}
+
+	msgType := uint8(MessageNonConfirmable)
+	if confirm {
+		msgType = MessageConfirmable
+		obs.nonConfirmable = 0
+		obs.lastConfirmed = time.Now()
+	} else {
+		obs.nonConfirmable++
+	}
+
+	obs.lastMessageID = s.nextMessageID(obs.Session)
+
+	msg = NewMessage(msgType, tmpl.GetCode(), obs.lastMessageID)
+	msg.SetToken([]byte(obs.Token))
+	for _, opt := range tmpl.GetAllOptions() {
+		if opt.GetCode() != OptionObserve {
+			msg.AddOptions([]Option{opt})
+		}
+	}
+	msg.SetPayload(tmpl.GetPayload())
+
+	if tmpl.GetCode() < CoapCodeCreated || tmpl.GetCode() > CoapCodeContinue {
+		s.removeObservationLocked(obs)
+		return msg, true
+	}
+
+	obs.NotifyCount++
+	msg.AddOption(OptionObserve, obs.Sequence())
+	if tmpl.GetOption(OptionMaxAge) == nil {
+		msg.AddOption(OptionMaxAge, s.observeMaxAge)
+	}
+
+	// a change held back is superseded
+	obs.pending = nil
+	s.notifiedLocked(obs, tmpl)
+
+	return msg, false
+}
+
+func (s *DefaultCoapServer) isObserverLocked(obs *Observation) bool {
+	for _, o := range s.observations[obs.Resource] {
+		if o == obs {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DefaultCoapServer) sendNotification(obs *Observation, msg Message, session Session) {
+	resp, err := SendMessage(msg, session)
+	if err != nil {
+		if msg.GetMessageType() == MessageConfirmable {
+			s.cancelObservation(obs, msg)
+		}
+		return
+	}
+
+	if resp != nil && resp.GetMessage() != nil && resp.GetMessage().GetMessageType() == MessageReset {
+		s.cancelObservation(obs, resp.GetMessage())
+	}
+}
@@ -0,0 +1,240 @@
+package canopus
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// registerObserver registers a new session with the server as an observer of
+// /reading, asking for the given content format, with the given queries
+func registerObserver(t *testing.T, s CoapServer, accept MediaType, query ...string) (Session, net.PacketConn) {
+	session, peer := newTestSession(t, s)
+
+	req := NewRequestWithMessageId(MessageConfirmable, Get, GenerateMessageID())
+	req.SetRequestURI("/reading")
+	for _, q := range query {
+		req.GetMessage().AddOption(OptionURIQuery, q)
+	}
+	req.GetMessage().AddOption(OptionObserve, observeRegister)
+	req.GetMessage().AddOption(OptionAccept, accept)
+
+	b, err := MessageToBytes(req.GetMessage())
+	assert.Nil(t, err)
+	msg, err := BytesToMessage(b)
+	assert.Nil(t, err)
+	s.(*DefaultCoapServer).handleRequest(msg, session)
+
+	resp := readMessage(t, peer)
+	assert.NotNil(t, resp.GetOption(OptionObserve))
+
+	return session, peer
+}
+
+func newReadingServer() CoapServer {
+	s := NewServer()
+	s.Get("/reading", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		if req.GetMessage().GetOption(OptionAccept) != nil && req.GetMessage().GetAcceptedContent() == MediaTypeApplicationCbor {
+			msg.AddOption(OptionContentFormat, MediaTypeApplicationCbor)
+			msg.SetPayload(NewBytesPayload([]byte{0x18, 0x15}))
+		} else {
+			msg.AddOption(OptionContentFormat, MediaTypeApplicationJSON)
+			msg.SetStringPayload("21")
+		}
+		return NewResponseWithMessage(msg)
+	})
+
+	return s
+}
+
+func TestServerNotifyObservers(t *testing.T) {
+	s := newReadingServer()
+
+	jsonSession, jsonPeer := registerObserver(t, s, MediaTypeApplicationJSON)
+	defer jsonPeer.Close()
+	defer jsonSession.GetConnection().Close()
+
+	cborSession, cborPeer := registerObserver(t, s, MediaTypeApplicationCbor)
+	defer cborPeer.Close()
+	defer cborSession.GetConnection().Close()
+
+	s.NotifyObservers("/reading", false)
+
+	msg := readMessage(t, jsonPeer)
+	assert.Equal(t, uint32(MediaTypeApplicationJSON), uintOptionValue(msg.GetOption(OptionContentFormat)))
+	assert.Equal(t, "21", msg.GetPayload().String())
+	assert.Equal(t, uint32(1), uintOptionValue(msg.GetOption(OptionObserve)))
+	assert.NotNil(t, msg.GetOption(OptionMaxAge))
+
+	msg = readMessage(t, cborPeer)
+	assert.Equal(t, uint32(MediaTypeApplicationCbor), uintOptionValue(msg.GetOption(OptionContentFormat)))
+	assert.Equal(t, []byte{0x18, 0x15}, msg.GetPayload().GetBytes())
+	assert.Equal(t, uint32(1), uintOptionValue(msg.GetOption(OptionObserve)))
+}
+
+func TestServerNotifyContent(t *testing.T) {
+	s := newReadingServer()
+
+	jsonSession, jsonPeer := registerObserver(t, s, MediaTypeApplicationJSON)
+	defer jsonPeer.Close()
+	defer jsonSession.GetConnection().Close()
+
+	cborSession, cborPeer := registerObserver(t, s, MediaTypeApplicationCbor)
+	defer cborPeer.Close()
+	defer cborSession.GetConnection().Close()
+
+	s.NotifyContent("/reading", []byte{0x18, 0x16}, MediaTypeApplicationCbor, false)
+
+	msg := readMessage(t, cborPeer)
+	assert.Equal(t, uint32(MediaTypeApplicationCbor), uintOptionValue(msg.GetOption(OptionContentFormat)))
+	assert.Equal(t, []byte{0x18, 0x16}, msg.GetPayload().GetBytes())
+
+	// the JSON observer isn't sent a representation it can't handle
+	jsonPeer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := jsonPeer.ReadFrom(make([]byte, MaxPacketSize))
+	assert.NotNil(t, err)
+}
+
+func TestServerNotifyMessageError(t *testing.T) {
+	s := newReadingServer()
+
+	session, peer := registerObserver(t, s, MediaTypeApplicationJSON)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	tmpl := NewMessage(MessageNonConfirmable, CoapCodeNotFound, 0)
+	tmpl.SetStringPayload("gone")
+	tmpl.AddOption(OptionMaxAge, uint32(5))
+	s.NotifyMessage("/reading", tmpl, false)
+
+	// an error ends the observation
+	msg := readMessage(t, peer)
+	assert.Equal(t, CoapCodeNotFound, msg.GetCode())
+	assert.Equal(t, "gone", msg.GetPayload().String())
+	assert.Nil(t, msg.GetOption(OptionObserve))
+	assert.Equal(t, uint32(5), uintOptionValue(msg.GetOption(OptionMaxAge)))
+	assert.False(t, s.HasObservation("/reading", peer.LocalAddr()))
+}
+
+// expectNotification reads a notification, failing if none is received
+// within the timeout
+func expectNotification(t *testing.T, peer net.PacketConn, timeout time.Duration) Message {
+	peer.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, MaxPacketSize)
+	n, _, err := peer.ReadFrom(buf)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	msg, err := BytesToMessage(buf[:n])
+	assert.Nil(t, err)
+
+	return msg
+}
+
+func expectNoNotification(t *testing.T, peer net.PacketConn, timeout time.Duration) {
+	peer.SetReadDeadline(time.Now().Add(timeout))
+	_, _, err := peer.ReadFrom(make([]byte, MaxPacketSize))
+	assert.NotNil(t, err)
+}
+
+func TestParseNotifyAttributes(t *testing.T) {
+	attrs, err := ParseNotifyAttributes([]string{"pmin=2", "pmax=60", "gt=25.5", "lt=-3", "st=0.5", "other=1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Second, attrs.MinPeriod)
+	assert.Equal(t, time.Minute, attrs.MaxPeriod)
+	assert.Equal(t, 25.5, *attrs.GreaterThan)
+	assert.Equal(t, -3.0, *attrs.LessThan)
+	assert.Equal(t, 0.5, *attrs.Step)
+
+	for _, query := range [][]string{
+		{"pmin=-1"},
+		{"pmax=soon"},
+		{"gt=high"},
+		{"st=-1"},
+		{"pmin=10", "pmax=5"},
+		{"gt=10", "lt=20"},
+	} {
+		_, err = ParseNotifyAttributes(query)
+		assert.Equal(t, ErrInvalidNotifyAttribute, err, strings.Join(query, "&"))
+	}
+
+	// registration queries override the resource's attributes
+	gt := 30.0
+	attrs, err = parseNotifyAttributes(NotifyAttributes{MinPeriod: time.Second, GreaterThan: &gt}, []string{"gt=40"})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, attrs.MinPeriod)
+	assert.Equal(t, 40.0, *attrs.GreaterThan)
+}
+
+func TestServerNotifyThresholds(t *testing.T) {
+	s := newReadingServer()
+
+	session, peer := registerObserver(t, s, MediaTypeApplicationJSON, "gt=25", "st=5")
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	// 21 was notified with the registration
+	for _, change := range []struct {
+		value    string
+		notified bool
+	}{
+		{"22", false},
+		{"26", true},
+		{"28", false},
+		{"31", true},
+		{"not a number", true},
+		{"20", true},
+	} {
+		s.NotifyChange("/reading", change.value, false)
+		if change.notified {
+			msg := expectNotification(t, peer, time.Second)
+			if msg != nil {
+				assert.Equal(t, change.value, msg.GetPayload().String())
+			}
+		} else {
+			expectNoNotification(t, peer, 50*time.Millisecond)
+		}
+	}
+}
+
+func TestServerNotifyMinPeriod(t *testing.T) {
+	s := newReadingServer()
+
+	session, peer := registerObserver(t, s, MediaTypeApplicationJSON, "pmin=1")
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	// changes are batched until a second after the registration
+	s.NotifyChange("/reading", "22", false)
+	s.NotifyChange("/reading", "23", false)
+	expectNoNotification(t, peer, 500*time.Millisecond)
+
+	msg := expectNotification(t, peer, time.Second)
+	assert.Equal(t, "23", msg.GetPayload().String())
+	assert.Equal(t, uint32(1), uintOptionValue(msg.GetOption(OptionObserve)))
+	expectNoNotification(t, peer, 50*time.Millisecond)
+}
+
+func TestServerNotifyMaxPeriod(t *testing.T) {
+	s := newReadingServer()
+
+	session, peer := registerObserver(t, s, MediaTypeApplicationJSON)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	s.SetNotifyAttributes("/reading", NotifyAttributes{MaxPeriod: time.Second})
+
+	// the current representation is sent again without any change
+	for seq := uint32(1); seq <= 2; seq++ {
+		msg := expectNotification(t, peer, 2*time.Second)
+		assert.Equal(t, "21", msg.GetPayload().String())
+		assert.Equal(t, seq, uintOptionValue(msg.GetOption(OptionObserve)))
+	}
+
+	s.RemoveObservation("/reading", peer.LocalAddr())
+	expectNoNotification(t, peer, 1500*time.Millisecond)
+}
@@ -0,0 +1,325 @@
+package canopus
+
+import (
+	"net"
+	"time"
+)
+
+// DefaultObserveMaxAge is the Max-Age, in seconds, sent with notifications
+const DefaultObserveMaxAge = 60
+
+// ObserveConfirmInterval is the longest time between two Confirmable
+// notifications to an observer, which checks it is still interested
+const ObserveConfirmInterval = 24 * time.Hour
+
+// ObserveMaxNonConfirmable is the number of Non-confirmable notifications
+// sent to an observer in a row, after which a Confirmable one is sent
+const ObserveMaxNonConfirmable = 20
+
+// Observe option values of a GET request
+const (
+	observeRegister   = 0
+	observeDeregister = 1
+)
+
+// sequence numbers of notifications are 24 bits long
+const observeSequenceMask = 1<<24 - 1
+
+// observeResumeOffset is added to the sequence number saved when resuming an
+// observation, to go past the notifications sent after it was saved while
+// staying newer than them, see RFC 7641, section 4.4
+const observeResumeOffset = 1 << 22
+
+func NewObservation(session Session, token string, resource string) *Observation {
+	return &Observation{
+		Session:       session,
+		Token:         token,
+		Resource:      resource,
+		NotifyCount:   0,
+		lastConfirmed: time.Now(),
+	}
+}
+
+// Observation is an observer of a resource, identified by its endpoint and
+// the token of its registration, as described in RFC 7641
+type Observation struct {
+	Session     Session
+	Token       string
+	Resource    string
+	NotifyCount int
+
+	// registration request, which notifications are built for
+	request Message
+
+	// PSK identity of an observer over DTLS
+	identity string
+
+	// conditions of notifications, and the state they are checked against
+	attrs        NotifyAttributes
+	lastNotified time.Time
+	lastValue    float64
+	hasLastValue bool
+
+	// latest representation notified, sent again after the MaxPeriod
+	lastTmpl  Message
+	pmaxTimer *time.Timer
+
+	// change held back until the MinPeriod elapses
+	pending        Message
+	pendingConfirm bool
+	pminTimer      *time.Timer
+
+	// Non-confirmable notifications sent since the last Confirmable one
+	nonConfirmable int
+	lastConfirmed  time.Time
+
+	// message ID of the latest notification, which the observer may reject
+	lastMessageID uint16
+}
+
+// Sequence returns the value of the Observe option of the latest
+// notification sent to the observer
+func (o *Observation) Sequence() uint32 {
+	return uint32(o.NotifyCount) & observeSequenceMask
+}
+
+func (o *Observation) endpoint() string {
+	return o.Session.GetAddress().String()
+}
+
+func (o *Observation) stopTimers() {
+	if o.pminTimer != nil {
+		o.pminTimer.Stop()
+		o.pminTimer = nil
+	}
+	if o.pmaxTimer != nil {
+		o.pmaxTimer.Stop()
+		o.pmaxTimer = nil
+	}
+	o.pending = nil
+}
+
+// SetObserveMaxAge sets the Max-Age, in seconds, sent with notifications
+func (s *DefaultCoapServer) SetObserveMaxAge(maxAge uint32) {
+	s.observationsMu.Lock()
+	s.observeMaxAge = maxAge
+	s.observationsMu.Unlock()
+}
+
+// handleReqObserve registers the sender of a GET request as an observer of
+// the resource, or deregisters it, depending on the value of the Observe
+// option. The observer registered is returned
+func (s *DefaultCoapServer) handleReqObserve(msg Message, session Session) *Observation {
+	if msg.GetCode() != Get {
+		return nil
+	}
+	resource := msg.GetURIPath()
+
+	switch uintOptionValue(msg.GetOption(OptionObserve)) {
+	case observeRegister:
+		obs, err := s.addObserver(resource, string(msg.GetToken()), session, msg)
+		if err != nil {
+			s.GetEvents().Error(err)
+		}
+		s.GetEvents().Observe(resource, msg)
+		return obs
+
+	case observeDeregister:
+		if s.removeObserver(resource, session.GetAddress().String(), string(msg.GetToken())) {
+			s.GetEvents().ObserveCancelled(resource, msg)
+		}
+	}
+
+	return nil
+}
+
+// observeResponse adds the Observe option to a successful response to a
+// registration. The observer is removed if the request failed
+func (s *DefaultCoapServer) observeResponse(obs *Observation, resp Message) {
+	if resp.GetCode() < CoapCodeCreated || resp.GetCode() > CoapCodeContinue {
+		s.removeObserver(obs.Resource, obs.endpoint(), obs.Token)
+		return
+	}
+
+	// the registration response is the first notification
+	s.observationsMu.Lock()
+	seq := obs.Sequence()
+	s.notifiedLocked(obs, resp)
+	s.observationsMu.Unlock()
+
+	resp.RemoveOptions(OptionObserve)
+	resp.AddOption(OptionObserve, seq)
+}
+
+// addObserver registers an observer, updating the registration with the same
+// endpoint and token if there is one. Notification attributes are read from
+// the queries of the request, the resource's ones being used if they are
+// invalid
+func (s *DefaultCoapServer) addObserver(resource, token string, session Session, req Message) (*Observation, error) {
+	s.observationsMu.Lock()
+	obs, err := s.addObserverLocked(resource, token, session, req)
+	s.saveObservationLocked(obs)
+	s.observationsMu.Unlock()
+
+	s.writeObservationStore()
+
+	return obs, err
+}
+
+func (s *DefaultCoapServer) addObserverLocked(resource, token string, session Session, req Message) (*Observation, error) {
+	var obs *Observation
+	for _, o := range s.observations[resource] {
+		if o.Token == token && o.endpoint() == session.GetAddress().String() {
+			obs = o
+			obs.Session = session
+			break
+		}
+	}
+
+	if obs == nil {
+		obs = NewObservation(session, token, resource)
+		s.observations[resource] = append(s.observations[resource], obs)
+	}
+	obs.request = req
+	obs.identity = sessionIdentity(session)
+
+	var err error
+	obs.attrs = s.notifyAttributes[resource]
+	if req != nil {
+		if obs.attrs, err = parseNotifyAttributes(obs.attrs, req.GetOptionsAsString(OptionURIQuery)); err != nil {
+			obs.attrs = s.notifyAttributes[resource]
+		}
+	}
+
+	return obs, err
+}
+
+// SetNotifyAttributes sets the conditions under which the observers of a
+// resource are notified, unless overridden by the queries of their
+// registration
+func (s *DefaultCoapServer) SetNotifyAttributes(resource string, attrs NotifyAttributes) {
+	s.observationsMu.Lock()
+	defer s.observationsMu.Unlock()
+
+	s.notifyAttributes[resource] = attrs
+	for _, obs := range s.observations[resource] {
+		obs.attrs = attrs
+		if obs.request != nil {
+			if merged, err := parseNotifyAttributes(attrs, obs.request.GetOptionsAsString(OptionURIQuery)); err == nil {
+				obs.attrs = merged
+			}
+		}
+		s.scheduleMaxPeriodLocked(obs)
+	}
+}
+
+// removeObserver removes the registration with the given endpoint and token,
+// returning false if there is none
+func (s *DefaultCoapServer) removeObserver(resource, endpoint, token string) bool {
+	removed := false
+	s.observationsMu.Lock()
+	for _, obs := range s.observations[resource] {
+		if obs.Token == token && obs.endpoint() == endpoint {
+			removed = s.removeObservationLocked(obs)
+			break
+		}
+	}
+	s.observationsMu.Unlock()
+
+	s.writeObservationStore()
+
+	return removed
+}
+
+func (s *DefaultCoapServer) removeObservationLocked(obs *Observation) bool {
+	list := s.observations[obs.Resource]
+	for idx, o := range list {
+		if o == obs {
+			obs.stopTimers()
+			s.deleteObservationLocked(obs)
+			s.observations[obs.Resource] = append(list[:idx:idx], list[idx+1:]...)
+			if len(s.observations[obs.Resource]) == 0 {
+				delete(s.observations, obs.Resource)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// cancelObservation removes an observer which rejected a notification or
+// failed to acknowledge it
+func (s *DefaultCoapServer) cancelObservation(obs *Observation, msg Message) {
+	s.observationsMu.Lock()
+	removed := s.removeObservationLocked(obs)
+	s.observationsMu.Unlock()
+
+	s.writeObservationStore()
+
+	if removed {
+		s.GetEvents().ObserveCancelled(obs.Resource, msg)
+	}
+}
+
+// handleObserveReset removes the observer a rejected notification was sent to
+func (s *DefaultCoapServer) handleObserveReset(msg Message, session Session) {
+	endpoint := session.GetAddress().String()
+
+	var rejected *Observation
+	s.observationsMu.RLock()
+	for _, list := range s.observations {
+		for _, obs := range list {
+			if obs.lastMessageID == msg.GetMessageId() && obs.endpoint() == endpoint {
+				rejected = obs
+			}
+		}
+	}
+	s.observationsMu.RUnlock()
+
+	if rejected != nil {
+		s.cancelObservation(rejected, msg)
+	}
+}
+
+func (s *DefaultCoapServer) AddObservation(resource, token string, session Session) {
+	s.addObserver(resource, token, session, nil)
+}
+
+func (s *DefaultCoapServer) HasObservation(resource string, addr net.Addr) bool {
+	s.observationsMu.RLock()
+	defer s.observationsMu.RUnlock()
+
+	for _, o := range s.observations[resource] {
+		if o.endpoint() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// observerEndpoints returns the endpoints observing resources
+func (s *DefaultCoapServer) observerEndpoints() map[string]bool {
+	s.observationsMu.RLock()
+	defer s.observationsMu.RUnlock()
+
+	endpoints := make(map[string]bool)
+	for _, observations := range s.observations {
+		for _, o := range observations {
+			endpoints[o.endpoint()] = true
+		}
+	}
+	return endpoints
+}
+
+func (s *DefaultCoapServer) RemoveObservation(resource string, addr net.Addr) {
+	s.observationsMu.Lock()
+	for _, o := range s.observations[resource] {
+		if o.endpoint() == addr.String() {
+			s.removeObservationLocked(o)
+			break
+		}
+	}
+	s.observationsMu.Unlock()
+
+	s.writeObservationStore()
+}
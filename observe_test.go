@@ -0,0 +1,261 @@
+package canopus
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func observerCount(s CoapServer, resource string) int {
+	server := s.(*DefaultCoapServer)
+	server.observationsMu.RLock()
+	defer server.observationsMu.RUnlock()
+
+	return len(server.observations[resource])
+}
+
+func TestServerObserveRegistration(t *testing.T) {
+	s := NewServer()
+	s.Get("/temperature", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.SetStringPayload("20")
+		return NewResponseWithMessage(msg)
+	})
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	resp := sendRequest(t, s, session, peer, Get, "/temperature", withToken("tok1"), withObserve(0))
+	assert.Equal(t, CoapCodeContent, resp.GetCode())
+	assert.NotNil(t, resp.GetOption(OptionObserve))
+	assert.Equal(t, uint32(0), uintOptionValue(resp.GetOption(OptionObserve)))
+	assert.True(t, s.HasObservation("/temperature", peer.LocalAddr()))
+
+	// registering again with the same token updates the registration
+	sendRequest(t, s, session, peer, Get, "/temperature", withToken("tok1"), withObserve(0))
+	assert.Equal(t, 1, observerCount(s, "/temperature"))
+
+	sendRequest(t, s, session, peer, Get, "/temperature", withToken("tok2"), withObserve(0))
+	assert.Equal(t, 2, observerCount(s, "/temperature"))
+
+	resp = sendRequest(t, s, session, peer, Get, "/temperature", withToken("tok1"), withObserve(1))
+	assert.Equal(t, CoapCodeContent, resp.GetCode())
+	assert.Nil(t, resp.GetOption(OptionObserve))
+	assert.Equal(t, 1, observerCount(s, "/temperature"))
+
+	// failed requests don't register an observer
+	resp = sendRequest(t, s, session, peer, Get, "/humidity", withToken("tok3"), withObserve(0))
+	assert.Equal(t, CoapCodeNotFound, resp.GetCode())
+	assert.Nil(t, resp.GetOption(OptionObserve))
+	assert.False(t, s.HasObservation("/humidity", peer.LocalAddr()))
+}
+
+func TestServerObserveNotifications(t *testing.T) {
+	s := NewServer()
+	s.SetTransmissionParams(testTransmissionParams())
+	s.Get("/temperature", func(req Request) Response {
+		return NewResponseWithMessage(ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+	})
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	sendRequest(t, s, session, peer, Get, "/temperature", withToken("tok"), withObserve(0))
+
+	for seq := uint32(1); seq <= 2; seq++ {
+		s.NotifyChange("/temperature", "21", false)
+
+		msg := readMessage(t, peer)
+		assert.Equal(t, uint8(MessageNonConfirmable), msg.GetMessageType())
+		assert.Equal(t, CoapCodeContent, msg.GetCode())
+		assert.Equal(t, []byte("tok"), msg.GetToken())
+		assert.Equal(t, seq, uintOptionValue(msg.GetOption(OptionObserve)))
+		assert.NotNil(t, msg.GetOption(OptionMaxAge))
+		assert.Nil(t, msg.GetOption(OptionURIPath))
+		assert.Equal(t, "21", msg.GetPayload().String())
+	}
+
+	// a Confirmable notification is sent once in a while
+	for i := 2; i < ObserveMaxNonConfirmable; i++ {
+		s.NotifyChange("/temperature", "21", false)
+		readMessage(t, peer)
+	}
+	s.NotifyChange("/temperature", "22", false)
+	msg := readMessage(t, peer)
+	assert.Equal(t, uint8(MessageConfirmable), msg.GetMessageType())
+	s.(*DefaultCoapServer).handleResponse(NewEmptyMessage(msg.GetMessageId()), session)
+
+	// the observer rejects the next notification
+	s.NotifyChange("/temperature", "23", false)
+	msg = readMessage(t, peer)
+	assert.Equal(t, uint8(MessageNonConfirmable), msg.GetMessageType())
+
+	rst := NewMessage(MessageReset, CoapCodeEmpty, msg.GetMessageId())
+	s.(*DefaultCoapServer).handleResponse(rst, session)
+	assert.False(t, s.HasObservation("/temperature", peer.LocalAddr()))
+}
+
+func TestServerObserveUnacknowledgedNotification(t *testing.T) {
+	s := NewServer()
+	s.SetTransmissionParams(testTransmissionParams())
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	cancelled := make(chan string, 1)
+	s.OnObserveCancel(func(resource string, msg Message) {
+		cancelled <- resource
+	})
+
+	s.AddObservation("/temperature", "tok", session)
+	s.NotifyChange("/temperature", "21", true)
+
+	select {
+	case resource := <-cancelled:
+		assert.Equal(t, "/temperature", resource)
+	case <-time.After(5 * time.Second):
+		t.Fatal("observer not removed")
+	}
+	assert.False(t, s.HasObservation("/temperature", peer.LocalAddr()))
+}
+
+func TestClientObserveSubscription(t *testing.T) {
+	s := NewServer()
+	s.Get("/temperature", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.SetStringPayload("20")
+		return NewResponseWithMessage(msg)
+	})
+
+	addr := startTestServer(t, s)
+	defer s.Stop()
+
+	conn, err := Dial(addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	sub, err := conn.Observe(context.Background(), "/temperature")
+	assert.Nil(t, err)
+	assert.Equal(t, "/temperature", sub.Resource())
+	assert.Equal(t, "20", (<-sub.Notifications()).GetMessage().GetPayload().String())
+
+	s.NotifyChange("/temperature", "21", false)
+	obsMsg := <-sub.Notifications()
+	assert.Equal(t, "21", obsMsg.GetMessage().GetPayload().String())
+	assert.Equal(t, uint32(1), uintOptionValue(obsMsg.GetMessage().GetOption(OptionObserve)))
+
+	assert.Nil(t, sub.Cancel())
+	assert.Equal(t, 0, observerCount(s, "/temperature"))
+	_, open := <-sub.Notifications()
+	assert.False(t, open)
+	assert.Nil(t, sub.Err())
+
+	_, err = conn.Observe(context.Background(), "/humidity")
+	assert.Equal(t, ErrObserveNotAccepted, err)
+}
+
+// startObservedPeer starts an endpoint accepting observations with the given
+// Max-Age and sending the notifications with the given sequence numbers and
+// payloads after the first registration. The messages received are sent to
+// the returned channel
+func startObservedPeer(t *testing.T, maxAge uint32, seqs []uint32, payloads []string) (net.PacketConn, chan Message) {
+	var once sync.Once
+	return startTestPeer(t, 0, func(msg Message) []Message {
+		if msg.GetMessageType() != MessageConfirmable {
+			return nil
+		}
+
+		ack := ContentMessage(0, MessageAcknowledgment)
+		ack.SetStringPayload("registered")
+		if uintOptionValue(msg.GetOption(OptionObserve)) == observeRegister {
+			ack.AddOption(OptionObserve, uint32(5))
+			ack.AddOption(OptionMaxAge, maxAge)
+		}
+
+		answers := []Message{ack}
+		once.Do(func() {
+			for i, seq := range seqs {
+				notification := ContentMessage(GenerateMessageID(), MessageNonConfirmable)
+				notification.SetToken(msg.GetToken())
+				notification.AddOption(OptionObserve, seq)
+				notification.AddOption(OptionMaxAge, maxAge)
+				notification.SetStringPayload(payloads[i])
+				answers = append(answers, notification)
+			}
+		})
+		return answers
+	})
+}
+
+func TestClientObserveFreshness(t *testing.T) {
+	// 6 is older than 7, 0 follows 2^24 - 1
+	seqs := []uint32{7, 6, 1<<23 + 6, 1<<24 - 1, 0}
+	pc, _ := startObservedPeer(t, 60, seqs, []string{"b", "stale", "c", "d", "e"})
+	defer pc.Close()
+
+	conn, err := Dial(pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	sub, err := conn.Observe(context.Background(), "/watch")
+	assert.Nil(t, err)
+	defer sub.Cancel()
+
+	var values []string
+	for value := ""; value != "e"; {
+		select {
+		case obsMsg := <-sub.Notifications():
+			value = obsMsg.GetMessage().GetPayload().String()
+			assert.NotEqual(t, "stale", value)
+			values = append(values, value)
+		case <-time.After(5 * time.Second):
+			t.Fatal("notification not received")
+		}
+	}
+	assert.Equal(t, []string{"registered", "b", "c", "d", "e"}, values)
+}
+
+func TestClientObserveReregistration(t *testing.T) {
+	pc, rcvd := startObservedPeer(t, 1, nil, nil)
+	defer pc.Close()
+
+	conn, err := Dial(pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	sub, err := conn.Observe(context.Background(), "/watch")
+	assert.Nil(t, err)
+	<-sub.Notifications()
+	<-rcvd
+
+	// registered again once the Max-Age of the registration response expires
+	select {
+	case msg := <-rcvd:
+		assert.Equal(t, sub.Token(), msg.GetTokenString())
+		assert.Equal(t, "/watch", msg.GetURIPath())
+		assert.Equal(t, uint32(observeRegister), uintOptionValue(msg.GetOption(OptionObserve)))
+	case <-time.After(5 * time.Second):
+		t.Fatal("registration not renewed")
+	}
+
+	assert.Nil(t, sub.Cancel())
+	msg := <-rcvd
+	assert.Equal(t, sub.Token(), msg.GetTokenString())
+	assert.Equal(t, uint32(observeDeregister), uintOptionValue(msg.GetOption(OptionObserve)))
+
+	// ending the subscription with its context
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err = conn.Observe(ctx, "/watch")
+	assert.Nil(t, err)
+	cancel()
+	for range sub.Notifications() {
+	}
+	assert.Equal(t, context.Canceled, sub.Err())
+}
@@ -0,0 +1,120 @@
+package canopus
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidNotifyAttribute = errors.New("Invalid notification attribute")
+
+// NotifyAttributes are the conditions under which an observer is notified of
+// a change, as set by LwM2M servers with the pmin, pmax, gt, lt and st
+// attributes
+type NotifyAttributes struct {
+	// MinPeriod is the shortest time between two notifications. Changes
+	// within it are batched, only the latest one being sent once it elapses
+	MinPeriod time.Duration
+
+	// MaxPeriod is the longest time without a notification, after which the
+	// current representation is sent again
+	MaxPeriod time.Duration
+
+	// Changes of numeric resources are only notified when the value crosses
+	// GreaterThan or LessThan, or differs by at least Step from the value
+	// last notified. Nil thresholds aren't checked
+	GreaterThan *float64
+	LessThan    *float64
+	Step        *float64
+}
+
+// ParseNotifyAttributes reads notification attributes from the Uri-Query
+// options of a request. Other queries are ignored
+func ParseNotifyAttributes(query []string) (NotifyAttributes, error) {
+	return parseNotifyAttributes(NotifyAttributes{}, query)
+}
+
+// parseNotifyAttributes overrides attributes with those found in the queries
+func parseNotifyAttributes(attrs NotifyAttributes, query []string) (NotifyAttributes, error) {
+	for _, q := range query {
+		kv := strings.SplitN(q, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "pmin", "pmax":
+			secs, err := strconv.ParseUint(kv[1], 10, 32)
+			if err != nil {
+				return attrs, ErrInvalidNotifyAttribute
+			}
+			if kv[0] == "pmin" {
+				attrs.MinPeriod = time.Duration(secs) * time.Second
+			} else {
+				attrs.MaxPeriod = time.Duration(secs) * time.Second
+			}
+
+		case "gt", "lt", "st":
+			v, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || (kv[0] == "st" && v < 0) {
+				return attrs, ErrInvalidNotifyAttribute
+			}
+			switch kv[0] {
+			case "gt":
+				attrs.GreaterThan = &v
+			case "lt":
+				attrs.LessThan = &v
+			case "st":
+				attrs.Step = &v
+			}
+		}
+	}
+
+	if attrs.MaxPeriod > 0 && attrs.MaxPeriod < attrs.MinPeriod {
+		return attrs, ErrInvalidNotifyAttribute
+	}
+	if attrs.GreaterThan != nil && attrs.LessThan != nil && *attrs.LessThan >= *attrs.GreaterThan {
+		return attrs, ErrInvalidNotifyAttribute
+	}
+
+	return attrs, nil
+}
+
+func (a NotifyAttributes) hasThresholds() bool {
+	return a.GreaterThan != nil || a.LessThan != nil || a.Step != nil
+}
+
+// changed checks if a new value meets any of the thresholds, compared to the
+// value last notified
+func (a NotifyAttributes) changed(last, value float64) bool {
+	if a.GreaterThan != nil && crosses(last, value, *a.GreaterThan) {
+		return true
+	}
+	if a.LessThan != nil && crosses(last, value, *a.LessThan) {
+		return true
+	}
+	if a.Step != nil && math.Abs(value-last) >= *a.Step {
+		return true
+	}
+	return false
+}
+
+// crosses checks if a value moved from one side of a threshold to the other
+func crosses(last, value, threshold float64) bool {
+	return (last <= threshold) != (value <= threshold)
+}
+
+// numericValue returns the value of a numeric representation sent as text
+func numericValue(msg Message) (float64, bool) {
+	if msg.GetPayload() == nil {
+		return 0, false
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(msg.GetPayload().String()), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
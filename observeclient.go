@@ -0,0 +1,239 @@
+package canopus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrObserveNotAccepted = errors.New("Observe registration not accepted by the server")
+
+// observeFreshnessWindow is the time after which a notification is newer than
+// the previous one, whatever their sequence numbers (RFC 7641, section 3.4)
+const observeFreshnessWindow = 128 * time.Second
+
+// notifications queued for a subscription while it is busy. The oldest ones
+// are dropped once it is full
+const subscriptionBacklog = 8
+
+// Subscription is the observation of a resource by a client, as described in
+// RFC 7641. Fresh notifications are delivered to its channel, stale and
+// reordered ones are dropped
+type Subscription struct {
+	conn     *UDPConnection
+	resource string
+	req      Message
+
+	notifications chan ObserveMessage
+	in            chan Message
+	quit          chan struct{}
+	finished      chan struct{}
+	err           error
+
+	cancelOnce sync.Once
+	cancelErr  error
+
+	// Observe sequence number and arrival of the latest fresh notification
+	seq      uint32
+	received time.Time
+}
+
+// Observe registers an observation of a resource, returning once the server
+// accepted it. Notifications, starting with the registration response, are
+// delivered to the subscription's channel until it is cancelled, ctx is done
+// or the connection is closed. The registration is renewed whenever the
+// Max-Age of the latest notification expires
+func (c *UDPConnection) Observe(ctx context.Context, resource string) (*Subscription, error) {
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI(resource)
+	req.GetMessage().AddOption(OptionObserve, observeRegister)
+
+	sub := &Subscription{
+		conn:          c,
+		resource:      resource,
+		req:           req.GetMessage(),
+		notifications: make(chan ObserveMessage),
+		in:            make(chan Message, subscriptionBacklog),
+		quit:          make(chan struct{}),
+		finished:      make(chan struct{}),
+	}
+
+	c.mux.addObservation(sub.Token(), sub.in)
+	first, err := sub.register(ctx)
+	if err != nil {
+		c.mux.removeObservation(sub.Token())
+		return nil, err
+	}
+
+	go sub.run(ctx, first)
+
+	return sub, nil
+}
+
+// Notifications returns the channel notifications are delivered to. It is
+// closed once the subscription ends
+func (s *Subscription) Notifications() <-chan ObserveMessage {
+	return s.notifications
+}
+
+// Token returns the token of the observation
+func (s *Subscription) Token() string {
+	return string(s.req.GetToken())
+}
+
+// Resource returns the path of the observed resource
+func (s *Subscription) Resource() string {
+	return s.resource
+}
+
+// Err returns why the subscription ended, once its channel is closed. It is
+// nil if the subscription was cancelled
+func (s *Subscription) Err() error {
+	select {
+	case <-s.finished:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Cancel ends the subscription and deregisters the observation with a GET
+// request carrying an Observe option of 1
+func (s *Subscription) Cancel() error {
+	s.cancelOnce.Do(func() {
+		close(s.quit)
+		<-s.finished
+
+		_, s.cancelErr = s.conn.mux.send(context.Background(), s.request(observeDeregister), s.conn.params)
+	})
+
+	return s.cancelErr
+}
+
+func (s *Subscription) run(ctx context.Context, first Message) {
+	defer close(s.notifications)
+	defer close(s.finished)
+	defer s.conn.mux.removeObservation(s.Token())
+
+	pending := []ObserveMessage{s.accept(first)}
+	timer := time.NewTimer(notificationMaxAge(first))
+	defer timer.Stop()
+
+	for {
+		var out chan ObserveMessage
+		var next ObserveMessage
+		if len(pending) > 0 {
+			out, next = s.notifications, pending[0]
+		}
+
+		select {
+		case out <- next:
+			pending = pending[1:]
+
+		case msg := <-s.in:
+			if !s.isFresh(msg) {
+				continue
+			}
+			pending = queueNotification(pending, s.accept(msg))
+
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(notificationMaxAge(msg))
+
+		case <-timer.C:
+			msg, err := s.register(ctx)
+			if err != nil {
+				s.err = err
+				return
+			}
+			if s.isFresh(msg) {
+				pending = queueNotification(pending, s.accept(msg))
+			}
+			timer.Reset(notificationMaxAge(msg))
+
+		case <-s.quit:
+			return
+
+		case <-ctx.Done():
+			s.err = ctx.Err()
+			return
+
+		case <-s.conn.mux.done:
+			s.err = ErrConnectionClosed
+			return
+		}
+	}
+}
+
+// register sends a registration request, returning the response if the
+// server accepted it
+func (s *Subscription) register(ctx context.Context) (Message, error) {
+	resp, err := s.conn.sendBlockwise(ctx, s.request(observeRegister))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := resp.GetMessage()
+	if msg.GetCode() < CoapCodeCreated || msg.GetCode() > CoapCodeContinue || msg.GetOption(OptionObserve) == nil {
+		return nil, ErrObserveNotAccepted
+	}
+
+	return msg, nil
+}
+
+// request builds a registration or deregistration request, with the token
+// and options of the initial registration
+func (s *Subscription) request(observe uint32) Message {
+	msg := NewMessage(MessageConfirmable, Get, GenerateMessageID())
+	msg.SetToken(s.req.GetToken())
+	for _, opt := range s.req.GetAllOptions() {
+		switch opt.GetCode() {
+		case OptionObserve, OptionBlock2:
+		default:
+			msg.AddOptions([]Option{opt})
+		}
+	}
+	msg.AddOption(OptionObserve, observe)
+
+	return msg
+}
+
+// isFresh checks if a notification is newer than the latest one delivered,
+// following the rules of RFC 7641, section 3.4
+func (s *Subscription) isFresh(msg Message) bool {
+	v1, v2 := s.seq, uintOptionValue(msg.GetOption(OptionObserve))
+
+	return (v1 < v2 && v2-v1 < 1<<23) ||
+		(v1 > v2 && v1-v2 > 1<<23) ||
+		time.Since(s.received) > observeFreshnessWindow
+}
+
+func (s *Subscription) accept(msg Message) ObserveMessage {
+	s.seq = uintOptionValue(msg.GetOption(OptionObserve))
+	s.received = time.Now()
+
+	return NewObserveMessage(s.resource, msg.GetPayload(), msg)
+}
+
+func queueNotification(pending []ObserveMessage, obsMsg ObserveMessage) []ObserveMessage {
+	if len(pending) == subscriptionBacklog {
+		pending = pending[1:]
+	}
+	return append(pending, obsMsg)
+}
+
+// notificationMaxAge returns how long a notification stays fresh. A Max-Age
+// of 0 is taken as a second, so that registrations aren't renewed in a loop
+func notificationMaxAge(msg Message) time.Duration {
+	age := uint32(DefaultObserveMaxAge)
+	if opt := msg.GetOption(OptionMaxAge); opt != nil {
+		age = uintOptionValue(opt)
+	}
+	if age == 0 {
+		age = 1
+	}
+
+	return time.Duration(age) * time.Second
+}
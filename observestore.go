@@ -0,0 +1,351 @@
+package canopus
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ObservationRecord is the state of an observation kept by an
+// ObservationStore, from which notifications resume after a restart
+type ObservationRecord struct {
+	Resource string
+	Token    string
+	Endpoint string
+
+	// PSK identity of an observer over DTLS, which is resumed once it
+	// connects again, possibly from another address
+	Identity string
+
+	// Observe option value of the latest notification when the observation
+	// was saved. Records aren't updated by notifications, resumed
+	// observations jump ahead of the notifications sent since instead
+	Sequence uint32
+
+	// registration request, as received from the observer
+	Request []byte
+}
+
+func (r ObservationRecord) key() string {
+	return r.Resource + " " + r.Endpoint + " " + r.Token
+}
+
+// ObservationStore keeps the observations of a server, so that they survive
+// a restart
+type ObservationStore interface {
+	// Save adds an observation, or updates the one with the same resource,
+	// endpoint and token
+	Save(rec ObservationRecord) error
+	Delete(rec ObservationRecord) error
+	Load() ([]ObservationRecord, error)
+}
+
+func NewMemoryObservationStore() *MemoryObservationStore {
+	return &MemoryObservationStore{
+		records: make(map[string]ObservationRecord),
+	}
+}
+
+// MemoryObservationStore keeps observations in memory, for as long as the
+// server runs. It is the default store of a server
+type MemoryObservationStore struct {
+	mu      sync.Mutex
+	records map[string]ObservationRecord
+}
+
+func (m *MemoryObservationStore) Save(rec ObservationRecord) error {
+	m.mu.Lock()
+	m.records[rec.key()] = rec
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *MemoryObservationStore) Delete(rec ObservationRecord) error {
+	m.mu.Lock()
+	delete(m.records, rec.key())
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Load returns the observations, ordered by resource, endpoint and token
+func (m *MemoryObservationStore) Load() ([]ObservationRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sortedLocked(), nil
+}
+
+func (m *MemoryObservationStore) sortedLocked() []ObservationRecord {
+	records := make([]ObservationRecord, 0, len(m.records))
+	for _, rec := range m.records {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].key() < records[j].key()
+	})
+
+	return records
+}
+
+// NewFileObservationStore opens a store keeping observations in a JSON file,
+// which is created on the first change if it doesn't exist
+func NewFileObservationStore(path string) (*FileObservationStore, error) {
+	store := &FileObservationStore{
+		mem:  NewMemoryObservationStore(),
+		path: path,
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []ObservationRecord
+	if err = json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		store.mem.records[rec.key()] = rec
+	}
+
+	return store, nil
+}
+
+// FileObservationStore keeps observations in a JSON file, which is rewritten
+// on every change
+type FileObservationStore struct {
+	mem  *MemoryObservationStore
+	path string
+}
+
+func (f *FileObservationStore) Save(rec ObservationRecord) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+
+	f.mem.records[rec.key()] = rec
+	return f.writeLocked()
+}
+
+func (f *FileObservationStore) Delete(rec ObservationRecord) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+
+	if _, ok := f.mem.records[rec.key()]; !ok {
+		return nil
+	}
+	delete(f.mem.records, rec.key())
+	return f.writeLocked()
+}
+
+func (f *FileObservationStore) Load() ([]ObservationRecord, error) {
+	return f.mem.Load()
+}
+
+// writeLocked replaces the file with the current observations, through a
+// temporary file so that it is never left half written
+func (f *FileObservationStore) writeLocked() error {
+	b, err := json.Marshal(f.mem.sortedLocked())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// SetObservationStore sets the store observations are saved to, resuming
+// those it holds once the server is serving. It must be called before
+// serving
+func (s *DefaultCoapServer) SetObservationStore(store ObservationStore) error {
+	records, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	s.observationsMu.Lock()
+	s.observationStore = store
+	s.restored = records
+	s.observationsMu.Unlock()
+
+	return nil
+}
+
+// sessionIdentity returns the PSK identity of a DTLS session
+func sessionIdentity(session Session) string {
+	if ssn, ok := session.(interface {
+		Identity() string
+	}); ok {
+		return ssn.Identity()
+	}
+	return ""
+}
+
+func observationRecord(obs *Observation) ObservationRecord {
+	rec := ObservationRecord{
+		Resource: obs.Resource,
+		Token:    obs.Token,
+		Endpoint: obs.endpoint(),
+		Identity: obs.identity,
+		Sequence: obs.Sequence(),
+	}
+	if obs.request != nil {
+		rec.Request, _ = MessageToBytes(obs.request)
+	}
+
+	return rec
+}
+
+// observationChange is a registration or a deregistration, written to the
+// store once the observations lock is released
+type observationChange struct {
+	rec     ObservationRecord
+	deleted bool
+}
+
+// saveObservationLocked queues the saving of an observation to the store.
+// The observations lock must be held
+func (s *DefaultCoapServer) saveObservationLocked(obs *Observation) {
+	s.storeChanges = append(s.storeChanges, observationChange{rec: observationRecord(obs)})
+}
+
+func (s *DefaultCoapServer) deleteObservationLocked(obs *Observation) {
+	s.storeChanges = append(s.storeChanges, observationChange{rec: observationRecord(obs), deleted: true})
+}
+
+// writeObservationStore writes the queued changes to the store, in the order
+// they were made. It must be called without the observations lock, so that
+// notifications aren't held up by store I/O
+func (s *DefaultCoapServer) writeObservationStore() {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+
+	s.observationsMu.Lock()
+	store := s.observationStore
+	changes := s.storeChanges
+	s.storeChanges = nil
+	s.observationsMu.Unlock()
+
+	for _, c := range changes {
+		var err error
+		if c.deleted {
+			err = store.Delete(c.rec)
+		} else {
+			err = store.Save(c.rec)
+		}
+		if err != nil {
+			s.GetEvents().Error(err)
+		}
+	}
+}
+
+// restoreObservations resumes the observations loaded from the store. Those
+// over UDP are resumed on conn, if any, and those over DTLS once observers
+// connect again
+func (s *DefaultCoapServer) restoreObservations(conn ServerConnection) {
+	var udp, kept []ObservationRecord
+
+	s.observationsMu.Lock()
+	for _, rec := range s.restored {
+		switch {
+		case rec.Identity != "":
+			s.detached = append(s.detached, rec)
+		case conn != nil:
+			udp = append(udp, rec)
+		default:
+			kept = append(kept, rec)
+		}
+	}
+	s.restored = kept
+	s.observationsMu.Unlock()
+
+	for _, rec := range udp {
+		addr, err := net.ResolveUDPAddr("udp", rec.Endpoint)
+		if err != nil {
+			s.GetEvents().Error(err)
+			continue
+		}
+		s.resumeObservation(rec, s.udpSession(addr, conn))
+	}
+}
+
+// resumeDetachedObservations resumes the observations of a client which
+// connected again over DTLS with the same PSK identity
+func (s *DefaultCoapServer) resumeDetachedObservations(session Session) {
+	s.observationsMu.RLock()
+	detached := len(s.detached)
+	s.observationsMu.RUnlock()
+
+	if detached == 0 {
+		return
+	}
+	identity := sessionIdentity(session)
+	if identity == "" {
+		return
+	}
+
+	var resumed, kept []ObservationRecord
+	s.observationsMu.Lock()
+	for _, rec := range s.detached {
+		if rec.Identity == identity {
+			resumed = append(resumed, rec)
+		} else {
+			kept = append(kept, rec)
+		}
+	}
+	s.detached = kept
+	s.observationsMu.Unlock()
+
+	for _, rec := range resumed {
+		s.resumeObservation(rec, session)
+	}
+}
+
+// resumeObservation registers an observer loaded from the store. As the
+// notifications sent after the record was saved aren't known, the sequence
+// number jumps observeResumeOffset ahead of the one saved
+func (s *DefaultCoapServer) resumeObservation(rec ObservationRecord, session Session) {
+	var req Message
+	if len(rec.Request) > 0 {
+		if msg, err := BytesToMessage(rec.Request); err == nil {
+			req = msg
+		}
+	}
+
+	s.observationsMu.Lock()
+	if rec.Endpoint != session.GetAddress().String() {
+		// the observer came back from another address
+		s.storeChanges = append(s.storeChanges, observationChange{rec: rec, deleted: true})
+	}
+
+	obs, _ := s.addObserverLocked(rec.Resource, rec.Token, session, req)
+	obs.NotifyCount = int(rec.Sequence) + observeResumeOffset
+	obs.identity = rec.Identity
+	s.saveObservationLocked(obs)
+	s.scheduleMaxPeriodLocked(obs)
+	s.observationsMu.Unlock()
+
+	s.writeObservationStore()
+}
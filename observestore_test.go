@@ -0,0 +1,160 @@
+package canopus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileObservationStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canopus")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "observations.json")
+
+	store, err := NewFileObservationStore(path)
+	assert.Nil(t, err)
+	records, err := store.Load()
+	assert.Nil(t, err)
+	assert.Empty(t, records)
+
+	temp := ObservationRecord{Resource: "/temp", Token: "a", Endpoint: "127.0.0.1:5683", Sequence: 1}
+	humidity := ObservationRecord{Resource: "/humidity", Token: "b", Endpoint: "127.0.0.1:5683", Identity: "sensor"}
+	assert.Nil(t, store.Save(temp))
+	assert.Nil(t, store.Save(humidity))
+
+	temp.Sequence = 2
+	assert.Nil(t, store.Save(temp))
+
+	// observations are read back once reopened
+	store, err = NewFileObservationStore(path)
+	assert.Nil(t, err)
+	records, err = store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, []ObservationRecord{humidity, temp}, records)
+
+	assert.Nil(t, store.Delete(humidity))
+	store, err = NewFileObservationStore(path)
+	assert.Nil(t, err)
+	records, err = store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, []ObservationRecord{temp}, records)
+}
+
+func TestServerObservationStore(t *testing.T) {
+	store := NewMemoryObservationStore()
+	s := newReadingServer()
+	assert.Nil(t, s.SetObservationStore(store))
+
+	session, peer := registerObserver(t, s, MediaTypeApplicationJSON)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	records, _ := store.Load()
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, "/reading", records[0].Resource)
+		assert.Equal(t, peer.LocalAddr().String(), records[0].Endpoint)
+		assert.NotEmpty(t, records[0].Request)
+	}
+
+	// notifications aren't written to the store
+	s.NotifyChange("/reading", "22", false)
+	readMessage(t, peer)
+	records, _ = store.Load()
+	assert.Equal(t, uint32(0), records[0].Sequence)
+
+	s.RemoveObservation("/reading", peer.LocalAddr())
+	records, _ = store.Load()
+	assert.Empty(t, records)
+}
+
+func TestServerRestoreObservations(t *testing.T) {
+	store := NewMemoryObservationStore()
+	s := newReadingServer()
+	assert.Nil(t, s.SetObservationStore(store))
+
+	session, peer := registerObserver(t, s, MediaTypeApplicationJSON)
+	defer peer.Close()
+
+	s.NotifyChange("/reading", "22", false)
+	msg := readMessage(t, peer)
+	token := msg.GetToken()
+	last := uintOptionValue(msg.GetOption(OptionObserve))
+	session.GetConnection().Close()
+
+	// a new server resumes the observation, with notifications newer than
+	// those sent before the restart
+	restarted := newReadingServer()
+	assert.Nil(t, restarted.SetObservationStore(store))
+	started := make(chan bool, 1)
+	restarted.OnStart(func(CoapServer) {
+		started <- true
+	})
+	startTestServer(t, restarted)
+	defer restarted.Stop()
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("server not started")
+	}
+	assert.True(t, restarted.HasObservation("/reading", peer.LocalAddr()))
+
+	restarted.NotifyChange("/reading", "23", false)
+	msg = readMessage(t, peer)
+	assert.Equal(t, token, msg.GetToken())
+	assert.Equal(t, "23", msg.GetPayload().String())
+	assert.True(t, (&Subscription{seq: last, received: time.Now()}).isFresh(msg))
+}
+
+// identitySession is a session authenticated with a PSK identity
+type identitySession struct {
+	*UDPServerSession
+	identity string
+}
+
+func (s identitySession) Identity() string {
+	return s.identity
+}
+
+func TestServerResumeDetachedObservations(t *testing.T) {
+	store := NewMemoryObservationStore()
+	store.Save(ObservationRecord{
+		Resource: "/reading",
+		Token:    "tok",
+		Endpoint: "127.0.0.1:1",
+		Identity: "sensor",
+		Sequence: 7,
+	})
+
+	s := newReadingServer().(*DefaultCoapServer)
+	assert.Nil(t, s.SetObservationStore(store))
+	s.restoreObservations(nil)
+
+	udpSession, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer udpSession.GetConnection().Close()
+
+	// other identities don't take over the observation
+	s.resumeDetachedObservations(identitySession{udpSession, "other"})
+	assert.False(t, s.HasObservation("/reading", peer.LocalAddr()))
+
+	s.resumeDetachedObservations(identitySession{udpSession, "sensor"})
+	assert.True(t, s.HasObservation("/reading", peer.LocalAddr()))
+
+	// the record follows the observer to its new address
+	records, _ := store.Load()
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, peer.LocalAddr().String(), records[0].Endpoint)
+	}
+
+	s.NotifyChange("/reading", "22", false)
+	msg := readMessage(t, peer)
+	assert.Equal(t, []byte("tok"), msg.GetToken())
+	assert.True(t, (&Subscription{seq: 7, received: time.Now()}).isFresh(msg))
+	assert.Equal(t, uint32(7+observeResumeOffset+1), uintOptionValue(msg.GetOption(OptionObserve)))
+}
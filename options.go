@@ -1,7 +1,6 @@
 package canopus
 
 import (
-	"math"
 	"strings"
 )
 
@@ -44,8 +43,10 @@ func (o *CoapOption) StringValue() string {
 	return o.Value.(string)
 }
 
+// Returns the integer value of an option, which may have been decoded from
+// a message as an uint32
 func (o *CoapOption) IntValue() int {
-	return o.Value.(int)
+	return int(uintOptionValue(o))
 }
 
 // Instantiates a New Option
@@ -91,7 +92,7 @@ func IsValidOption(opt Option) bool {
 	case OptionIfNoneMatch, OptionURIHost,
 		OptionEtag, OptionIfMatch, OptionObserve, OptionURIPort, OptionLocationPath,
 		OptionURIPath, OptionContentFormat, OptionMaxAge, OptionURIQuery, OptionAccept,
-		OptionLocationQuery, OptionBlock2, OptionBlock1, OptionProxyURI, OptionProxyScheme, OptionSize1:
+		OptionLocationQuery, OptionBlock2, OptionBlock1, OptionProxyURI, OptionProxyScheme, OptionSize1, OptionSize2:
 		return true
 
 	default:
@@ -114,78 +115,128 @@ func IsCriticalOption(opt Option) bool {
 	return !IsElectiveOption(opt)
 }
 
+// NewBlock1Option creates a Block1 option for block number seq, of size
+// 2^(bs + 4), with more set if further blocks follow
 func NewBlock1Option(bs BlockSizeType, more bool, seq uint32) *Block1Option {
 	opt := &Block1Option{}
 	opt.Code = OptionBlock1
+	opt.Value = encodeBlockValue(bs, more, seq)
 
-	val := seq
+	return opt
+}
 
-	val = val << 4
-	if more {
-		val |= (1 << 3)
-	}
+func Block1OptionFromOption(opt Option) *Block1Option {
+	blockOpt := &Block1Option{}
+
+	blockOpt.Value = opt.GetValue()
+	blockOpt.Code = opt.GetCode()
+
+	return blockOpt
+}
 
-	val |= (uint32(bs) << 0)
+// Block1Option controls the blockwise transfer of a request payload,
+// as described in RFC 7959
+type Block1Option struct {
+	CoapOption
+}
 
-	opt.Value = val
+func (o *Block1Option) Sequence() uint32 {
+	return blockOptionValue(o) >> 4
+}
 
-	/*
-		BLockSize
-		val := o.Value.(uint)
-		exp := val & 0x07
+func (o *Block1Option) Exponent() uint32 {
+	return blockOptionValue(o) & 0x07
+}
 
-		return math.Exp2(float64(exp + 4))
+// BlockSizeLength returns the size of a block in bytes
+func (o *Block1Option) BlockSizeLength() uint32 {
+	return blockSizeLength(o.Exponent())
+}
 
-		More
-		val := o.Value.(uint)
+// Size returns the block size exponent (SZX)
+func (o *Block1Option) Size() BlockSizeType {
+	return BlockSizeType(o.Exponent())
+}
 
-		return ((val >> 3) & 0x01) == 1
+func (o *Block1Option) HasMore() bool {
+	return ((blockOptionValue(o) >> 3) & 0x01) == 1
+}
 
-	*/
+// NewBlock2Option creates a Block2 option for block number num, of size
+// 2^(szx + 4), with more set if further blocks follow
+func NewBlock2Option(szx BlockSizeType, more bool, num uint32) *Block2Option {
+	opt := &Block2Option{}
+	opt.Code = OptionBlock2
+	opt.Value = encodeBlockValue(szx, more, num)
 
 	return opt
 }
 
-func Block1OptionFromOption(opt Option) *Block1Option {
-	blockOpt := &Block1Option{}
+func Block2OptionFromOption(opt Option) *Block2Option {
+	blockOpt := &Block2Option{}
 
-	blockOpt.Value = opt.GetValue()
+	blockOpt.Value = blockOptionValue(opt)
 	blockOpt.Code = opt.GetCode()
 
 	return blockOpt
 }
 
-type Block1Option struct {
+// Block2Option controls the blockwise transfer of a response payload,
+// as described in RFC 7959
+type Block2Option struct {
 	CoapOption
 }
 
-func (o *Block1Option) Sequence() uint32 {
-	val := o.GetValue().(uint32)
+func (o *Block2Option) Sequence() uint32 {
+	return o.Value.(uint32) >> 4
+}
 
-	return val >> 4
+func (o *Block2Option) Exponent() uint32 {
+	return o.Value.(uint32) & 0x07
 }
 
-func (o *Block1Option) Exponent() uint32 {
-	val := o.GetValue().(uint32)
+// BlockSizeLength returns the size of a block in bytes
+func (o *Block2Option) BlockSizeLength() uint32 {
+	return blockSizeLength(o.Exponent())
+}
 
-	return val & 0x07
+func (o *Block2Option) HasMore() bool {
+	return ((o.Value.(uint32) >> 3) & 0x01) == 1
 }
 
-func (o *Block1Option) BlockSizeLength() uint32 {
-	sz := uint32(o.Size()) + 4
+func encodeBlockValue(szx BlockSizeType, more bool, num uint32) uint32 {
+	val := num << 4
+	if more {
+		val |= 1 << 3
+	}
 
-	return sz * sz
+	return val | uint32(szx)&0x07
 }
 
-func (o *Block1Option) Size() BlockSizeType {
-	val := o.GetValue().(uint32)
-	exp := val & 0x07
+// blockOptionValue returns the value of a Block1 or Block2 option, which is
+// empty when every field is zero
+func blockOptionValue(opt Option) uint32 {
+	v, _ := opt.GetValue().(uint32)
 
-	return BlockSizeType(byte(math.Exp2(float64(exp + 4))))
+	return v
 }
 
-func (o *Block1Option) HasMore() bool {
-	val := o.Value.(uint32)
+// blockSizeLength returns the size in bytes of the blocks with the given
+// exponent, i.e. 2^(szx + 4)
+func blockSizeLength(szx uint32) uint32 {
+	return 1 << (szx + 4)
+}
 
-	return ((val >> 3) & 0x01) == 1
+// uintOptionValue returns the value of an option holding an unsigned integer,
+// such as Observe or Max-Age
+func uintOptionValue(opt Option) uint32 {
+	switch v := opt.GetValue().(type) {
+	case uint32:
+		return v
+	case int:
+		return uint32(v)
+	case MediaType:
+		return uint32(v)
+	}
+	return 0
 }
@@ -1,6 +1,8 @@
 package canopus
 
 import (
+	"bytes"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -59,10 +61,14 @@ func NewClientRequestFromMessage(msg Message, attrs map[string]string, session S
 // Wraps a CoAP Message as a Request
 // Provides various methods which proxies the Message object methods
 type CoapRequest struct {
-	msg     Message
-	attrs   map[string]string
-	session Session
-	server  *CoapServer
+	msg          Message
+	attrs        map[string]string
+	session      Session
+	server       *CoapServer
+	acknowledged bool
+
+	// body of a request streamed in Block1 blocks
+	body io.Reader
 }
 
 func (c *CoapRequest) SetProxyURI(uri string) {
@@ -77,6 +83,18 @@ func (c *CoapRequest) GetSession() Session {
 	return c.session
 }
 
+// DeferResponse acknowledges a Confirmable request with an empty ACK straight
+// away, so that a handler can return NoResponse() and send the actual
+// response later using the returned SeparateResponder
+func (c *CoapRequest) DeferResponse() *SeparateResponder {
+	if c.msg.GetMessageType() == MessageConfirmable && !c.acknowledged {
+		c.acknowledged = true
+		SendMessage(NewMessageOfType(MessageAcknowledgment, c.msg.GetMessageId(), nil), c.session)
+	}
+
+	return newSeparateResponder(c.msg, c.session)
+}
+
 func (c *CoapRequest) GetAttributes() map[string]string {
 	return c.attrs
 }
@@ -96,6 +114,19 @@ func (c *CoapRequest) GetMessage() Message {
 	return c.msg
 }
 
+// Body returns a reader of the request payload. For routes registered with
+// HandleStream, the blocks of an upload are read as they are received
+func (c *CoapRequest) Body() io.Reader {
+	if c.body != nil {
+		return c.body
+	}
+
+	if c.msg.GetPayload() == nil {
+		return bytes.NewReader(nil)
+	}
+	return bytes.NewReader(c.msg.GetPayload().GetBytes())
+}
+
 func (c *CoapRequest) SetStringPayload(s string) {
 	c.msg.(*CoapMessage).SetPayload(NewPlainTextPayload(s))
 }
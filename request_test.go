@@ -8,7 +8,7 @@ import (
 
 func TestRequest(t *testing.T) {
 	var req Request
-	assert.NotNil(t, NewRequest(MessageConfirmable, Get, 12345))
+	assert.NotNil(t, NewRequestWithMessageId(MessageConfirmable, Get, 12345))
 
 	msg := NewMessage(MessageConfirmable, Get, 12345)
 
@@ -19,7 +19,7 @@ func TestRequest(t *testing.T) {
 	// &net.UDPConn{}, &net.UDPAddr{}
 	assert.NotNil(t, NewClientRequestFromMessage(msg, make(map[string]string), nil))
 
-	req = NewRequest(MessageConfirmable, Get, 12345)
+	req = NewRequestWithMessageId(MessageConfirmable, Get, 12345)
 	assert.Equal(t, uint8(0), req.GetMessage().GetMessageType())
 
 	req.SetConfirmable(false)
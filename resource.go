@@ -0,0 +1,305 @@
+package canopus
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Resource is a CoAP resource served at its path, with a route for each of
+// the methods it implements among ResourceGetter, ResourcePutter,
+// ResourcePoster, ResourceDeleter and ResourceObserver. Resources
+// implementing LinkedResource are published in /.well-known/core with their
+// link attributes
+type Resource interface {
+	Path() string
+}
+
+type ResourceGetter interface {
+	Get(req Request) Response
+}
+
+type ResourcePutter interface {
+	Put(req Request) Response
+}
+
+type ResourcePoster interface {
+	Post(req Request) Response
+}
+
+type ResourceDeleter interface {
+	Delete(req Request) Response
+}
+
+// ResourceObserver handles the GET requests with an Observe option, other GET
+// requests being handled by Get if the resource has it. Observable resources
+// are published with the obs attribute
+type ResourceObserver interface {
+	Observe(req Request) Response
+}
+
+type LinkedResource interface {
+	LinkAttributes() LinkAttributes
+}
+
+// LinkAttributes are the attributes of a resource published in
+// /.well-known/core, as defined by RFC 6690. The ct attribute is given by the
+// content formats of its routes
+type LinkAttributes struct {
+	// rt and if attributes, such as "oma.lwm2m" or "core.s"
+	ResourceTypes []string
+	Interfaces    []string
+
+	Title string
+
+	// sz attribute, the estimated size of the representation, not published
+	// if 0
+	Size int
+
+	// obs attribute
+	Observable bool
+}
+
+// merge adds the attributes of another route of the same path
+func (l LinkAttributes) merge(other LinkAttributes) LinkAttributes {
+	l.ResourceTypes = appendMissing(l.ResourceTypes, other.ResourceTypes...)
+	l.Interfaces = appendMissing(l.Interfaces, other.Interfaces...)
+	if l.Title == "" {
+		l.Title = other.Title
+	}
+	if other.Size > l.Size {
+		l.Size = other.Size
+	}
+	l.Observable = l.Observable || other.Observable
+
+	return l
+}
+
+// AddResource adds the routes of a resource, returning them
+func (s *DefaultCoapServer) AddResource(r Resource) []Route {
+	var routes []Route
+	for _, route := range resourceRoutes(r) {
+		s.addRoute(route)
+		routes = append(routes, route)
+	}
+
+	return routes
+}
+
+// AddResource adds the routes of a resource to the router, returning them
+func (r *Router) AddResource(res Resource) []Route {
+	var routes []Route
+	r.mu.Lock()
+	for _, route := range resourceRoutes(res) {
+		r.routes = append(r.routes, route)
+		routes = append(routes, route)
+	}
+	r.mu.Unlock()
+
+	return routes
+}
+
+func resourceRoutes(r Resource) []*RegExRoute {
+	var link LinkAttributes
+	if linked, ok := r.(LinkedResource); ok {
+		link = linked.LinkAttributes()
+	}
+
+	var routes []*RegExRoute
+	add := func(method string, fn RouteHandler) {
+		route := CreateNewRegExRoute(r.Path(), method, fn).(*RegExRoute)
+		route.Link = link
+		routes = append(routes, route)
+	}
+
+	getter, hasGet := r.(ResourceGetter)
+	observer, hasObserve := r.(ResourceObserver)
+	switch {
+	case hasObserve:
+		link.Observable = true
+		add(MethodGet, func(req Request) Response {
+			if !hasGet || req.GetMessage().GetOption(OptionObserve) != nil {
+				return observer.Observe(req)
+			}
+			return getter.Get(req)
+		})
+	case hasGet:
+		add(MethodGet, getter.Get)
+	}
+	if putter, ok := r.(ResourcePutter); ok {
+		add(MethodPut, putter.Put)
+	}
+	if poster, ok := r.(ResourcePoster); ok {
+		add(MethodPost, poster.Post)
+	}
+	if deleter, ok := r.(ResourceDeleter); ok {
+		add(MethodDelete, deleter.Delete)
+	}
+
+	return routes
+}
+
+// coreLink is a resource published in /.well-known/core, merging the routes
+// of its path
+type coreLink struct {
+	path       string
+	methods    []string
+	mediaTypes []MediaType
+	attrs      LinkAttributes
+}
+
+// coreLinks returns the links to the resources of the server, excluding
+// /.well-known/core
+func (s *DefaultCoapServer) coreLinks() []*coreLink {
+	var links []*coreLink
+	byPath := make(map[string]*coreLink)
+	for _, r := range s.GetRoutes() {
+		path := r.GetConfiguredPath()
+		if strings.TrimPrefix(path, "/") == ".well-known/core" {
+			continue
+		}
+
+		link := byPath[path]
+		if link == nil {
+			link = &coreLink{path: path}
+			byPath[path] = link
+			links = append(links, link)
+		}
+		link.methods = appendMissing(link.methods, r.GetMethod())
+		link.attrs = link.attrs.merge(r.GetLinkAttributes())
+
+		// the formats of the representations, or else of the requests
+		formats := r.GetProducedMediaTypes()
+		if len(formats) == 0 {
+			formats = r.GetMediaTypes()
+		}
+		for _, mt := range formats {
+			if !containsMediaType(link.mediaTypes, mt) {
+				link.mediaTypes = append(link.mediaTypes, mt)
+			}
+		}
+	}
+
+	return links
+}
+
+// coreLinkFormat returns the links to the resources of the server in the
+// CoRE Link Format, filtered with the query of a discovery request, e.g.
+// "rt=temperature" or "href=/sensors*"
+func (s *DefaultCoapServer) coreLinkFormat(query ...string) string {
+	var buf bytes.Buffer
+	for _, link := range s.coreLinks() {
+		if !link.matches(query) {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString(",")
+		}
+		link.write(&buf)
+	}
+
+	return buf.String()
+}
+
+func (l *coreLink) write(buf *bytes.Buffer) {
+	buf.WriteString("<")
+	buf.WriteString(joinRoutePath("", l.path))
+	buf.WriteString(">")
+
+	writeLinkParam(buf, "rt", strings.Join(l.attrs.ResourceTypes, " "), true)
+	writeLinkParam(buf, "if", strings.Join(l.attrs.Interfaces, " "), true)
+	formats := l.formats()
+	writeLinkParam(buf, "ct", strings.Join(formats, " "), len(formats) > 1)
+	writeLinkParam(buf, "title", l.attrs.Title, true)
+	if l.attrs.Size > 0 {
+		writeLinkParam(buf, "sz", strconv.Itoa(l.attrs.Size), false)
+	}
+	if l.attrs.Observable {
+		buf.WriteString(";obs")
+	}
+	writeLinkParam(buf, "methods", strings.Join(l.methods, " "), true)
+}
+
+func (l *coreLink) formats() []string {
+	var formats []string
+	for _, mt := range l.mediaTypes {
+		formats = append(formats, strconv.Itoa(int(mt)))
+	}
+	return formats
+}
+
+func writeLinkParam(buf *bytes.Buffer, name, value string, quoted bool) {
+	if value == "" {
+		return
+	}
+
+	buf.WriteString(";")
+	buf.WriteString(name)
+	buf.WriteString("=")
+	if quoted {
+		buf.WriteString(strconv.Quote(value))
+	} else {
+		buf.WriteString(value)
+	}
+}
+
+// matches checks if a link matches the queries of a discovery request, as
+// described in RFC 6690, section 4.1. A value ending with * matches values
+// starting with it
+func (l *coreLink) matches(query []string) bool {
+	for _, q := range query {
+		kv := strings.SplitN(q, "=", 2)
+		if kv[0] == "obs" {
+			if !l.attrs.Observable {
+				return false
+			}
+			continue
+		}
+		if len(kv) != 2 {
+			continue
+		}
+
+		var values []string
+		switch kv[0] {
+		case "href":
+			values = []string{joinRoutePath("", l.path)}
+		case "rt":
+			values = l.attrs.ResourceTypes
+		case "if":
+			values = l.attrs.Interfaces
+		case "ct":
+			values = l.formats()
+		case "title":
+			values = []string{l.attrs.Title}
+		default:
+			continue
+		}
+
+		if !matchesLinkValue(values, kv[1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchesLinkValue(values []string, pattern string) bool {
+	prefix := strings.HasSuffix(pattern, "*")
+	pattern = strings.TrimSuffix(pattern, "*")
+
+	for _, v := range values {
+		if v == pattern || (prefix && strings.HasPrefix(v, pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendMissing(values []string, add ...string) []string {
+	for _, v := range add {
+		if !containsString(values, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,99 @@
+package canopus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// temperature is an observable LwM2M temperature sensor value
+type temperature struct {
+	value string
+}
+
+func (r *temperature) Path() string {
+	return "/3303/0/5700"
+}
+
+func (r *temperature) Get(req Request) Response {
+	return textHandler(r.value)(req)
+}
+
+func (r *temperature) Put(req Request) Response {
+	r.value = req.GetMessage().GetPayload().String()
+	return NewResponseWithMessage(ChangedMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+}
+
+func (r *temperature) Observe(req Request) Response {
+	return textHandler("observed " + r.value)(req)
+}
+
+func (r *temperature) LinkAttributes() LinkAttributes {
+	return LinkAttributes{
+		ResourceTypes: []string{"oma.lwm2m", "ucum.Cel"},
+		Interfaces:    []string{"core.s"},
+		Title:         `Sensor "Value"`,
+		Size:          8,
+	}
+}
+
+func TestServerAddResource(t *testing.T) {
+	s := NewServer()
+	res := &temperature{value: "21"}
+	routes := s.AddResource(res)
+	assert.Equal(t, 2, len(routes))
+	routes[0].Produces(MediaTypeTextPlain, MediaTypeApplicationJSON)
+	s.Get("/status", textHandler("ok"))
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	resp := sendRequest(t, s, session, peer, Get, "/3303/0/5700")
+	assert.Equal(t, "21", resp.GetPayload().String())
+
+	req := NewRequestWithMessageId(MessageConfirmable, Put, GenerateMessageID())
+	req.SetRequestURI("/3303/0/5700")
+	req.SetStringPayload("22")
+	b, err := MessageToBytes(req.GetMessage())
+	assert.Nil(t, err)
+	msg, err := BytesToMessage(b)
+	assert.Nil(t, err)
+	s.(*DefaultCoapServer).handleRequest(msg, session)
+	assert.Equal(t, CoapCodeChanged, readMessage(t, peer).GetCode())
+
+	resp = sendRequest(t, s, session, peer, Get, "/3303/0/5700", withToken("tok"), withObserve(observeRegister))
+	assert.Equal(t, "observed 22", resp.GetPayload().String())
+
+	// resources aren't deleted without a Delete method
+	req = NewRequestWithMessageId(MessageConfirmable, Delete, GenerateMessageID())
+	req.SetRequestURI("/3303/0/5700")
+	b, _ = MessageToBytes(req.GetMessage())
+	msg, _ = BytesToMessage(b)
+	s.(*DefaultCoapServer).handleRequest(msg, session)
+	assert.Equal(t, CoapCodeMethodNotAllowed, readMessage(t, peer).GetCode())
+
+	s.(*DefaultCoapServer).addDiscoveryRoute()
+	resp = sendRequest(t, s, session, peer, Get, "/.well-known/core")
+	assert.Equal(t, `</3303/0/5700>;rt="oma.lwm2m ucum.Cel";if="core.s";ct="0 50";title="Sensor \"Value\"";sz=8;obs;methods="GET PUT",</status>;methods="GET"`, resp.GetPayload().String())
+
+	// published links are parsed back
+	resources := CoreResourcesFromString(resp.GetPayload().String())
+	if assert.Equal(t, 2, len(resources)) {
+		assert.Equal(t, "/3303/0/5700", resources[0].Target)
+		assert.NotNil(t, resources[0].GetAttribute("obs"))
+		assert.Equal(t, "core.s", resources[0].GetAttribute("if").Value)
+	}
+}
+
+func TestCoreLinkFormatQuery(t *testing.T) {
+	s := NewServer()
+	s.AddResource(&temperature{})
+	s.Get("/status", textHandler("ok")).Describe(LinkAttributes{ResourceTypes: []string{"core.rd-status"}})
+
+	server := s.(*DefaultCoapServer)
+	assert.Equal(t, `</status>;rt="core.rd-status";methods="GET"`, server.coreLinkFormat("rt=core.rd*"))
+	assert.Equal(t, `</3303/0/5700>;rt="oma.lwm2m ucum.Cel";if="core.s";title="Sensor \"Value\"";sz=8;obs;methods="GET PUT"`, server.coreLinkFormat("obs"))
+	assert.Equal(t, `</3303/0/5700>;rt="oma.lwm2m ucum.Cel";if="core.s";title="Sensor \"Value\"";sz=8;obs;methods="GET PUT"`, server.coreLinkFormat("href=/3303/*", "if=core.s"))
+	assert.Equal(t, "", server.coreLinkFormat("rt=temperature"))
+}
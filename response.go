@@ -1,6 +1,7 @@
 package canopus
 
 import (
+	"io"
 	"strings"
 )
 
@@ -46,6 +47,29 @@ func NewResponseWithMessage(msg Message) Response {
 	return resp
 }
 
+// NewStreamResponse creates a response whose payload is read from body, and
+// sent in Block2 blocks when it doesn't fit in a single one. The stream is
+// kept while clients fetch its blocks, and closed afterwards if it is an
+// io.Closer
+func NewStreamResponse(msg Message, body io.ReadSeeker) Response {
+	return &StreamResponse{
+		DefaultResponse: DefaultResponse{
+			msg: msg,
+		},
+		body: body,
+	}
+}
+
+// StreamResponse is a response with a payload read from a stream
+type StreamResponse struct {
+	DefaultResponse
+	body io.ReadSeeker
+}
+
+func (c *StreamResponse) Body() io.ReadSeeker {
+	return c.body
+}
+
 type DefaultResponse struct {
 	msg Message
 	err error
@@ -0,0 +1,224 @@
+package canopus
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var ErrRouterCycle = errors.New("Router mounted within itself")
+var ErrRouteConflict = errors.New("Route already added to the server")
+
+// NewRouter creates a router grouping routes, to be mounted under a path
+// prefix on a server
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Router is a group of routes sharing middleware, which may contain other
+// groups. Its routes are added to a server with the server's Mount
+type Router struct {
+	mu         sync.Mutex
+	routes     []*RegExRoute
+	middleware []Middleware
+	mounts     []mountedRouter
+}
+
+type mountedRouter struct {
+	prefix string
+	router *Router
+}
+
+func (r *Router) Get(path string, fn RouteHandler) Route {
+	return r.add(MethodGet, path, fn)
+}
+
+func (r *Router) Delete(path string, fn RouteHandler) Route {
+	return r.add(MethodDelete, path, fn)
+}
+
+func (r *Router) Put(path string, fn RouteHandler) Route {
+	return r.add(MethodPut, path, fn)
+}
+
+func (r *Router) Post(path string, fn RouteHandler) Route {
+	return r.add(MethodPost, path, fn)
+}
+
+// Options adds an OPTIONS route. CoAP has no OPTIONS method code, such routes
+// are only reached through MatchingRoute
+func (r *Router) Options(path string, fn RouteHandler) Route {
+	return r.add(MethodOptions, path, fn)
+}
+
+func (r *Router) Patch(path string, fn RouteHandler) Route {
+	return r.add(MethodPatch, path, fn)
+}
+
+func (r *Router) NewRoute(path string, method CoapCode, fn RouteHandler) Route {
+	return r.add(MethodString(method), path, fn)
+}
+
+// HandleStream adds a route whose handler reads the body of Block1 uploads
+// as they are received, see DefaultCoapServer.HandleStream
+func (r *Router) HandleStream(path string, method CoapCode, fn RouteHandler) Route {
+	route := r.add(MethodString(method), path, fn)
+	route.(*RegExRoute).StreamBody = true
+
+	return route
+}
+
+func (r *Router) add(method, path string, fn RouteHandler) Route {
+	route := CreateNewRegExRoute(path, method, fn).(*RegExRoute)
+	r.mu.Lock()
+	r.routes = append(r.routes, route)
+	r.mu.Unlock()
+
+	return route
+}
+
+// Use adds middleware run around the handlers of the router's routes,
+// including those of its groups, inside the server's middleware
+func (r *Router) Use(mw ...Middleware) {
+	r.mu.Lock()
+	r.middleware = append(r.middleware, mw...)
+	r.mu.Unlock()
+}
+
+// Group creates a router whose routes are under a path prefix of this one
+func (r *Router) Group(prefix string) *Router {
+	group := NewRouter()
+	r.Mount(prefix, group)
+
+	return group
+}
+
+// Mount adds the routes of another router under a path prefix of this one.
+// Mounting a router again under the same prefix has no effect, and mounting
+// a router within itself fails with ErrRouterCycle
+func (r *Router) Mount(prefix string, router *Router) error {
+	if router.contains(r) {
+		return ErrRouterCycle
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := mountedRouter{prefix, router}
+	for _, mounted := range r.mounts {
+		if mounted == m {
+			return nil
+		}
+	}
+	r.mounts = append(r.mounts, m)
+
+	return nil
+}
+
+// contains tells whether a router is this one or one of its groups
+func (r *Router) contains(router *Router) bool {
+	if r == router {
+		return true
+	}
+
+	r.mu.Lock()
+	mounts := append([]mountedRouter{}, r.mounts...)
+	r.mu.Unlock()
+
+	for _, m := range mounts {
+		if m.router.contains(router) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Routes returns the routes of the router and its groups, with their full
+// path within the router. Each route runs the middleware of the routers it is
+// in before its own
+func (r *Router) Routes() []Route {
+	var routes []Route
+	for _, route := range r.resolve("", nil) {
+		routes = append(routes, route)
+	}
+
+	return routes
+}
+
+// resolve returns copies of the routes under a prefix, with the middleware of
+// the enclosing routers
+func (r *Router) resolve(prefix string, outer []Middleware) []*RegExRoute {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mw := append(append([]Middleware{}, outer...), r.middleware...)
+
+	var routes []*RegExRoute
+	for _, route := range r.routes {
+		resolved := CreateNewRegExRoute(joinRoutePath(prefix, route.Path), route.Method, route.Handler).(*RegExRoute)
+		resolved.AutoAck = route.AutoAck
+		resolved.StreamBody = route.StreamBody
+		resolved.MediaTypes = route.MediaTypes
+		resolved.Produced = route.Produced
+		resolved.Link = route.Link
+		resolved.Middleware = append(append([]Middleware{}, mw...), route.Middleware...)
+		routes = append(routes, resolved)
+	}
+	for _, m := range r.mounts {
+		routes = append(routes, m.router.resolve(joinRoutePath(prefix, m.prefix), mw)...)
+	}
+
+	return routes
+}
+
+// Mount adds the routes of a router, and of its groups, under a path prefix.
+// Routes added to the router afterwards aren't served unless it is mounted
+// again, which replaces the routes of the earlier mount. Mounting fails with
+// ErrRouteConflict, without adding any route, if a route with the same
+// method, path and content formats was added other than by this mount
+func (s *DefaultCoapServer) Mount(prefix string, router *Router) error {
+	m := mountedRouter{joinRoutePath("", prefix), router}
+	routes := router.resolve(m.prefix, nil)
+
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	previous := s.mounts[m]
+	for _, route := range routes {
+		key := routeKey(route)
+		if _, ok := previous[key]; !ok && s.routes.has(key) {
+			return ErrRouteConflict
+		}
+	}
+
+	mounted := make(map[string]Route)
+	for _, route := range routes {
+		key := routeKey(route)
+		if old, ok := previous[key]; ok {
+			s.routes.replace(old, route)
+		} else {
+			s.routes.Add(route)
+		}
+		mounted[key] = route
+	}
+	s.mounts[m] = mounted
+
+	return nil
+}
+
+// joinRoutePath joins a path prefix and a route path, e.g. "/sensors" and
+// "/temp" to "/sensors/temp"
+func joinRoutePath(prefix, path string) string {
+	prefix = strings.Trim(prefix, "/")
+	path = strings.TrimPrefix(path, "/")
+
+	switch {
+	case prefix == "":
+		return "/" + path
+	case path == "":
+		return "/" + prefix
+	default:
+		return "/" + prefix + "/" + path
+	}
+}
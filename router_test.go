@@ -0,0 +1,211 @@
+package canopus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinRoutePath(t *testing.T) {
+	assert.Equal(t, "/sensors/temp", joinRoutePath("/sensors", "/temp"))
+	assert.Equal(t, "/sensors/temp", joinRoutePath("sensors/", "temp"))
+	assert.Equal(t, "/sensors", joinRoutePath("/sensors", "/"))
+	assert.Equal(t, "/temp", joinRoutePath("", "/temp"))
+	assert.Equal(t, "/", joinRoutePath("/", "/"))
+}
+
+func TestServerMountRouter(t *testing.T) {
+	s := NewServer()
+
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next RouteHandler) RouteHandler {
+			return func(req Request) Response {
+				calls = append(calls, name)
+				return next(req)
+			}
+		}
+	}
+
+	devices := NewRouter()
+	devices.Use(trace("devices"))
+
+	sensors := devices.Group("/sensors")
+	sensors.Use(trace("sensors"))
+	sensors.Get("/:id", func(req Request) Response {
+		return textHandler("sensor " + req.GetAttribute("id"))(req)
+	})
+
+	actuators := NewRouter()
+	actuators.Post("/relay", textHandler("relay"))
+	assert.Nil(t, devices.Mount("/actuators", actuators))
+
+	assert.Nil(t, s.Mount("/devices", devices))
+	s.Get("/status", textHandler("ok"))
+
+	var paths []string
+	for _, route := range s.GetRoutes() {
+		paths = append(paths, route.GetMethod()+" "+route.GetConfiguredPath())
+	}
+	assert.Equal(t, []string{"GET /devices/sensors/:id", "POST /devices/actuators/relay", "GET /status"}, paths)
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	resp := sendRequest(t, s, session, peer, Get, "/devices/sensors/t1")
+	assert.Equal(t, "sensor t1", resp.GetPayload().String())
+	assert.Equal(t, []string{"devices", "sensors"}, calls)
+
+	// middleware of a group doesn't run outside of it
+	calls = nil
+	resp = sendRequest(t, s, session, peer, Get, "/status")
+	assert.Equal(t, "ok", resp.GetPayload().String())
+	assert.Empty(t, calls)
+
+	s.(*DefaultCoapServer).addDiscoveryRoute()
+	resp = sendRequest(t, s, session, peer, Get, "/.well-known/core")
+	assert.Equal(t, `</devices/sensors/:id>;methods="GET",</devices/actuators/relay>;methods="POST",</status>;methods="GET"`, resp.GetPayload().String())
+
+	// mounting again adds the new routes and replaces the others
+	actuators.Post("/valve", textHandler("valve"))
+	actuators.Use(trace("actuators"))
+	assert.Nil(t, devices.Mount("/actuators", actuators))
+	assert.Nil(t, s.Mount("/devices", devices))
+	assert.Equal(t, 5, len(s.GetRoutes()))
+
+	calls = nil
+	resp = sendRequest(t, s, session, peer, Post, "/devices/actuators/relay")
+	assert.Equal(t, "relay", resp.GetPayload().String())
+	assert.Equal(t, []string{"devices", "actuators"}, calls)
+	resp = sendRequest(t, s, session, peer, Post, "/devices/actuators/valve")
+	assert.Equal(t, "valve", resp.GetPayload().String())
+}
+
+func TestMountConflicts(t *testing.T) {
+	s := NewServer()
+	s.Get("/status", textHandler("ok"))
+
+	// routes added directly or by another mount aren't replaced
+	status := NewRouter()
+	status.Get("/status", textHandler("mounted"))
+	status.Get("/health", textHandler("healthy"))
+	assert.Equal(t, ErrRouteConflict, s.Mount("/", status))
+
+	health := NewRouter()
+	health.Get("/health", textHandler("healthy"))
+	assert.Nil(t, s.Mount("/", health))
+	assert.Nil(t, s.Mount("/", health))
+
+	other := NewRouter()
+	other.Get("/health", textHandler("other"))
+	assert.Equal(t, ErrRouteConflict, s.Mount("/", other))
+
+	var paths []string
+	for _, route := range s.GetRoutes() {
+		paths = append(paths, route.GetConfiguredPath())
+	}
+	assert.Equal(t, []string{"/status", "/health"}, paths)
+
+	// a router can't be mounted within itself
+	devices := NewRouter()
+	sensors := devices.Group("/sensors")
+	assert.Equal(t, ErrRouterCycle, devices.Mount("/devices", devices))
+	assert.Equal(t, ErrRouterCycle, sensors.Mount("/devices", devices))
+	assert.Nil(t, s.Mount("/devices", devices))
+}
+
+func TestServerMethodNotAllowed(t *testing.T) {
+	s := NewServer()
+	s.Get("/lamp", textHandler("on"))
+	s.NewRoute("/lamp", Patch, textHandler("patched"))
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	request := func(method CoapCode, path string) Message {
+		req := NewRequestWithMessageId(MessageConfirmable, method, GenerateMessageID())
+		req.SetRequestURI(path)
+		req.GetMessage().SetToken([]byte("tok"))
+
+		b, err := MessageToBytes(req.GetMessage())
+		assert.Nil(t, err)
+		msg, err := BytesToMessage(b)
+		assert.Nil(t, err)
+		s.(*DefaultCoapServer).handleRequest(msg, session)
+
+		return readMessage(t, peer)
+	}
+
+	resp := request(Patch, "/lamp")
+	assert.Equal(t, CoapCodeContent, resp.GetCode())
+	assert.Equal(t, "patched", resp.GetPayload().String())
+
+	resp = request(Delete, "/lamp")
+	assert.Equal(t, CoapCodeMethodNotAllowed, resp.GetCode())
+	assert.Equal(t, []byte("tok"), resp.GetToken())
+
+	resp = request(Post, "/door")
+	assert.Equal(t, CoapCodeNotFound, resp.GetCode())
+
+	// unknown method codes
+	resp = request(CoapCode(31), "/lamp")
+	assert.Equal(t, CoapCodeMethodNotAllowed, resp.GetCode())
+
+	// an empty Confirmable message is a ping, answered with a Reset
+	ping := NewMessageOfType(MessageConfirmable, GenerateMessageID(), nil)
+	s.(*DefaultCoapServer).handleRequest(ping, session)
+	resp = readMessage(t, peer)
+	assert.Equal(t, uint8(MessageReset), resp.GetMessageType())
+	assert.Equal(t, CoapCodeEmpty, resp.GetCode())
+	assert.Equal(t, ping.GetMessageId(), resp.GetMessageId())
+
+	s.(*DefaultCoapServer).addDiscoveryRoute()
+	resp = request(Get, "/.well-known/core")
+	assert.Equal(t, `</lamp>;methods="GET PATCH"`, resp.GetPayload().String())
+}
+
+func TestServerContentNegotiation(t *testing.T) {
+	s := NewServer()
+	s.Get("/reading", textHandler(`{"v":21}`)).Produces(MediaTypeApplicationJSON)
+	s.Get("/reading", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.SetPayload(NewBytesPayload([]byte{0xa1, 0x61, 0x76, 0x15}))
+		return NewResponseWithMessage(msg)
+	}).Produces(MediaTypeApplicationCbor)
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	request := func(accept ...MediaType) Message {
+		req := NewRequestWithMessageId(MessageConfirmable, Get, GenerateMessageID())
+		req.SetRequestURI("/reading")
+		req.GetMessage().SetToken([]byte("tok"))
+		for _, mt := range accept {
+			req.GetMessage().AddOption(OptionAccept, mt)
+		}
+
+		b, err := MessageToBytes(req.GetMessage())
+		assert.Nil(t, err)
+		msg, err := BytesToMessage(b)
+		assert.Nil(t, err)
+		s.(*DefaultCoapServer).handleRequest(msg, session)
+
+		return readMessage(t, peer)
+	}
+
+	// the Content-Format is set from the route
+	resp := request()
+	assert.Equal(t, `{"v":21}`, resp.GetPayload().String())
+	assert.Equal(t, uint32(MediaTypeApplicationJSON), uintOptionValue(resp.GetOption(OptionContentFormat)))
+
+	resp = request(MediaTypeApplicationCbor)
+	assert.Equal(t, []byte{0xa1, 0x61, 0x76, 0x15}, resp.GetPayload().GetBytes())
+	assert.Equal(t, uint32(MediaTypeApplicationCbor), uintOptionValue(resp.GetOption(OptionContentFormat)))
+
+	resp = request(MediaTypeApplicationXML)
+	assert.Equal(t, CoapCodeNotAcceptable, resp.GetCode())
+	assert.Equal(t, []byte("tok"), resp.GetToken())
+}
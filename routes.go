@@ -45,7 +45,16 @@ type RegExRoute struct {
 	Handler    RouteHandler
 	RegEx      *regexp.Regexp
 	AutoAck    bool
+	StreamBody bool
+
+	// MediaTypes are the content formats the route consumes, and Produced
+	// those it responds with. Any format is accepted if empty
 	MediaTypes []MediaType
+	Produced   []MediaType
+	Middleware []Middleware
+
+	// attributes published in /.well-known/core
+	Link LinkAttributes
 }
 
 func (r *RegExRoute) Matches(path string) (bool, map[string]string) {
@@ -70,6 +79,37 @@ func (r *RegExRoute) GetMediaTypes() []MediaType {
 	return r.MediaTypes
 }
 
+func (r *RegExRoute) GetProducedMediaTypes() []MediaType {
+	return r.Produced
+}
+
+// Consumes sets the content formats of the requests handled by the route.
+// Other formats are refused with 4.15 Unsupported Content-Format, unless
+// another route of the same path and method consumes them
+func (r *RegExRoute) Consumes(mt ...MediaType) Route {
+	r.MediaTypes = append(r.MediaTypes, mt...)
+	return r
+}
+
+// Produces sets the content formats the route responds with. The route is
+// chosen for requests whose Accept option asks for one of them, and the
+// Content-Format of its responses set if the handler doesn't
+func (r *RegExRoute) Produces(mt ...MediaType) Route {
+	r.Produced = append(r.Produced, mt...)
+	return r
+}
+
+func (r *RegExRoute) GetLinkAttributes() LinkAttributes {
+	return r.Link
+}
+
+// Describe sets the link attributes the route's path is published with in
+// /.well-known/core
+func (r *RegExRoute) Describe(link LinkAttributes) Route {
+	r.Link = link
+	return r
+}
+
 func (r *RegExRoute) GetConfiguredPath() string {
 	return r.Path
 }
@@ -78,37 +118,151 @@ func (r *RegExRoute) AutoAcknowledge() bool {
 	return r.AutoAck
 }
 
+// StreamsBody checks if the handler reads the body of Block1 uploads as
+// they are received, rather than once they are complete
+func (r *RegExRoute) StreamsBody() bool {
+	return r.StreamBody
+}
+
+// Use adds middleware run around the route's handler, inside the server's
+// middleware
+func (r *RegExRoute) Use(mw ...Middleware) Route {
+	r.Middleware = append(r.Middleware, mw...)
+	return r
+}
+
 func (r *RegExRoute) Handle(req Request) Response {
-	return r.Handler(req)
+	return chainMiddleware(r.Handler, r.Middleware)(req)
 }
 
-// MatchingRoute checks if a given path matches any defined routes/resources
+// MatchingRoute checks if a given path matches any defined routes/resources.
+// It returns ErrNoMatchingMethod if routes match the path but none of them
+// the method, and ErrNoMatchingRoute if no route matches the path. The
+// content format, cf, is given as a MediaType or as Content-Format options
 func MatchingRoute(path string, method string, cf interface{}, routes []Route) (Route, map[string]string, error) {
+	return matchRoute(path, method, cf, nil, routes)
+}
+
+// MatchingRequestRoute returns the route handling a request, chosen among the
+// routes of its path and method by the content format they consume and, with
+// the Accept option, the one they produce. It returns ErrNotAcceptable if none
+// of these routes produces the format asked for
+func MatchingRequestRoute(msg Message, routes []Route) (Route, map[string]string, error) {
+	return matchRoute(msg.GetURIPath(), MethodString(msg.GetCode()), msg.GetOption(OptionContentFormat), msg.GetOption(OptionAccept), routes)
+}
+
+func matchRoute(path, method string, cf, accept interface{}, routes []Route) (Route, map[string]string, error) {
+	var matched []Route
+	var matchedAttrs []map[string]string
 	for _, route := range routes {
-		if method == route.GetMethod() {
-			match, attrs := route.Matches(path)
-
-			if match {
-				if len(route.GetMediaTypes()) > 0 {
-					if cf == nil {
-						return route, attrs, ErrUnsupportedContentFormat
-					}
-
-					foundMediaType := false
-					for _, o := range route.GetMediaTypes() {
-						if uint32(o) == cf {
-							foundMediaType = true
-							break
-						}
-					}
-
-					if !foundMediaType {
-						return route, attrs, ErrUnsupportedContentFormat
-					}
-				}
-				return route, attrs, nil
+		if match, attrs := route.Matches(path); match {
+			matched = append(matched, route)
+			matchedAttrs = append(matchedAttrs, attrs)
+		}
+	}
+
+	i, err := negotiateRoute(matched, method, cf, accept)
+	if i < 0 {
+		return nil, nil, err
+	}
+	return matched[i], matchedAttrs[i], err
+}
+
+// negotiateRoute picks, among the routes matching a path, the first one with
+// the method which consumes the content format cf and produces the one asked
+// for with accept. If none does, it returns the error to answer with and the
+// index of the route refused, or -1 if no route has the method
+func negotiateRoute(routes []Route, method string, cf, accept interface{}) (int, error) {
+	format, hasFormat := mediaTypeValue(cf)
+	accepted, hasAccept := mediaTypeValue(accept)
+
+	rejected := -1
+	var err error
+	for i, route := range routes {
+		if method != route.GetMethod() {
+			continue
+		}
+
+		if len(route.GetMediaTypes()) > 0 && (!hasFormat || !containsMediaType(route.GetMediaTypes(), format)) {
+			if err == nil {
+				rejected, err = i, ErrUnsupportedContentFormat
 			}
+			continue
+		}
+
+		if hasAccept && len(route.GetProducedMediaTypes()) > 0 && !containsMediaType(route.GetProducedMediaTypes(), accepted) {
+			rejected, err = i, ErrNotAcceptable
+			continue
+		}
+		return i, nil
+	}
+
+	if err != nil {
+		return rejected, err
+	}
+	if len(routes) > 0 {
+		return -1, ErrNoMatchingMethod
+	}
+	return -1, ErrNoMatchingRoute
+}
+
+// mediaTypeValue returns the content format of a Content-Format or Accept
+// option, or of a MediaType
+func mediaTypeValue(v interface{}) (MediaType, bool) {
+	switch v := v.(type) {
+	case MediaType:
+		return v, true
+	case Option:
+		if v != nil {
+			return MediaType(uintOptionValue(v)), true
+		}
+	case []Option:
+		if len(v) > 0 && v[0] != nil {
+			return MediaType(uintOptionValue(v[0])), true
+		}
+	}
+	return 0, false
+}
+
+// contentFormat returns the format a route responds with to a request, the
+// one asked for with the Accept option or else the first one it produces
+func contentFormat(route Route, req Message) (MediaType, bool) {
+	produced := route.GetProducedMediaTypes()
+	if len(produced) == 0 {
+		return 0, false
+	}
+	if accepted, ok := mediaTypeValue(req.GetOption(OptionAccept)); ok && containsMediaType(produced, accepted) {
+		return accepted, true
+	}
+	return produced[0], true
+}
+
+// AllowedMethods returns the methods of the routes matching a path, in the
+// order the routes were added
+func AllowedMethods(path string, routes []Route) []string {
+	var methods []string
+	for _, route := range routes {
+		if match, _ := route.Matches(path); match && !containsString(methods, route.GetMethod()) {
+			methods = append(methods, route.GetMethod())
+		}
+	}
+	return methods
+}
+
+func containsString(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMediaType(mediaTypes []MediaType, mt MediaType) bool {
+	for _, m := range mediaTypes {
+		if m == mt {
+			return true
 		}
 	}
-	return nil, nil, ErrNoMatchingRoute
+	return false
 }
@@ -44,3 +44,64 @@ func TestRoutes(t *testing.T) {
 	matches, _ = route.Matches("/test.abc/abc/def")
 	assert.False(t, matches)
 }
+
+func TestMatchingRouteMethods(t *testing.T) {
+	routes := []Route{
+		CreateNewRegExRoute("/lamp", MethodGet, nil),
+		CreateNewRegExRoute("/lamp", MethodPut, nil),
+		CreateNewRegExRoute("/lamp/:id", MethodPatch, nil),
+	}
+
+	route, _, err := MatchingRoute("/lamp", MethodPut, nil, routes)
+	assert.Nil(t, err)
+	assert.Equal(t, routes[1], route)
+
+	_, _, err = MatchingRoute("/lamp", MethodDelete, nil, routes)
+	assert.Equal(t, ErrNoMatchingMethod, err)
+
+	_, _, err = MatchingRoute("/door", MethodGet, nil, routes)
+	assert.Equal(t, ErrNoMatchingRoute, err)
+
+	assert.Equal(t, []string{MethodGet, MethodPut}, AllowedMethods("/lamp", routes))
+	assert.Equal(t, []string{MethodPatch}, AllowedMethods("/lamp/1", routes))
+	assert.Empty(t, AllowedMethods("/door", routes))
+}
+
+func TestMatchingRequestRoute(t *testing.T) {
+	json := CreateNewRegExRoute("/reading", MethodGet, nil).Produces(MediaTypeApplicationJSON)
+	cbor := CreateNewRegExRoute("/reading", MethodGet, nil).Produces(MediaTypeApplicationCbor)
+	upload := CreateNewRegExRoute("/reading", MethodPut, nil).Consumes(MediaTypeApplicationJSON)
+	routes := []Route{json, cbor, upload}
+
+	request := func(method CoapCode, opts ...Option) Message {
+		req := NewRequestWithMessageId(MessageConfirmable, method, GenerateMessageID())
+		req.SetRequestURI("/reading")
+		req.GetMessage().AddOptions(opts)
+		return req.GetMessage()
+	}
+
+	route, _, err := MatchingRequestRoute(request(Get), routes)
+	assert.Nil(t, err)
+	assert.Equal(t, json, route)
+
+	route, _, err = MatchingRequestRoute(request(Get, NewOption(OptionAccept, MediaTypeApplicationCbor)), routes)
+	assert.Nil(t, err)
+	assert.Equal(t, cbor, route)
+
+	_, _, err = MatchingRequestRoute(request(Get, NewOption(OptionAccept, MediaTypeApplicationXML)), routes)
+	assert.Equal(t, ErrNotAcceptable, err)
+
+	route, _, err = MatchingRequestRoute(request(Put, NewOption(OptionContentFormat, MediaTypeApplicationJSON)), routes)
+	assert.Nil(t, err)
+	assert.Equal(t, upload, route)
+
+	_, _, err = MatchingRequestRoute(request(Put, NewOption(OptionContentFormat, MediaTypeTextPlain)), routes)
+	assert.Equal(t, ErrUnsupportedContentFormat, err)
+
+	_, _, err = MatchingRequestRoute(request(Put), routes)
+	assert.Equal(t, ErrUnsupportedContentFormat, err)
+
+	// MatchingRoute also takes Content-Format options
+	_, _, err = MatchingRoute("/reading", MethodPut, []Option{NewOption(OptionContentFormat, MediaTypeApplicationJSON)}, routes)
+	assert.Nil(t, err)
+}
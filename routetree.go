@@ -0,0 +1,310 @@
+package canopus
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NewRouteTree creates a tree indexing routes by the segments of their path
+func NewRouteTree() *RouteTree {
+	return &RouteTree{
+		root: &routeNode{},
+		keys: make(map[string][]*treeEntry),
+	}
+}
+
+// RouteTree matches paths one segment at a time against the routes added to
+// it, instead of running the regular expression of each route. It follows
+// the syntax of CreateNewRegExRoute, :param matching a segment and :param*
+// the rest of the path. Routes whose path mixes text and parameters within a
+// segment, and routes which aren't RegExRoute, are matched with their
+// Matches method. A RouteTree isn't safe for concurrent use while routes are
+// added
+type RouteTree struct {
+	root     *routeNode
+	routes   []Route
+	fallback []*treeEntry
+
+	// entries by route key, see routeKey
+	keys map[string][]*treeEntry
+}
+
+type routeNode struct {
+	static map[string]*routeNode
+	param  *routeNode
+
+	// routes whose path ends at this node, and those ending with a :param*
+	// after it
+	routes   []*treeEntry
+	wildcard []*treeEntry
+}
+
+type treeEntry struct {
+	index int
+	route Route
+
+	// routes not indexed by the tree are matched with their Matches method
+	indexed bool
+
+	// text of each segment and parameter name, empty for text segments, and
+	// name of the trailing :param*
+	segments []string
+	params   []string
+	wildcard string
+}
+
+// maximum number of routes matching a path, such as variants of a route
+// with different methods or content formats, found without allocating
+const treeMatchBuffer = 16
+
+// Add adds a route, which is matched after those already added
+func (t *RouteTree) Add(route Route) {
+	entry := &treeEntry{
+		index: len(t.routes),
+		route: route,
+	}
+	t.routes = append(t.routes, route)
+	key := routeKey(route)
+	t.keys[key] = append(t.keys[key], entry)
+
+	regex, ok := route.(*RegExRoute)
+	if !ok || !entry.parse(regex.Path) {
+		t.fallback = append(t.fallback, entry)
+		return
+	}
+	entry.indexed = true
+
+	node := t.root
+	for i, segment := range entry.segments {
+		node = node.child(segment, entry.params[i])
+	}
+	if entry.wildcard != "" {
+		node.wildcard = append(node.wildcard, entry)
+	} else {
+		node.routes = append(node.routes, entry)
+	}
+}
+
+// routeKey identifies a route by its method, path and content formats
+func routeKey(route Route) string {
+	return fmt.Sprintf("%s %s %v %v", route.GetMethod(), route.GetConfiguredPath(), route.GetMediaTypes(), route.GetProducedMediaTypes())
+}
+
+// has tells whether a route with the given key was added
+func (t *RouteTree) has(key string) bool {
+	return len(t.keys[key]) > 0
+}
+
+// replace replaces a route added before with one having the same key, which
+// keeps its place in the matching order
+func (t *RouteTree) replace(old, route Route) {
+	for _, entry := range t.keys[routeKey(old)] {
+		if entry.route == old {
+			entry.route = route
+			t.routes[entry.index] = route
+			return
+		}
+	}
+
+	t.Add(route)
+}
+
+// Routes returns a copy of the routes, in the order they were added
+func (t *RouteTree) Routes() []Route {
+	routes := make([]Route, len(t.routes))
+	copy(routes, t.routes)
+
+	return routes
+}
+
+// Match returns the route for a path, as MatchingRoute does
+func (t *RouteTree) Match(path, method string, cf interface{}) (Route, map[string]string, error) {
+	return t.match(path, method, cf, nil)
+}
+
+// MatchRequest returns the route handling a request, as MatchingRequestRoute
+// does
+func (t *RouteTree) MatchRequest(msg Message) (Route, map[string]string, error) {
+	return t.match(msg.GetURIPath(), MethodString(msg.GetCode()), msg.GetOption(OptionContentFormat), msg.GetOption(OptionAccept))
+}
+
+func (t *RouteTree) match(path, method string, cf, accept interface{}) (Route, map[string]string, error) {
+	var buf [treeMatchBuffer]*treeEntry
+	entries := t.lookup(path, buf[:0])
+
+	var candidates [treeMatchBuffer]Route
+	routes := candidates[:0]
+	for _, entry := range entries {
+		routes = append(routes, entry.route)
+	}
+
+	i, err := negotiateRoute(routes, method, cf, accept)
+	if i < 0 {
+		return nil, nil, err
+	}
+
+	return routes[i], entries[i].attributes(path), err
+}
+
+// lookup returns the entries whose route matches a path, in the order the
+// routes were added
+func (t *RouteTree) lookup(path string, entries []*treeEntry) []*treeEntry {
+	switch {
+	case path == "/":
+		entries = t.root.collect(path, -1, entries)
+	case strings.HasPrefix(path, "/"):
+		entries = t.root.collect(path, 1, entries)
+	}
+
+	for _, entry := range t.fallback {
+		if match, _ := entry.route.Matches(path); match {
+			entries = append(entries, entry)
+		}
+	}
+
+	// entries are mostly few and nearly sorted
+	for i := 1; i < len(entries); i++ {
+		for j := i; j > 0 && entries[j].index < entries[j-1].index; j-- {
+			entries[j], entries[j-1] = entries[j-1], entries[j]
+		}
+	}
+
+	return entries
+}
+
+// collect adds the entries matching the path from start, the index of a
+// segment, or -1 once all segments are matched
+func (n *routeNode) collect(path string, start int, entries []*treeEntry) []*treeEntry {
+	if start < 0 {
+		return append(entries, n.routes...)
+	}
+	if start < len(path) {
+		entries = append(entries, n.wildcard...)
+	}
+
+	end := strings.IndexByte(path[start:], '/')
+	next := -1
+	if end < 0 {
+		end = len(path)
+	} else {
+		end += start
+		next = end + 1
+	}
+	segment := path[start:end]
+
+	if child := n.static[segment]; child != nil {
+		entries = child.collect(path, next, entries)
+	}
+	if n.param != nil && segment != "" && !strings.ContainsAny(segment, "#?") {
+		entries = n.param.collect(path, next, entries)
+	}
+
+	return entries
+}
+
+func (n *routeNode) child(segment, param string) *routeNode {
+	if param != "" {
+		if n.param == nil {
+			n.param = &routeNode{}
+		}
+		return n.param
+	}
+
+	if n.static == nil {
+		n.static = make(map[string]*routeNode)
+	}
+	child := n.static[segment]
+	if child == nil {
+		child = &routeNode{}
+		n.static[segment] = child
+	}
+	return child
+}
+
+// parse reads the parameters of a path. It returns false if the path can't
+// be matched segment by segment
+func (e *treeEntry) parse(path string) bool {
+	if !strings.HasPrefix(path, "/") {
+		return false
+	}
+	if path == "/" {
+		return true
+	}
+
+	segments := strings.Split(path[1:], "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") {
+			if segment == "" || strings.ContainsAny(segment, `:\^$|?*+()[]{}`) {
+				return false
+			}
+			e.segments = append(e.segments, segment)
+			e.params = append(e.params, "")
+			continue
+		}
+
+		name := segment[1:]
+		if strings.HasSuffix(name, "*") {
+			if i != len(segments)-1 {
+				return false
+			}
+			name = name[:len(name)-1]
+			if !validParamName(name) {
+				return false
+			}
+			e.wildcard = name
+			continue
+		}
+		if !validParamName(name) {
+			return false
+		}
+		e.segments = append(e.segments, segment)
+		e.params = append(e.params, name)
+	}
+
+	return true
+}
+
+func validParamName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/#?()\.*:`)
+}
+
+// attributes returns the parameters of the route in a path matching it, or
+// nil if it has none
+func (e *treeEntry) attributes(path string) map[string]string {
+	if !e.indexed {
+		_, attrs := e.route.Matches(path)
+		return attrs
+	}
+	if e.wildcard == "" && !e.hasParams() {
+		return nil
+	}
+
+	attrs := map[string]string{"": path}
+	start := 1
+	for _, param := range e.params {
+		end := strings.IndexByte(path[start:], '/')
+		if end < 0 {
+			end = len(path)
+		} else {
+			end += start
+		}
+		if param != "" {
+			attrs[param] = path[start:end]
+		}
+		start = end + 1
+	}
+	if e.wildcard != "" {
+		attrs[e.wildcard] = path[start:]
+	}
+
+	return attrs
+}
+
+func (e *treeEntry) hasParams() bool {
+	for _, param := range e.params {
+		if param != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package canopus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteTreeMatchesLikeRegEx(t *testing.T) {
+	var routes []Route
+	for _, path := range []string{
+		"/",
+		"/test",
+		"/test/:var",
+		"/test/:var/foo",
+		"/test/bar/foo",
+		"/test.abc/:var",
+		"/files/:path*",
+		"/files/readme",
+		"/file.:ext",
+		"/a/:rest*/z",
+		"relative",
+	} {
+		routes = append(routes, CreateNewRegExRoute(path, MethodGet, nil))
+	}
+	routes = append(routes, CreateNewRegExRoute("/test/:var", MethodPut, nil))
+
+	tree := NewRouteTree()
+	for _, route := range routes {
+		tree.Add(route)
+	}
+	assert.Equal(t, routes, tree.Routes())
+
+	for _, path := range []string{
+		"/", "/test", "/test/", "/test/abc", "/test/abc/foo", "/test/bar/foo",
+		"/test//foo", "/test/abc/def", "/test.abc/x", "/testxabc/x", "/files",
+		"/files/", "/files/a", "/files/a/b", "/files/readme", "/file.json",
+		"/a/b/c/z", "/a/z", "relative", "/relative", "/test/a?b",
+	} {
+		for _, method := range []string{MethodGet, MethodPut, MethodPost} {
+			route, attrs, err := MatchingRoute(path, method, nil, routes)
+			treeRoute, treeAttrs, treeErr := tree.Match(path, method, nil)
+
+			assert.Equal(t, err, treeErr, method+" "+path)
+			assert.True(t, route == treeRoute, method+" "+path)
+			for name, value := range treeAttrs {
+				assert.Equal(t, attrs[name], value, method+" "+path+" "+name)
+			}
+			for name, value := range attrs {
+				if name != "" {
+					assert.Equal(t, value, treeAttrs[name], method+" "+path+" "+name)
+				}
+			}
+		}
+	}
+}
+
+func TestRouteTreeAllocations(t *testing.T) {
+	tree := lwm2mRouteTree()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		tree.Match("/3303/0/5700", MethodGet, nil)
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+// lwm2mRoutes creates the routes of the resources of 100 LwM2M objects
+func lwm2mRoutes() []Route {
+	var routes []Route
+	for obj := 3200; obj < 3300; obj++ {
+		for res := 5700; res < 5710; res++ {
+			routes = append(routes, CreateNewRegExRoute(fmt.Sprintf("/%d/:inst/%d", obj, res), MethodGet, nil))
+		}
+	}
+	routes = append(routes, CreateNewRegExRoute("/3303/0/5700", MethodGet, nil))
+
+	return routes
+}
+
+func lwm2mRouteTree() *RouteTree {
+	tree := NewRouteTree()
+	for _, route := range lwm2mRoutes() {
+		tree.Add(route)
+	}
+	return tree
+}
+
+func BenchmarkRegExRouteMatch(b *testing.B) {
+	routes := lwm2mRoutes()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MatchingRoute("/3299/0/5709", MethodGet, nil, routes)
+	}
+}
+
+func BenchmarkRouteTreeMatch(b *testing.B) {
+	tree := lwm2mRouteTree()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Match("/3299/0/5709", MethodGet, nil)
+	}
+}
+
+func BenchmarkRouteTreeMatchStatic(b *testing.B) {
+	tree := lwm2mRouteTree()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Match("/3303/0/5700", MethodGet, nil)
+	}
+}
@@ -0,0 +1,70 @@
+package canopus
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrResponseAlreadySent = errors.New("Response has already been sent")
+var ErrSeparateResponseTimeout = errors.New("Separate response not received within the exchange lifetime")
+
+func newSeparateResponder(req Message, session Session) *SeparateResponder {
+	return &SeparateResponder{
+		req:     req,
+		session: session,
+	}
+}
+
+// SeparateResponder sends the response to a request which has already been
+// acknowledged with an empty ACK, as described in RFC 7252 section 5.2.2
+type SeparateResponder struct {
+	mu      sync.Mutex
+	req     Message
+	session Session
+	sent    bool
+}
+
+// Respond sends the response as a new exchange carrying the request's token.
+// The response is Confirmable if the request was, and is retransmitted until
+// the client acknowledges it
+func (r *SeparateResponder) Respond(resp Response) error {
+	r.mu.Lock()
+	if r.sent {
+		r.mu.Unlock()
+		return ErrResponseAlreadySent
+	}
+	r.sent = true
+	r.mu.Unlock()
+
+	msg := resp.GetMessage()
+	if msg == nil {
+		return ErrNilMessage
+	}
+
+	server := r.session.GetServer().(*DefaultCoapServer)
+	msg = server.blockwise(r.req, resp, r.session)
+
+	if r.req.GetMessageType() == MessageConfirmable {
+		msg.SetMessageType(MessageConfirmable)
+	} else {
+		msg.SetMessageType(MessageNonConfirmable)
+	}
+
+	msg.SetMessageId(server.nextMessageID(r.session))
+	msg.SetToken(r.req.GetToken())
+
+	if err := ValidateMessage(msg); err != nil {
+		return err
+	}
+
+	server.GetEvents().Message(msg, false)
+	_, err := SendMessage(msg, r.session)
+
+	return err
+}
+
+// isEmptyAcknowledgement checks if a message is an empty ACK, which
+// announces that the response will be sent separately
+func isEmptyAcknowledgement(msg Message) bool {
+	return msg.GetMessageType() == MessageAcknowledgment && msg.GetCode() == CoapCodeEmpty
+}
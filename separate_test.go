@@ -0,0 +1,107 @@
+package canopus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientSeparateResponse(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer pc.Close()
+
+	acks := make(chan Message, 2)
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, _ := BytesToMessage(buf[:n])
+			if msg.GetMessageType() != MessageConfirmable {
+				acks <- msg
+				continue
+			}
+
+			b, _ := MessageToBytes(NewMessageOfType(MessageAcknowledgment, msg.GetMessageId(), nil))
+			pc.WriteTo(b, addr)
+
+			time.Sleep(30 * time.Millisecond)
+			resp := ContentMessage(GenerateMessageID(), MessageConfirmable)
+			resp.SetToken(msg.GetToken())
+			resp.SetStringPayload("later")
+			b, _ = MessageToBytes(resp)
+			pc.WriteTo(b, addr)
+
+			// sent again, as if the acknowledgement were lost
+			time.Sleep(30 * time.Millisecond)
+			pc.WriteTo(b, addr)
+		}
+	}()
+
+	conn, err := Dial(pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTransmissionParams(testTransmissionParams())
+
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/slow")
+
+	resp, err := conn.Send(req)
+	assert.Nil(t, err)
+	assert.Equal(t, MessageConfirmable, int(resp.GetMessage().GetMessageType()))
+	assert.Equal(t, "later", resp.GetMessage().GetPayload().String())
+
+	for i := 0; i < 2; i++ {
+		ack := <-acks
+		assert.Equal(t, MessageAcknowledgment, int(ack.GetMessageType()))
+		assert.Equal(t, resp.GetMessage().GetMessageId(), ack.GetMessageId())
+	}
+}
+
+func TestServerSeparateResponse(t *testing.T) {
+	s := NewServer()
+	s.SetTransmissionParams(testTransmissionParams())
+
+	release := make(chan bool)
+	s.Get("/slow", func(req Request) Response {
+		responder := req.DeferResponse()
+		go func() {
+			<-release
+			msg := ContentMessage(0, MessageAcknowledgment)
+			msg.SetStringPayload("later")
+			responder.Respond(NewResponseWithMessage(msg))
+		}()
+
+		return NoResponse()
+	})
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/slow")
+	go s.(*DefaultCoapServer).handleRequest(req.GetMessage(), session)
+
+	buf := make([]byte, MaxPacketSize)
+	n, _, err := peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	ack, _ := BytesToMessage(buf[:n])
+	assert.True(t, isEmptyAcknowledgement(ack))
+	assert.Equal(t, req.GetMessage().GetMessageId(), ack.GetMessageId())
+
+	release <- true
+	n, _, err = peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	resp, _ := BytesToMessage(buf[:n])
+	assert.Equal(t, MessageConfirmable, int(resp.GetMessageType()))
+	assert.Equal(t, CoapCodeContent, resp.GetCode())
+	assert.Equal(t, req.GetMessage().GetToken(), resp.GetToken())
+	assert.Equal(t, "later", resp.GetPayload().String())
+	s.(*DefaultCoapServer).handleResponse(NewEmptyMessage(resp.GetMessageId()), session)
+}
@@ -1,19 +1,45 @@
 package canopus
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
+	"io"
 	"log"
 	"net"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrServerClosed = errors.New("Server closed")
+
+// interval at which Shutdown checks whether the server has been drained
+const shutdownPollInterval = 10 * time.Millisecond
+
 var DTLS_SERVER_SESSIONS = make(map[int32]*DTLSServerSession)
 var NEXT_SESSION_ID int32 = 0
 var DTLS_CLIENT_CONNECTIONS = make(map[int32]*DTLSConnection)
 
+// guards DTLS_SERVER_SESSIONS and DTLS_CLIENT_CONNECTIONS, which are read
+// from the OpenSSL BIO callbacks
+var dtlsSessionsMu sync.RWMutex
+
+func dtlsServerSession(id int32) *DTLSServerSession {
+	dtlsSessionsMu.RLock()
+	defer dtlsSessionsMu.RUnlock()
+
+	return DTLS_SERVER_SESSIONS[id]
+}
+
+func dtlsClientConnection(id int32) *DTLSConnection {
+	dtlsSessionsMu.RLock()
+	defer dtlsSessionsMu.RUnlock()
+
+	return DTLS_CLIENT_CONNECTIONS[id]
+}
+
 type ServerConfiguration struct {
 	EnableResourceDiscovery bool
 }
@@ -23,60 +49,170 @@ func NewServer() CoapServer {
 }
 
 func createServer() CoapServer {
-	return &DefaultCoapServer{
-		events:                  NewEvents(),
-		observations:            make(map[string][]*Observation),
-		fnHandleCOAPProxy:       NullProxyHandler,
-		fnHandleHTTPProxy:       NullProxyHandler,
-		fnProxyFilter:           NullProxyFilter,
-		stopChannel:             make(chan int),
-		coapResponseChannelsMap: make(map[uint16]chan *CoapResponseChannel),
-		messageIds:              make(map[uint16]time.Time),
-		incomingBlockMessages:   make(map[string]Message),
-		outgoingBlockMessages:   make(map[string]Message),
-		sessions:                make(map[string]Session),
-		createdSession:          make(chan Session),
+	events := NewEvents()
+
+	s := &DefaultCoapServer{
+		events:             events,
+		observations:       make(map[string][]*Observation),
+		observeMaxAge:      DefaultObserveMaxAge,
+		notifyAttributes:   make(map[string]NotifyAttributes),
+		observationStore:   NewMemoryObservationStore(),
+		fnHandleCOAPProxy:  NullProxyHandler,
+		fnHandleHTTPProxy:  NullProxyHandler,
+		fnProxyFilter:      NullProxyFilter,
+		stopChannel:        make(chan int),
+		listeners:          make(map[ServerConnection]bool),
+		exchanges:          newExchangeTracker(DefaultTransmissionParams(), events),
+		dedup:              newDedupCache(DefaultTransmissionParams(), DefaultDedupCacheSize),
+		messageIDs:         newMessageIDGenerator(DefaultTransmissionParams().ExchangeLifetime()),
+		block2:             newBlock2Cache(DefaultBlock2CacheSize),
+		block2Size:         DefaultBlock2Size,
+		block1:             newBlock1Uploads(DefaultMaxRequestBodySize, DefaultBlock1Timeout),
+		sessions:           make(map[string]Session),
+		sessionIdleTimeout: DefaultSessionIdleTimeout,
+		routes:             NewRouteTree(),
+		mounts:             make(map[mountedRouter]map[string]Route),
 	}
+	s.pool = newWorkerPool(DefaultWorkerCount, DefaultQueueSize, s.handlePacket)
+
+	return s
 }
 
 type DefaultCoapServer struct {
-	messageIds            map[uint16]time.Time
-	incomingBlockMessages map[string]Message
-	outgoingBlockMessages map[string]Message
-
-	routes       []Route
-	events       Events
-	observations map[string][]*Observation
+	dedup      *dedupCache
+	messageIDs *messageIDGenerator
+	block2     *block2Cache
+	block2Size BlockSizeType
+	block1     *block1Uploads
+
+	routesMu   sync.RWMutex
+	routes     *RouteTree
+	middleware []Middleware
+	events     Events
+
+	// routes added by each mount, replaced when mounting again
+	mounts map[mountedRouter]map[string]Route
+
+	observationsMu sync.RWMutex
+	observations   map[string][]*Observation
+	observeMaxAge  uint32
+
+	// notification attributes of resources, set with SetNotifyAttributes
+	notifyAttributes map[string]NotifyAttributes
+
+	// observations are saved to the store, and those loaded from it resumed
+	// once serving, or once observers over DTLS connect again
+	observationStore ObservationStore
+	restored         []ObservationRecord
+	detached         []ObservationRecord
+
+	// registrations and deregistrations waiting to be written to the store,
+	// which storeMu serializes
+	storeChanges []observationChange
+	storeMu      sync.Mutex
 
 	fnHandleHTTPProxy ProxyHandler
 	fnHandleCOAPProxy ProxyHandler
 	fnProxyFilter     ProxyFilter
 
-	stopChannel chan int
+	stopChannel  chan int
+	startOnce    sync.Once
+	shuttingDown int32
+	notifying    int32
+
+	listenersMu sync.Mutex
+	listeners   map[ServerConnection]bool
+	serving     sync.WaitGroup
 
-	coapResponseChannelsMap map[uint16]chan *CoapResponseChannel
+	exchanges *exchangeTracker
+	pool      *workerPool
 
-	sessions       map[string]Session
-	createdSession chan Session
-	serverConfig   *ServerConfiguration
+	sessionsMu         sync.RWMutex
+	sessions           map[string]Session
+	sessionIdleTimeout time.Duration
+	serverConfig       *ServerConfiguration
 
 	cookieSecret []byte
 
 	fnPskHandler func(id string) []byte
 }
 
+// SetWorkerPool sets the number of goroutines handling incoming messages and
+// the number of messages which can be queued for them. It must be called
+// before the server is started
+func (s *DefaultCoapServer) SetWorkerPool(workers, queueSize int) {
+	s.pool = newWorkerPool(workers, queueSize, s.handlePacket)
+}
+
+// SetBlock2Size sets the size of the blocks large responses are split into.
+// Clients may still ask for smaller blocks
+func (s *DefaultCoapServer) SetBlock2Size(size BlockSizeType) {
+	s.block2Size = size
+}
+
+// SetMaxRequestBodySize sets the largest request payload reassembled from
+// Block1 blocks, larger uploads are refused with 4.13 Request Entity Too Large
+func (s *DefaultCoapServer) SetMaxRequestBodySize(size int) {
+	s.block1.setMaxBodySize(size)
+}
+
+// SetBlock1Timeout sets how long a partial Block1 upload is kept without
+// receiving its next block
+func (s *DefaultCoapServer) SetBlock1Timeout(timeout time.Duration) {
+	s.block1.setTimeout(timeout)
+}
+
+// SetSessionIdleTimeout sets how long the session of an endpoint is kept
+// without exchanging messages with it
+func (s *DefaultCoapServer) SetSessionIdleTimeout(timeout time.Duration) {
+	s.sessionsMu.Lock()
+	s.sessionIdleTimeout = timeout
+	s.sessionsMu.Unlock()
+}
+
 func (s *DefaultCoapServer) DeleteSession(ssn Session) {
 	s.closeSession(ssn)
 }
 
+// SetTransmissionParams overrides the parameters used when retransmitting
+// Confirmable messages sent by the server
+func (s *DefaultCoapServer) SetTransmissionParams(p TransmissionParams) {
+	s.exchanges.setParams(p)
+	s.dedup.setParams(p)
+	s.messageIDs.setLifetime(p.ExchangeLifetime())
+}
+
+// nextMessageID returns the message ID to use for the next message sent to
+// the session's endpoint
+func (s *DefaultCoapServer) nextMessageID(session Session) uint16 {
+	return s.messageIDs.next(session.GetAddress().String())
+}
+
 func (s *DefaultCoapServer) HandlePSK(fn func(id string) []byte) {
 	s.fnPskHandler = fn
 }
 
 func (s *DefaultCoapServer) handleRequest(msg Message, session Session) {
 	if msg.GetMessageType() != MessageReset {
+		// Duplicate Message ID Check
+		if duplicate, resp := s.dedup.seen(session.GetAddress().String(), msg); duplicate {
+			if msg.GetMessageType() == MessageConfirmable {
+				logMsg("Duplicate Message ID ", msg.GetMessageId())
+				s.handleReqDuplicateMessageID(resp, session)
+			}
+			return
+		}
+
+		// Ping
+		if msg.GetCode() == CoapCodeEmpty {
+			if msg.GetMessageType() == MessageConfirmable {
+				s.handleReqPing(msg, session)
+			}
+			return
+		}
+
 		// Unsupported Method
-		if msg.GetCode() != Get && msg.GetCode() != Post && msg.GetCode() != Put && msg.GetCode() != Delete {
+		if MethodString(msg.GetCode()) == "" {
 			s.handleReqUnsupportedMethodRequest(msg, session)
 			return
 		}
@@ -85,7 +221,7 @@ func (s *DefaultCoapServer) handleRequest(msg Message, session Session) {
 		if IsProxyRequest(msg) {
 			s.handleReqProxyRequest(msg, session)
 		} else {
-			route, attrs, err := MatchingRoute(msg.GetURIPath(), MethodString(msg.GetCode()), msg.GetOptions(OptionContentFormat), s.GetRoutes())
+			route, attrs, err := s.matchRoute(msg)
 			if err != nil {
 				s.GetEvents().Error(err)
 				if err == ErrNoMatchingRoute {
@@ -103,94 +239,77 @@ func (s *DefaultCoapServer) handleRequest(msg Message, session Session) {
 					return
 				}
 
+				if err == ErrNotAcceptable {
+					s.handleReqNotAcceptable(msg, session)
+					return
+				}
+
 				log.Println("Error occured parsing inbound message")
 				return
 			}
 
-			// Duplicate Message ID Check
-			if s.isDuplicateMessage(msg) {
-				PrintMessage(msg)
-				if msg.GetMessageType() == MessageConfirmable {
-					log.Println("Duplicate Message ID ", msg.GetMessageId())
-					s.handleReqDuplicateMessageID(msg, session)
-				}
+			// SZX 7 is reserved, as checked by handleReqBlock1 for Block1
+			if block := requestedBlock2(msg); block != nil && block.Exponent() == 7 {
+				s.handleReqBadRequest(msg, session)
 				return
 			}
 
-			s.updateMessageTS(msg)
+			// the handler is only called once all blocks of an upload are received
+			block1 := requestedBlock1(msg)
+			var streamed Response
+			if block1 != nil && route.StreamsBody() {
+				if streamed = s.handleReqBlock1Stream(route, attrs, msg, block1, session); streamed == nil {
+					return
+				}
+			} else if block1 != nil {
+				if msg = s.handleReqBlock1(msg, block1, session); msg == nil {
+					return
+				}
+			}
 
-			// Auto acknowledge
-			// TODO: Necessary?
+			// Auto acknowledge, the handler's response is then sent separately
+			acknowledged := false
 			if msg.GetMessageType() == MessageConfirmable && route.AutoAcknowledge() {
 				s.handleRequestAcknowledge(msg, session)
+				acknowledged = true
 			}
 			req := NewClientRequestFromMessage(msg, attrs, session)
 
-			if msg.GetMessageType() == MessageConfirmable {
-				// Observation Request
-				obsOpt := msg.GetOption(OptionObserve)
-				if obsOpt != nil {
-					s.handleReqObserve(req, msg, session)
-				}
+			var obs *Observation
+			if msg.GetOption(OptionObserve) != nil {
+				obs = s.handleReqObserve(msg, session)
 			}
-			opt := req.GetMessage().GetOption(OptionBlock1)
-			if opt != nil {
-				blockOpt := Block1OptionFromOption(opt)
-
-				// 0000 1 010
-				/*
-									[NUM][M][SZX]
-									2 ^ (2 + 4)
-									2 ^ 6 = 32
-									Size = 2 ^ (SZX + 4)
-
-									The value 7 for SZX (which would
-					      	indicate a block size of 2048) is reserved, i.e. MUST NOT be sent
-					      	and MUST lead to a 4.00 Bad Request response code upon reception
-					      	in a request.
-				*/
-
-				if blockOpt.Value != nil {
-					if blockOpt.Code == OptionBlock1 {
-						exp := blockOpt.Exponent()
-
-						if exp == 7 {
-							s.handleReqBadRequest(msg, session)
-							return
-						}
-
-						// szx := blockOpt.Size()
-						hasMore := blockOpt.HasMore()
-						seqNum := blockOpt.Sequence()
-						// fmt.Println("Out Values == ", blockOpt.Value, exp, szx, 2, hasMore, seqNum)
-
-						s.GetEvents().BlockMessage(msg, true)
-
-						s.updateBlockMessageFragment(session.GetAddress().String(), msg, seqNum)
-
-						if hasMore {
-							s.handleReqContinue(msg, session)
-
-							// Auto Respond to client
-
-						} else {
-							// TODO: Check if message is too large
-							msg = NewMessage(msg.GetMessageType(), msg.GetCode(), msg.GetMessageId())
-							msg.SetPayload(s.flushBlockMessagePayload(session.GetAddress().String()))
-							req = NewClientRequestFromMessage(msg, attrs, session)
-						}
-					} else if blockOpt.Code == OptionBlock2 {
-
-					} else {
-						// TOOO: Invalid Block option Code
-					}
+			coapReq := req.(*CoapRequest)
+			coapReq.acknowledged = acknowledged
+
+			// subsequent blocks of a large response are served from the cache
+			var resp Response
+			if streamed != nil {
+				// answers the last block of the upload
+				resp = streamed
+				if resp.GetMessage() != nil {
+					resp.GetMessage().SetMessageId(msg.GetMessageId())
 				}
+			} else if blockMsg := s.cachedBlock2Response(msg, session); blockMsg != nil {
+				resp = NewResponseWithMessage(blockMsg)
+			} else {
+				resp = s.handleRoute(route, req)
 			}
-
-			resp := route.Handle(req)
 			_, nilresponse := resp.(NilResponse)
-			if !nilresponse {
-				respMsg := resp.GetMessage().(*CoapMessage)
+			if !nilresponse && obs != nil {
+				s.observeResponse(obs, resp.GetMessage())
+			}
+			if !nilresponse && block1 != nil && resp.GetMessage().GetOption(OptionBlock1) == nil {
+				// the response to the last block acknowledges it
+				resp.GetMessage().AddOption(OptionBlock1, encodeBlockValue(block1.Size(), false, block1.Sequence()))
+			}
+			if !nilresponse && coapReq.acknowledged {
+				err := newSeparateResponder(req.GetMessage(), session).Respond(resp)
+				if err != nil {
+					s.GetEvents().Error(err)
+				}
+			} else if !nilresponse {
+				respMsg := s.blockwise(msg, resp, session)
 				respMsg.SetToken(req.GetMessage().GetToken())
 
 				// TODO: Validate Message before sending (e.g missing messageId)
@@ -204,45 +323,18 @@ func (s *DefaultCoapServer) handleRequest(msg Message, session Session) {
 	}
 }
 
-func (s *DefaultCoapServer) handleReqObserve(req Request, msg Message, session Session) {
-	// TODO: if server doesn't allow observing, return error
-	addr := session.GetAddress()
-
-	// TODO: Check if observation has been registered, if yes, remove it (observation == cancel)
-	resource := msg.GetURIPath()
-
-	if s.HasObservation(resource, addr) {
-		// Remove observation of client
-		s.RemoveObservation(resource, addr)
-
-		// Observe Cancel Request & Fire OnObserveCancel Event
-		s.GetEvents().ObserveCancelled(resource, msg)
-	} else {
-		// Register observation of client
-		s.AddObservation(msg.GetURIPath(), string(msg.GetToken()), session)
-
-		// Observe Request & Fire OnObserve Event
-		s.GetEvents().Observe(resource, msg)
-	}
-
-	req.GetMessage().AddOption(OptionObserve, 1)
-}
-
 func (s *DefaultCoapServer) handleResponse(msg Message, session Session) {
-	defer s.closeSession(session)
 	if msg.GetOption(OptionObserve) != nil {
 		s.handleAcknowledgeObserveRequest(msg)
 		return
 	}
 
-	ch := GetResponseChannel(s, msg.GetMessageId())
-	if ch != nil {
-		resp := &CoapResponseChannel{
-			Response: NewResponse(msg, nil),
-		}
-		ch <- resp
-		DeleteResponseChannel(s, msg.GetMessageId())
+	if msg.GetMessageType() == MessageReset {
+		// the observer doesn't want the notification
+		s.handleObserveReset(msg, session)
 	}
+
+	s.exchanges.complete(session.GetAddress().String(), msg)
 }
 
 func (s *DefaultCoapServer) GetEvents() Events {
@@ -253,33 +345,9 @@ func (s *DefaultCoapServer) addDiscoveryRoute() {
 	var discoveryRoute RouteHandler = func(req Request) Response {
 		msg := req.GetMessage()
 
-		var buf bytes.Buffer
-		for _, r := range s.routes {
-			if r.GetConfiguredPath() != ".well-known/core" {
-				buf.WriteString("</")
-				buf.WriteString(r.GetConfiguredPath())
-				buf.WriteString(">")
-
-				// Media Types
-				lenMt := len(r.GetMediaTypes())
-				if lenMt > 0 {
-					buf.WriteString(";ct=")
-					for idx, mt := range r.GetMediaTypes() {
-
-						buf.WriteString(strconv.Itoa(int(mt)))
-						if idx+1 < lenMt {
-							buf.WriteString(" ")
-						}
-					}
-				}
-
-				buf.WriteString(",")
-			}
-		}
-
 		ack := ContentMessage(msg.GetMessageId(), MessageAcknowledgment)
 		ack.SetToken(msg.GetToken())
-		ack.SetPayload(NewPlainTextPayload(buf.String()))
+		ack.SetPayload(NewPlainTextPayload(s.coreLinkFormat(msg.GetOptionsAsString(OptionURIQuery)...)))
 		ack.AddOption(OptionContentFormat, MediaTypeApplicationLinkFormat)
 		resp := NewResponseWithMessage(ack)
 
@@ -288,209 +356,340 @@ func (s *DefaultCoapServer) addDiscoveryRoute() {
 	s.NewRoute("/.well-known/core", Get, discoveryRoute)
 }
 
-func (s *DefaultCoapServer) ListenAndServeDTLS(addr string) {
-	s.addDiscoveryRoute()
+// ListenAndServeDTLS listens on a UDP address and serves DTLS requests until
+// the server is shut down. It always returns a non-nil error, ErrServerClosed
+// after Shutdown or Stop
+func (s *DefaultCoapServer) ListenAndServeDTLS(addr string) error {
+	conn, err := s.createConn(addr)
+	if err != nil {
+		return err
+	}
 
-	conn := s.createConn(addr)
+	return s.ServeDTLS(conn)
+}
 
-	ctx, err := NewServerDtlsContext()
+// ListenAndServe listens on a UDP address and serves requests until the
+// server is shut down. It always returns a non-nil error, ErrServerClosed
+// after Shutdown or Stop
+func (s *DefaultCoapServer) ListenAndServe(addr string) error {
+	conn, err := s.createConn(addr)
 	if err != nil {
-		panic("Unable to create SSL Context:" + err.Error())
+		return err
 	}
 
-	if conn == nil {
-		log.Fatal("An error occured starting up CoAPS Server")
-	} else {
-		secret := make([]byte, 32)
-		if n, err := rand.Read(secret); n != 32 || err != nil {
-			panic(err)
-		}
+	return s.Serve(conn)
+}
 
-		s.cookieSecret = secret
-		log.Println("Started CoAPS Server ", conn.LocalAddr())
-		go s.handleIncomingDTLSData(conn, ctx)
-		go s.events.Started(s)
-		go s.handleMessageIDPurge()
+// Serve serves requests received on conn until the server is shut down,
+// closing conn when returning. It always returns a non-nil error,
+// ErrServerClosed after Shutdown or Stop
+func (s *DefaultCoapServer) Serve(conn net.PacketConn) error {
+	return s.serve(&UDPServerConnection{conn: conn}, nil)
+}
+
+// ServeDTLS serves DTLS requests received on conn until the server is shut
+// down, closing conn when returning. It always returns a non-nil error,
+// ErrServerClosed after Shutdown or Stop
+func (s *DefaultCoapServer) ServeDTLS(conn net.PacketConn) error {
+	ctx, err := NewServerDtlsContext()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	secret := make([]byte, 32)
+	if n, err := rand.Read(secret); n != 32 || err != nil {
+		conn.Close()
+		return err
 	}
+	s.cookieSecret = secret
+
+	return s.serve(&UDPServerConnection{conn: conn}, ctx)
 }
 
-func (s *DefaultCoapServer) ListenAndServe(addr string) {
-	s.addDiscoveryRoute()
+func (s *DefaultCoapServer) serve(conn ServerConnection, dtlsCtx *ServerDtlsContext) error {
+	if !s.addListener(conn) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.removeListener(conn)
 
-	conn := s.createConn(addr)
+	s.startOnce.Do(func() {
+		s.addDiscoveryRoute()
+		s.pool.run()
+		go s.handleMessageIDPurge()
+	})
 
-	if conn == nil {
-		log.Fatal("An error occured starting up CoAP Server")
-	} else {
-		log.Println("Started CoAP Server ", conn.LocalAddr())
-		go s.handleIncomingData(conn)
+	if dtlsCtx != nil {
+		s.restoreObservations(nil)
+		log.Println("Started CoAPS Server ", conn.LocalAddr())
 		go s.events.Started(s)
-		go s.handleMessageIDPurge()
+		return s.handleIncomingDTLSData(conn, dtlsCtx)
 	}
+
+	s.restoreObservations(conn)
+	log.Println("Started CoAP Server ", conn.LocalAddr())
+	go s.events.Started(s)
+	return s.handleIncomingData(conn)
 }
 
-func (s *DefaultCoapServer) createConn(addr string) ServerConnection {
+func (s *DefaultCoapServer) createConn(addr string) (net.PacketConn, error) {
 	localHost := addr
 	if !strings.Contains(localHost, ":") {
 		localHost = ":" + localHost
 	}
 	localAddr, err := net.ResolveUDPAddr("udp6", localHost)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
-	conn, err := net.ListenUDP(UDP, localAddr)
-	if err != nil {
-		panic(err.Error())
+	return net.ListenUDP(UDP, localAddr)
+}
+
+// addListener registers a connection being served, returning false if the
+// server is shutting down
+func (s *DefaultCoapServer) addListener(conn ServerConnection) bool {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	if s.isShuttingDown() {
+		return false
+	}
+	s.listeners[conn] = true
+	s.serving.Add(1)
+
+	return true
+}
+
+func (s *DefaultCoapServer) removeListener(conn ServerConnection) {
+	s.listenersMu.Lock()
+	delete(s.listeners, conn)
+	s.listenersMu.Unlock()
+
+	conn.Close()
+	s.serving.Done()
+}
+
+// readError decides whether a read error stops serving a connection
+func (s *DefaultCoapServer) readError(err error) error {
+	if s.isShuttingDown() {
+		return ErrServerClosed
 	}
 
-	return &UDPServerConnection{
-		conn: conn,
+	if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+		logMsg("Error occured reading UDP", err)
+		return nil
 	}
+	return err
 }
 
-func (s *DefaultCoapServer) handleIncomingDTLSData(conn ServerConnection, ctx *ServerDtlsContext) {
+func (s *DefaultCoapServer) handleIncomingDTLSData(conn ServerConnection, ctx *ServerDtlsContext) error {
 	readBuf := make([]byte, MaxPacketSize)
-	go func() {
-		for {
-			select {
-			case <-s.stopChannel:
-				return
-
-			default:
-				// continue
+	for {
+		len, addr, err := conn.ReadFrom(readBuf)
+		if err != nil {
+			if err = s.readError(err); err != nil {
+				return err
 			}
+			continue
+		}
 
-			len, addr, err := conn.ReadFrom(readBuf)
-			if err == nil {
-				msgBuf := make([]byte, len)
-				copy(msgBuf, readBuf[:len])
-				ssn := s.sessions[addr.String()]
-				if ssn == nil {
-					ssn = &DTLSServerSession{
-						UDPServerSession: UDPServerSession{
-							addr:   addr,
-							conn:   conn,
-							server: s,
-							buf:    []byte{},
-							rcvd:   make(chan []byte, 1),
-						},
-					}
-					err := newSslSession(ssn.(*DTLSServerSession), ctx, s.fnPskHandler)
-					if err != nil {
-						panic(err.Error())
-					}
-					s.sessions[addr.String()] = ssn
-					s.createdSession <- ssn
-				}
-
-				ssn.(*DTLSServerSession).rcvd <- msgBuf
-			} else {
-				logMsg("Error occured reading UDP", err)
+		msgBuf := make([]byte, len)
+		copy(msgBuf, readBuf[:len])
+
+		s.sessionsMu.Lock()
+		ssn, _ := s.sessions[addr.String()].(*DTLSServerSession)
+		created := false
+		if ssn == nil {
+			ssn = &DTLSServerSession{
+				UDPServerSession: UDPServerSession{
+					addr:   addr,
+					conn:   conn,
+					server: s,
+					buf:    []byte{},
+					rcvd:   make(chan []byte, 1),
+				},
+				quit: make(chan struct{}),
+			}
+			err := newSslSession(ssn, ctx, s.fnPskHandler)
+			if err != nil {
+				s.sessionsMu.Unlock()
+				logMsg("Error creating DTLS session", err)
+				continue
 			}
+			s.sessions[addr.String()] = ssn
+			created = true
 		}
-	}()
+		s.sessionsMu.Unlock()
+		ssn.touch()
 
-	go func() {
-		for {
-			ssn := <-s.createdSession
+		if created {
 			go s.handleSession(ssn)
 		}
-	}()
 
+		select {
+		case ssn.rcvd <- msgBuf:
+		case <-ssn.quit:
+		}
+	}
 }
 
-func (s *DefaultCoapServer) handleIncomingData(conn ServerConnection) {
+func (s *DefaultCoapServer) handleIncomingData(conn ServerConnection) error {
 	readBuf := make([]byte, MaxPacketSize)
-	go func() {
-		for {
-			select {
-			case <-s.stopChannel:
-				return
-
-			default:
-				// continue
+	for {
+		len, addr, err := conn.ReadFrom(readBuf)
+		if err != nil {
+			if err = s.readError(err); err != nil {
+				return err
 			}
+			continue
+		}
 
-			len, addr, err := conn.ReadFrom(readBuf)
-			if err == nil {
-				msgBuf := make([]byte, len)
-				copy(msgBuf, readBuf[:len])
-				ssn := s.sessions[addr.String()]
-				if ssn == nil {
-					ssn = &UDPServerSession{
-						addr:   addr,
-						conn:   conn,
-						server: s,
-						rcvd:   make(chan []byte),
-					}
-					if err != nil {
-						panic(err.Error())
-					}
-					s.sessions[addr.String()] = ssn
-				}
-				go func() {
-					ssn.(*UDPServerSession).rcvd <- msgBuf
-				}()
-				go s.handleSession(ssn)
-			} else {
-				logMsg("Error occured reading UDP", err)
-			}
+		msgBuf := make([]byte, len)
+		copy(msgBuf, readBuf[:len])
+
+		s.dispatch(s.udpSession(addr, conn), msgBuf)
+	}
+}
+
+// dispatch handles acknowledgements and resets as they are read, since
+// workers sending Confirmable messages are blocked waiting for them, and
+// queues other messages to the worker pool
+func (s *DefaultCoapServer) dispatch(ssn Session, data []byte) {
+	if len(data) > 0 && (data[0]>>4)&0x03 >= MessageAcknowledgment {
+		s.handlePacket(ssn, data)
+		return
+	}
+
+	if err := s.pool.submit(ssn, data); err != nil {
+		logMsg(err.Error(), ssn.GetAddress())
+		s.GetEvents().Error(err)
+	}
+}
+
+// udpSession returns the session of a remote endpoint, creating it if needed
+func (s *DefaultCoapServer) udpSession(addr net.Addr, conn ServerConnection) Session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	ssn := s.sessions[addr.String()]
+	if ssn == nil {
+		ssn = &UDPServerSession{
+			addr:   addr,
+			conn:   conn,
+			server: s,
 		}
-	}()
+		s.sessions[addr.String()] = ssn
+	}
+	ssn.(*UDPServerSession).touch()
 
+	return ssn
 }
 
 func (s *DefaultCoapServer) GetSession(addr string) Session {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+
 	return s.sessions[addr]
 }
 
-func (s *DefaultCoapServer) Stop() {
+func (s *DefaultCoapServer) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) != 0
+}
+
+// Shutdown gracefully shuts the server down. New requests are ignored while
+// the requests being handled, the Confirmable messages awaiting an
+// acknowledgement and the notifications being sent are completed. Sockets
+// and DTLS sessions are then closed, and the Closed event fired.
+//
+// If ctx is done before everything is completed, the remaining exchanges
+// are abandoned and ctx.Err() is returned
+func (s *DefaultCoapServer) Shutdown(ctx context.Context) error {
+	s.listenersMu.Lock()
+	if !atomic.CompareAndSwapInt32(&s.shuttingDown, 0, 1) {
+		s.listenersMu.Unlock()
+		return ErrServerClosed
+	}
+	s.listenersMu.Unlock()
+
+	err := s.drain(ctx)
+	if err != nil {
+		s.exchanges.failAll(ErrServerClosed)
+	}
+
 	close(s.stopChannel)
+	s.pool.close()
+	s.closeDTLSSessions()
+
+	s.listenersMu.Lock()
+	for conn := range s.listeners {
+		conn.Close()
+	}
+	s.listenersMu.Unlock()
+	s.serving.Wait()
+
+	s.events.Closed(s)
+
+	return err
 }
 
-func (s *DefaultCoapServer) updateBlockMessageFragment(client string, msg Message, seq uint32) {
-	msgs := s.incomingBlockMessages[client]
+// drain waits until nothing is left to handle or send
+func (s *DefaultCoapServer) drain(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
 
-	if msgs == nil {
-		msgs = &CoapBlockMessage{
-			Sequence:   0,
-			MessageBuf: []byte{},
+	for {
+		if s.pool.idle() && atomic.LoadInt32(&s.notifying) == 0 && s.exchanges.inflight() == 0 {
+			return nil
 		}
-	}
 
-	blockMsgs := msgs.(*CoapBlockMessage)
-	blockMsgs.Sequence = seq
-	blockMsgs.MessageBuf = append(blockMsgs.MessageBuf, msg.GetPayload().GetBytes()...)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
 
-	s.incomingBlockMessages[client] = msgs
+		case <-ticker.C:
+		}
+	}
 }
 
-func (s *DefaultCoapServer) flushBlockMessagePayload(origin string) MessagePayload {
-	msgs := s.incomingBlockMessages[origin]
+func (s *DefaultCoapServer) closeDTLSSessions() {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	for addr, ssn := range s.sessions {
+		if dtlsSsn, ok := ssn.(*DTLSServerSession); ok {
+			dtlsSsn.Close()
+			delete(s.sessions, addr)
+		}
+	}
+}
 
-	blockMsg := msgs.(*CoapBlockMessage)
-	payload := blockMsg.MessageBuf
+// Stop shuts the server down immediately, abandoning any pending exchange
+func (s *DefaultCoapServer) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
 
-	return NewBytesPayload(payload)
+	s.Shutdown(ctx)
 }
 
 func (s *DefaultCoapServer) handleMessageIDPurge() {
 	// Routine for clearing up message IDs which has expired
 	ticker := time.NewTicker(MessageIDPurgeDuration * time.Second)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				for k, v := range s.messageIds {
-					elapsed := time.Since(v)
-					if elapsed > MessageIDPurgeDuration {
-						delete(s.messageIds, k)
-					}
-				}
-			}
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.dedup.purge()
+			s.messageIDs.purge()
+			s.block2.purge()
+			s.block1.purge()
+			s.purgeSessions()
+
+		case <-s.stopChannel:
+			return
 		}
-	}()
+	}
 }
 
 func (s *DefaultCoapServer) SetProxyFilter(fn ProxyFilter) {
@@ -501,25 +700,88 @@ func (s *DefaultCoapServer) GetCookieSecret() []byte {
 	return s.cookieSecret
 }
 
-func (s *DefaultCoapServer) handleSession(session Session) {
-	msgBuf := make([]byte, 1500)
-	n, _ := session.Read(msgBuf)
+// handleSession reads the messages of a DTLS session until it is closed,
+// dispatching each of them. A session failing to read is closed, the peer
+// having to handshake again
+func (s *DefaultCoapServer) handleSession(session *DTLSServerSession) {
+	readBuf := make([]byte, MaxPacketSize)
+	for {
+		n, err := session.Read(readBuf)
+		if err != nil {
+			if err != io.EOF {
+				logMsg("Error reading session", err)
+			}
+			s.closeSession(session)
+			session.Close()
+			return
+		}
+
+		msgBuf := make([]byte, n)
+		copy(msgBuf, readBuf[:n])
+		s.dispatch(session, msgBuf)
+	}
+}
 
-	msg, err := BytesToMessage(msgBuf[:n])
+// handlePacket parses and handles a datagram received from a session
+func (s *DefaultCoapServer) handlePacket(session Session, data []byte) {
+	msg, err := BytesToMessage(data)
 	if err != nil {
+		// without a valid header there is nothing to respond to
 		logMsg(err.Error())
-		s.handleReqBadRequest(msg, session)
+		return
+	}
+
+	if s.isShuttingDown() && msg.GetMessageType() != MessageAcknowledgment && msg.GetMessageType() != MessageReset {
+		// only acknowledgements of pending exchanges are handled while draining
+		return
 	}
 
-	if msg.GetMessageType() == MessageAcknowledgment {
+	s.resumeDetachedObservations(session)
+
+	if msg.GetMessageType() == MessageAcknowledgment || msg.GetMessageType() == MessageReset {
 		s.handleResponse(msg, session)
 	} else {
 		s.handleRequest(msg, session)
 	}
 }
 
+// closeSession removes a session, unless another one replaced it already
 func (s *DefaultCoapServer) closeSession(ssn Session) {
-	delete(s.sessions, ssn.GetAddress().String())
+	s.sessionsMu.Lock()
+	if s.sessions[ssn.GetAddress().String()] == ssn {
+		delete(s.sessions, ssn.GetAddress().String())
+	}
+	s.sessionsMu.Unlock()
+}
+
+// purgeSessions removes the sessions idle for longer than the idle timeout,
+// closing those over DTLS
+func (s *DefaultCoapServer) purgeSessions() {
+	var expired []*DTLSServerSession
+
+	// observers may wait longer than the timeout for their next notification
+	observers := s.observerEndpoints()
+
+	s.sessionsMu.Lock()
+	deadline := time.Now().Add(-s.sessionIdleTimeout)
+	for addr, ssn := range s.sessions {
+		idle, ok := ssn.(interface {
+			idleSince() time.Time
+		})
+		if !ok || !idle.idleSince().Before(deadline) || observers[addr] {
+			continue
+		}
+
+		delete(s.sessions, addr)
+		if dtlsSsn, ok := ssn.(*DTLSServerSession); ok {
+			expired = append(expired, dtlsSsn)
+		}
+	}
+	s.sessionsMu.Unlock()
+
+	for _, ssn := range expired {
+		ssn.Close()
+	}
 }
 
 func (s *DefaultCoapServer) Get(path string, fn RouteHandler) Route {
@@ -538,6 +800,8 @@ func (s *DefaultCoapServer) Post(path string, fn RouteHandler) Route {
 	return s.add(MethodPost, path, fn)
 }
 
+// Options adds an OPTIONS route. CoAP has no OPTIONS method code, such routes
+// are only reached through MatchingRoute
 func (s *DefaultCoapServer) Options(path string, fn RouteHandler) Route {
 	return s.add(MethodOptions, path, fn)
 }
@@ -548,78 +812,29 @@ func (s *DefaultCoapServer) Patch(path string, fn RouteHandler) Route {
 
 func (s *DefaultCoapServer) add(method string, path string, fn RouteHandler) Route {
 	route := CreateNewRegExRoute(path, method, fn)
-	s.routes = append(s.routes, route)
+	s.addRoute(route)
 
 	return route
 }
 
 func (s *DefaultCoapServer) NewRoute(path string, method CoapCode, fn RouteHandler) Route {
 	route := CreateNewRegExRoute(path, MethodString(method), fn)
-	s.routes = append(s.routes, route)
+	s.addRoute(route)
 
 	return route
 }
 
-func (s *DefaultCoapServer) storeNewOutgoingBlockMessage(client string, payload []byte) {
-	bm := NewBlockMessage().(*CoapBlockMessage)
-	bm.MessageBuf = payload
-	s.outgoingBlockMessages[client] = bm
-}
-
-func (s *DefaultCoapServer) NotifyChange(resource, value string, confirm bool) {
-	t := s.observations[resource]
-
-	if t != nil {
-		var req Request
-
-		if confirm {
-			req = NewRequest(MessageConfirmable, CoapCodeContent)
-		} else {
-			req = NewRequest(MessageAcknowledgment, CoapCodeContent)
-		}
-
-		for _, r := range t {
-			req.SetToken(r.Token)
-			req.SetStringPayload(value)
-			req.SetRequestURI(r.Resource)
-			r.NotifyCount++
-			req.GetMessage().AddOption(OptionObserve, r.NotifyCount)
-
-			go SendMessage(req.GetMessage(), r.Session)
-		}
-	}
-}
-
-func (s *DefaultCoapServer) AddObservation(resource, token string, session Session) {
-	s.observations[resource] = append(s.observations[resource], NewObservation(session, token, resource))
-}
-
-func (s *DefaultCoapServer) HasObservation(resource string, addr net.Addr) bool {
-	obs := s.observations[resource]
-	if obs == nil {
-		return false
-	}
-
-	for _, o := range obs {
-		if o.Session.GetAddress().String() == addr.String() {
-			return true
-		}
-	}
-	return false
-}
+// HandleStream adds a route whose handler reads the body of Block1 uploads
+// from Request.Body() as the blocks are received, instead of once the whole
+// payload has been reassembled in memory. The maximum request body size
+// doesn't apply to these uploads
+func (s *DefaultCoapServer) HandleStream(path string, method CoapCode, fn RouteHandler) Route {
+	route := CreateNewRegExRoute(path, MethodString(method), fn)
+	route.(*RegExRoute).StreamBody = true
 
-func (s *DefaultCoapServer) RemoveObservation(resource string, addr net.Addr) {
-	obs := s.observations[resource]
-	if obs == nil {
-		return
-	}
+	s.addRoute(route)
 
-	for idx, o := range obs {
-		if o.Session.GetAddress().String() == addr.String() {
-			s.observations[resource] = append(obs[:idx], obs[idx+1:]...)
-			return
-		}
-	}
+	return route
 }
 
 func (s *DefaultCoapServer) OnNotify(fn FnEventNotify) {
@@ -686,18 +901,26 @@ func (s *DefaultCoapServer) ForwardHTTP(msg Message, session Session) {
 	s.fnHandleHTTPProxy(s, msg, session)
 }
 
+// GetRoutes returns a copy of the routes registered with the server
 func (s *DefaultCoapServer) GetRoutes() []Route {
-	return s.routes
-}
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
 
-func (s *DefaultCoapServer) isDuplicateMessage(msg Message) bool {
-	_, ok := s.messageIds[msg.GetMessageId()]
+	return s.routes.Routes()
+}
 
-	return ok
+func (s *DefaultCoapServer) addRoute(route Route) {
+	s.routesMu.Lock()
+	s.routes.Add(route)
+	s.routesMu.Unlock()
 }
 
-func (s *DefaultCoapServer) updateMessageTS(msg Message) {
-	s.messageIds[msg.GetMessageId()] = time.Now()
+// matchRoute returns the route handling a request
+func (s *DefaultCoapServer) matchRoute(msg Message) (Route, map[string]string, error) {
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+
+	return s.routes.MatchRequest(msg)
 }
 
 func (s *DefaultCoapServer) handleReqUnknownCriticalOption(msg Message, session Session) {
@@ -709,20 +932,36 @@ func (s *DefaultCoapServer) handleReqUnknownCriticalOption(msg Message, session
 
 func (s *DefaultCoapServer) handleReqBadRequest(msg Message, session Session) {
 	if msg.GetMessageType() == MessageConfirmable {
-		SendMessage(BadRequestMessage(msg.GetMessageId(), msg.GetMessageType()), session)
+		resp := BadRequestMessage(msg.GetMessageId(), MessageAcknowledgment)
+		resp.SetToken(msg.GetToken())
+		SendMessage(resp, session)
 	}
 	return
 }
 
 func (s *DefaultCoapServer) handleReqContinue(msg Message, session Session) {
 	if msg.GetMessageType() == MessageConfirmable {
-		SendMessage(ContinueMessage(msg.GetMessageId(), msg.GetMessageType()), session)
+		resp := ContinueMessage(msg.GetMessageId(), MessageAcknowledgment)
+		resp.SetToken(msg.GetToken())
+		resp.AddOption(OptionBlock1, msg.GetOption(OptionBlock1).GetValue())
+		SendMessage(resp, session)
 	}
 	return
 }
 
+// handleReqPing answers an empty Confirmable message with a Reset, as
+// required by RFC 7252, section 4.3
+func (s *DefaultCoapServer) handleReqPing(msg Message, session Session) {
+	rst := NewMessageOfType(MessageReset, msg.GetMessageId(), nil)
+
+	SendMessage(rst, session)
+}
+
+// handleReqUnsupportedMethodRequest answers requests with an unknown method
+// code with 4.05 Method Not Allowed, as required by RFC 7252, section 5.8
 func (s *DefaultCoapServer) handleReqUnsupportedMethodRequest(msg Message, session Session) {
-	ret := NotImplementedMessage(msg.GetMessageId(), MessageAcknowledgment)
+	ret := MethodNotAllowedMessage(msg.GetMessageId(), MessageAcknowledgment)
+	ret.SetToken(msg.GetToken())
 	ret.CloneOptions(msg, OptionURIPath, OptionContentFormat)
 
 	// c.GetEvents().Message(ret, false)
@@ -753,24 +992,40 @@ func (s *DefaultCoapServer) handleReqNoMatchingRoute(msg Message, session Sessio
 
 func (s *DefaultCoapServer) handleReqNoMatchingMethod(msg Message, session Session) {
 	ret := MethodNotAllowedMessage(msg.GetMessageId(), MessageAcknowledgment)
+	ret.SetToken(msg.GetToken())
 	ret.CloneOptions(msg, OptionURIPath, OptionContentFormat)
 
 	SendMessage(ret, session)
 }
 
+func (s *DefaultCoapServer) handleReqNotAcceptable(msg Message, session Session) {
+	ret := NotAcceptableMessage(msg.GetMessageId(), MessageAcknowledgment)
+	ret.SetToken(msg.GetToken())
+	ret.CloneOptions(msg, OptionURIPath)
+
+	SendMessage(ret, session)
+}
+
 func (s *DefaultCoapServer) handleReqUnsupportedContentFormat(msg Message, session Session) {
 	ret := UnsupportedContentFormatMessage(msg.GetMessageId(), MessageAcknowledgment)
+	ret.SetToken(msg.GetToken())
 	ret.CloneOptions(msg, OptionURIPath, OptionContentFormat)
 
 	// s.GetEvents().Message(ret, false)
 	SendMessage(ret, session)
 }
 
-func (s *DefaultCoapServer) handleReqDuplicateMessageID(msg Message, session Session) {
-	ret := EmptyMessage(msg.GetMessageId(), MessageReset)
-	ret.CloneOptions(msg, OptionURIPath, OptionContentFormat)
+// handleReqDuplicateMessageID replays the response sent for the original
+// message. If the original is still being processed there is nothing to
+// replay yet, and the duplicate is ignored
+func (s *DefaultCoapServer) handleReqDuplicateMessageID(resp []byte, session Session) {
+	if resp == nil {
+		return
+	}
 
-	SendMessage(ret, session)
+	if _, err := session.Write(resp); err != nil {
+		s.GetEvents().Error(err)
+	}
 }
 
 func (s *DefaultCoapServer) handleRequestAcknowledge(msg Message, session Session) {
@@ -784,7 +1039,7 @@ func (s *DefaultCoapServer) handleAcknowledgeObserveRequest(msg Message) {
 }
 
 func (s *DefaultCoapServer) handleAcknowledgeObserveRequestGetSession(addr string) Session {
-	return s.sessions[addr]
+	return s.GetSession(addr)
 }
 
 func NewResponseChannel() (ch chan *CoapResponseChannel) {
@@ -795,78 +1050,67 @@ func NewResponseChannel() (ch chan *CoapResponseChannel) {
 
 func AddResponseChannel(c CoapServer, msgId uint16, ch chan *CoapResponseChannel) {
 	s := c.(*DefaultCoapServer)
-	s.coapResponseChannelsMap[msgId] = ch
+	s.exchanges.register(msgId, ch)
 }
 
 func DeleteResponseChannel(c CoapServer, msgId uint16) {
 	s := c.(*DefaultCoapServer)
-	delete(s.coapResponseChannelsMap, msgId)
+	s.exchanges.remove(messageKey{msgID: msgId})
 }
 
 func GetResponseChannel(c CoapServer, msgId uint16) (ch chan *CoapResponseChannel) {
 	s := c.(*DefaultCoapServer)
-	ch = s.coapResponseChannelsMap[msgId]
+	ex := s.exchanges.get(messageKey{msgID: msgId})
+	if ex != nil {
+		ch = ex.ch
+	}
 
 	return
 }
 
-func NewObservation(session Session, token string, resource string) *Observation {
-	return &Observation{
-		Session:     session,
-		Token:       token,
-		Resource:    resource,
-		NotifyCount: 0,
+// SendMessage sends a message to a session. Confirmable messages are retransmitted
+// until acknowledged by the remote endpoint; the acknowledgement is returned as the
+// Response, or a *TimeoutError once MAX_RETRANSMIT has been reached
+func SendMessage(msg Message, session Session) (Response, error) {
+	if session.GetConnection() == nil {
+		return nil, ErrNilConn
 	}
-}
-
-type Observation struct {
-	Session     Session
-	Token       string
-	Resource    string
-	NotifyCount int
-}
 
-func _doSendMessage(msg Message, session Session, ch chan *CoapResponseChannel) {
-	resp := &CoapResponseChannel{}
+	if msg == nil {
+		return nil, ErrNilMessage
+	}
 
-	b, err := MessageToBytes(msg)
-	if err != nil {
-		resp.Error = err
-		ch <- resp
+	if session.GetAddress() == nil {
+		return nil, ErrNilAddr
 	}
 
-	_, err = session.Write(b)
+	b, err := MessageToBytes(msg)
 	if err != nil {
-		resp.Error = err
-		ch <- resp
+		return nil, err
 	}
 
-	if msg.GetMessageType() == MessageNonConfirmable {
-		resp.Response = NewResponse(NewEmptyMessage(msg.GetMessageId()), nil)
-		ch <- resp
+	server := session.GetServer().(*DefaultCoapServer)
+	if ssn, ok := session.(interface {
+		touch()
+	}); ok {
+		ssn.touch()
 	}
-	AddResponseChannel(session.GetServer(), msg.GetMessageId(), ch)
-}
 
-func SendMessage(msg Message, session Session) (Response, error) {
-	if session.GetConnection() == nil {
-		return nil, ErrNilConn
+	if msg.GetMessageType() == MessageConfirmable {
+		respCh := <-server.exchanges.send(msg, b, session)
+		return respCh.Response, respCh.Error
 	}
 
-	if msg == nil {
-		return nil, ErrNilMessage
+	if msg.GetMessageType() == MessageAcknowledgment || msg.GetMessageType() == MessageReset {
+		// kept to answer retransmissions of the message being responded to
+		server.dedup.storeResponse(session.GetAddress().String(), msg.GetMessageId(), b)
 	}
 
-	if session.GetAddress() == nil {
-		return nil, ErrNilAddr
+	_, err = session.Write(b)
+	if err != nil {
+		return nil, err
 	}
-
-	ch := NewResponseChannel()
-	go _doSendMessage(msg, session, ch)
-
-	session.GetServer().DeleteSession(session)
-	respCh := <-ch
-	return respCh.Response, respCh.Error
+	return NewResponse(NewEmptyMessage(msg.GetMessageId()), nil), nil
 }
 
 type CoapResponseChannel struct {
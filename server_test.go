@@ -1,6 +1,13 @@
 package canopus
 
-import "testing"
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
 
 // TODO Redo this entire test suite
 func TestServerInstantiate(t *testing.T) {
@@ -148,3 +155,188 @@ func TestServerInstantiate(t *testing.T) {
 //	})
 //	client.Start()
 //}
+
+func TestServerConfirmableRetransmission(t *testing.T) {
+	s := NewServer()
+	s.SetTransmissionParams(testTransmissionParams())
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	msg := NewMessage(MessageConfirmable, CoapCodeContent, GenerateMessageID())
+	msg.SetStringPayload("notification")
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for i := 0; i < 2; i++ {
+			peer.ReadFrom(buf)
+		}
+		s.(*DefaultCoapServer).handleResponse(NewEmptyMessage(msg.GetMessageId()), session)
+	}()
+
+	resp, err := SendMessage(msg, session)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.GetMessageId(), resp.GetMessage().GetMessageId())
+	assert.Nil(t, GetResponseChannel(s, msg.GetMessageId()))
+}
+
+func TestServerConfirmableTimeout(t *testing.T) {
+	s := NewServer()
+	s.SetTransmissionParams(testTransmissionParams())
+
+	var evtErr error
+	s.OnError(func(err error) {
+		evtErr = err
+	})
+
+	session, peer := newTestSession(t, s)
+	defer peer.Close()
+	defer session.GetConnection().Close()
+
+	msg := NewMessage(MessageConfirmable, CoapCodeContent, GenerateMessageID())
+	resp, err := SendMessage(msg, session)
+	assert.Nil(t, resp)
+	assert.True(t, IsTimeoutError(err))
+	assert.Equal(t, err, evtErr)
+	assert.Equal(t, 4, err.(*TimeoutError).Attempts)
+}
+
+func TestListenAndServeReturnsError(t *testing.T) {
+	s := NewServer()
+
+	pc, err := net.ListenPacket("udp", "[::]:0")
+	assert.Nil(t, err)
+	defer pc.Close()
+
+	// port already in use
+	err = s.ListenAndServe(pc.LocalAddr().String())
+	assert.NotNil(t, err)
+}
+
+func TestServerShutdownDrainsNotifications(t *testing.T) {
+	s := NewServer()
+	s.SetTransmissionParams(testTransmissionParams())
+
+	started := make(chan bool, 1)
+	s.OnStart(func(server CoapServer) {
+		started <- true
+	})
+
+	closed := make(chan bool, 1)
+	s.OnClose(func(server CoapServer) {
+		closed <- true
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(pc)
+	}()
+	<-started
+
+	peer, rcvd := startTestPeer(t, 1, acknowledge)
+	defer peer.Close()
+
+	session := &UDPServerSession{
+		addr:   peer.LocalAddr(),
+		conn:   &UDPServerConnection{conn: pc},
+		server: s,
+	}
+	s.AddObservation("watched", "tok", session)
+	s.NotifyChange("watched", "value", true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.Nil(t, s.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-served)
+	assert.Equal(t, 2, len(rcvd))
+	assert.Equal(t, "value", (<-rcvd).GetPayload().String())
+	assert.Equal(t, 1, len(closed))
+
+	// socket is closed and the server can't be restarted
+	_, err = pc.WriteTo([]byte{0}, peer.LocalAddr())
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrServerClosed, s.Serve(pc))
+	assert.Equal(t, ErrServerClosed, s.Shutdown(ctx))
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	s := NewServer()
+	s.SetTransmissionParams(TransmissionParams{
+		AckTimeout:      time.Second,
+		AckRandomFactor: 1.5,
+		MaxRetransmit:   4,
+	})
+
+	started := make(chan bool, 1)
+	s.OnStart(func(server CoapServer) {
+		started <- true
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.Serve(pc)
+	<-started
+
+	peer, _ := startTestPeer(t, 100, acknowledge)
+	defer peer.Close()
+
+	session := &UDPServerSession{
+		addr:   peer.LocalAddr(),
+		conn:   &UDPServerConnection{conn: pc},
+		server: s,
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := SendMessage(NewMessage(MessageConfirmable, CoapCodeContent, GenerateMessageID()), session)
+		sent <- err
+	}()
+	for s.(*DefaultCoapServer).exchanges.inflight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-sent)
+}
+
+func TestServerSessionIdleTimeout(t *testing.T) {
+	s := NewServer()
+	s.SetSessionIdleTimeout(50 * time.Millisecond)
+	s.Get("/hello", func(req Request) Response {
+		return NewResponseWithMessage(ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+	})
+
+	addr := startTestServer(t, s)
+	defer s.Stop()
+
+	conn, err := Dial(addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/hello")
+	_, err = conn.Send(req)
+	assert.Nil(t, err)
+
+	// sessions outlive the messages exchanged
+	client := conn.(*UDPConnection).conn.LocalAddr().String()
+	assert.NotNil(t, s.GetSession(client))
+
+	// idle sessions expire, unless observing resources
+	s.AddObservation("/hello", "tok", s.GetSession(client))
+	time.Sleep(100 * time.Millisecond)
+	s.(*DefaultCoapServer).purgeSessions()
+	assert.NotNil(t, s.GetSession(client))
+
+	s.RemoveObservation("/hello", conn.(*UDPConnection).conn.LocalAddr())
+	s.(*DefaultCoapServer).purgeSessions()
+	assert.Nil(t, s.GetSession(client))
+}
@@ -1,8 +1,21 @@
 package canopus
 
-import "net"
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSessionIdleTimeout is how long the server keeps the session of an
+// endpoint it exchanges no message with. An expired DTLS session is closed,
+// the endpoint having to handshake again
+const DefaultSessionIdleTimeout = 5 * time.Minute
 
 type UDPServerSession struct {
+	// time of the latest message received or sent, in nanoseconds, accessed
+	// atomically
+	active int64
+
 	addr   net.Addr
 	conn   ServerConnection
 	server CoapServer
@@ -39,3 +52,13 @@ func (s *UDPServerSession) Read(b []byte) (n int, err error) {
 func (s *UDPServerSession) GetServer() CoapServer {
 	return s.server
 }
+
+// touch records a message exchanged with the endpoint, delaying the expiry
+// of the session
+func (s *UDPServerSession) touch() {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+func (s *UDPServerSession) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.active))
+}
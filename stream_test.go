@@ -0,0 +1,101 @@
+package canopus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readerOnly hides any other interface of a reader, such as io.Seeker
+type readerOnly struct {
+	io.Reader
+}
+
+func TestStreamUpload(t *testing.T) {
+	firmware := bytes.Repeat([]byte("firmware"), 1000)
+
+	s := NewServer()
+	received := make(chan []byte, 1)
+	s.HandleStream("/firmware", Put, func(req Request) Response {
+		b, err := ioutil.ReadAll(req.Body())
+		assert.Nil(t, err)
+		received <- b
+
+		return NewResponseWithMessage(ChangedMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+	})
+
+	// the handler gives up after the first bytes
+	s.HandleStream("/refused", Put, func(req Request) Response {
+		req.Body().Read(make([]byte, 10))
+
+		return NewResponseWithMessage(ForbiddenMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+	})
+
+	addr := startTestServer(t, s)
+	defer s.Stop()
+
+	conn, err := Dial(addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	req := NewRequest(MessageConfirmable, Put)
+	req.SetRequestURI("/firmware")
+	req.GetMessage().SetBlock1Option(NewBlock1Option(BlockSize256, true, 0))
+
+	resp, err := conn.Upload(context.Background(), req, readerOnly{bytes.NewReader(firmware)})
+	assert.Nil(t, err)
+	assert.Equal(t, CoapCodeChanged, resp.GetMessage().GetCode())
+	assert.Equal(t, firmware, <-received)
+
+	req = NewRequest(MessageConfirmable, Put)
+	req.SetRequestURI("/refused")
+
+	resp, err = conn.Upload(context.Background(), req, bytes.NewReader(firmware))
+	assert.Nil(t, err)
+	assert.Equal(t, CoapCodeForbidden, resp.GetMessage().GetCode())
+}
+
+func TestStreamDownload(t *testing.T) {
+	firmware := bytes.Repeat([]byte("firmware"), 1000)
+
+	s := NewServer()
+	s.Get("/firmware", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		return NewStreamResponse(msg, bytes.NewReader(firmware))
+	})
+
+	s.Get("/small", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		return NewStreamResponse(msg, bytes.NewReader([]byte("small")))
+	})
+
+	addr := startTestServer(t, s)
+	defer s.Stop()
+
+	conn, err := Dial(addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// doesn't apply to downloads
+	conn.SetMaxResponseSize(100)
+
+	var body bytes.Buffer
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/firmware")
+	resp, err := conn.Download(context.Background(), req, &body)
+	assert.Nil(t, err)
+	assert.Equal(t, CoapCodeContent, resp.GetMessage().GetCode())
+	assert.Equal(t, firmware, body.Bytes())
+
+	body.Reset()
+	req = NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/small")
+	resp, err = conn.Download(context.Background(), req, &body)
+	assert.Nil(t, err)
+	assert.Equal(t, "small", body.String())
+	assert.Nil(t, resp.GetMessage().GetOption(OptionBlock2))
+}
@@ -0,0 +1,89 @@
+package canopus
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// TransmissionParams holds the parameters used for reliable (Confirmable)
+// message transmission as described in RFC 7252 section 4.8
+type TransmissionParams struct {
+	AckTimeout      time.Duration
+	AckRandomFactor float64
+	MaxRetransmit   int
+}
+
+// DefaultTransmissionParams returns the default transmission parameters
+// defined by RFC 7252
+func DefaultTransmissionParams() TransmissionParams {
+	return TransmissionParams{
+		AckTimeout:      DefaultAckTimeout * time.Second,
+		AckRandomFactor: DefaultAckRandomFactor,
+		MaxRetransmit:   DefaultMaxRetransmit,
+	}
+}
+
+// InitialTimeout returns a random duration between ACK_TIMEOUT and
+// ACK_TIMEOUT * ACK_RANDOM_FACTOR, used as the timeout of the first transmission
+func (p TransmissionParams) InitialTimeout() time.Duration {
+	spread := float64(p.AckTimeout) * (p.AckRandomFactor - 1)
+
+	return p.AckTimeout + time.Duration(rand.Float64()*spread)
+}
+
+// MaxTransmitSpan returns the maximum time from the first transmission of a
+// Confirmable message to its last retransmission
+func (p TransmissionParams) MaxTransmitSpan() time.Duration {
+	return time.Duration(float64(p.AckTimeout) * float64(int(1)<<uint(p.MaxRetransmit)-1) * p.AckRandomFactor)
+}
+
+// ExchangeLifetime returns the time from the first transmission of a
+// Confirmable message until the exchange can no longer be acknowledged or
+// answered, i.e. EXCHANGE_LIFETIME
+func (p TransmissionParams) ExchangeLifetime() time.Duration {
+	return p.MaxTransmitSpan() + 2*MaxLatency + p.AckTimeout
+}
+
+// NonLifetime returns the time from the first transmission of a
+// Non-confirmable message until its message ID can safely be reused,
+// i.e. NON_LIFETIME
+func (p TransmissionParams) NonLifetime() time.Duration {
+	return p.MaxTransmitSpan() + MaxLatency
+}
+
+// TimeoutError is returned when a Confirmable message has not been
+// acknowledged after MAX_RETRANSMIT retransmissions
+type TimeoutError struct {
+	MessageID uint16
+	Attempts  int
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("No acknowledgement received for message %d after %d attempts", e.MessageID, e.Attempts)
+}
+
+// Timeout always returns true, allowing TimeoutError to be used as a net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary always returns false, as the exchange has been abandoned
+func (e *TimeoutError) Temporary() bool {
+	return false
+}
+
+// IsTimeoutError checks if an error was caused by a CoAP or network timeout
+func IsTimeoutError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if _, ok := err.(*TimeoutError); ok {
+		return true
+	}
+
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
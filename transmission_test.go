@@ -0,0 +1,76 @@
+package canopus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTransmissionParams() TransmissionParams {
+	return TransmissionParams{
+		AckTimeout:      20 * time.Millisecond,
+		AckRandomFactor: 1.5,
+		MaxRetransmit:   3,
+	}
+}
+
+func TestTransmissionParams(t *testing.T) {
+	p := DefaultTransmissionParams()
+	assert.Equal(t, 2*time.Second, p.AckTimeout)
+	assert.Equal(t, 4, p.MaxRetransmit)
+	assert.Equal(t, 45*time.Second, p.MaxTransmitSpan())
+
+	for i := 0; i < 100; i++ {
+		to := p.InitialTimeout()
+		assert.True(t, to >= 2*time.Second)
+		assert.True(t, to <= 3*time.Second)
+	}
+}
+
+func TestConfirmableRetransmission(t *testing.T) {
+	pc, seen := startTestPeer(t, 2, func(msg Message) []Message {
+		ack := ContentMessage(0, MessageAcknowledgment)
+		ack.SetStringPayload("ack")
+		return []Message{ack}
+	})
+	defer pc.Close()
+
+	conn, err := Dial(pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTransmissionParams(testTransmissionParams())
+
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/lossy")
+
+	resp, err := conn.Send(req)
+	assert.Nil(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, req.GetMessage().GetMessageId(), resp.GetMessage().GetMessageId())
+	assert.Equal(t, "ack", resp.GetMessage().GetPayload().String())
+	assert.Equal(t, 3, len(seen))
+}
+
+func TestConfirmableRetransmissionTimeout(t *testing.T) {
+	pc, seen := startTestPeer(t, 100, acknowledge)
+	defer pc.Close()
+
+	conn, err := Dial(pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTransmissionParams(testTransmissionParams())
+
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/lossy")
+
+	resp, err := conn.Send(req)
+	assert.Nil(t, resp)
+	assert.True(t, IsTimeoutError(err))
+
+	timeoutErr, ok := err.(*TimeoutError)
+	assert.True(t, ok)
+	assert.Equal(t, 4, timeoutErr.Attempts)
+	assert.Equal(t, req.GetMessage().GetMessageId(), timeoutErr.MessageID)
+	assert.Equal(t, 4, len(seen))
+}
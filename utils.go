@@ -1,11 +1,11 @@
 package canopus
 
 import (
+	crand "crypto/rand"
 	"fmt"
 	"math/rand"
 	"regexp"
 	"strings"
-	"time"
 )
 
 // Returns the string value for a Message Payload
@@ -19,24 +19,41 @@ func PayloadAsString(p MessagePayload) string {
 // GenerateMessageId generate a uint16 Message ID
 func GenerateMessageID() uint16 {
 	MESSAGEID_MUTEX.Lock()
+	defer MESSAGEID_MUTEX.Unlock()
+
 	if CurrentMessageID != 65535 {
 		CurrentMessageID++
 	} else {
 		CurrentMessageID = 1
 	}
-	MESSAGEID_MUTEX.Unlock()
 
 	return uint16(CurrentMessageID)
 }
 
 var genChars = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
 
-// GenerateToken generates a random token by a given length
+// GenerateToken generates a random token by a given length. Tokens guard
+// against spoofed responses, so they are read from crypto/rand, falling back
+// to math/rand if it fails
 func GenerateToken(l int) string {
-	rand.Seed(time.Now().UTC().UnixNano())
-	token := make([]rune, l)
-	for i := range token {
-		token[i] = genChars[rand.Intn(len(genChars))]
+	// bytes at or above limit would favour the first characters
+	limit := 256 - 256%len(genChars)
+
+	token := make([]rune, 0, l)
+	buf := make([]byte, l)
+	for len(token) < l {
+		if _, err := crand.Read(buf); err != nil {
+			for i := len(token); i < l; i++ {
+				token = append(token, genChars[rand.Intn(len(genChars))])
+			}
+			break
+		}
+
+		for _, b := range buf {
+			if int(b) < limit && len(token) < l {
+				token = append(token, genChars[int(b)%len(genChars)])
+			}
+		}
 	}
 	return string(token)
 }
@@ -60,8 +77,13 @@ func CoreResourcesFromString(str string) []*CoreResource {
 			attrs := strings.Split(match[len(elemMatch)+1:], ";")
 
 			for _, attr := range attrs {
-				pair := strings.Split(attr, "=")
+				pair := strings.SplitN(attr, "=", 2)
 
+				// attributes such as obs have no value
+				if len(pair) == 1 {
+					resource.AddAttribute(pair[0], "")
+					continue
+				}
 				resource.AddAttribute(pair[0], strings.Replace(pair[1], "\"", "", -1))
 			}
 		}
@@ -85,6 +107,15 @@ func CoapCodeToString(code CoapCode) string {
 	case Delete:
 		return "DELETE"
 
+	case Fetch:
+		return "FETCH"
+
+	case Patch:
+		return "PATCH"
+
+	case IPatch:
+		return "iPATCH"
+
 	case CoapCodeEmpty:
 		return "0 Empty"
 
@@ -164,7 +195,7 @@ func ValidCoapMediaTypeCode(mt MediaType) bool {
 		MediaTypeApplicationLinkFormat, MediaTypeApplicationXML, MediaTypeApplicationOctetStream, MediaTypeApplicationRdfXML,
 		MediaTypeApplicationSoapXML, MediaTypeApplicationAtomXML, MediaTypeApplicationXmppXML, MediaTypeApplicationExi,
 		MediaTypeApplicationFastInfoSet, MediaTypeApplicationSoapFastInfoSet, MediaTypeApplicationJSON,
-		MediaTypeApplicationXObitBinary, MediaTypeTextPlainVndOmaLwm2m, MediaTypeTlvVndOmaLwm2m,
+		MediaTypeApplicationXObitBinary, MediaTypeApplicationCbor, MediaTypeTextPlainVndOmaLwm2m, MediaTypeTlvVndOmaLwm2m,
 		MediaTypeJSONVndOmaLwm2m, MediaTypeOpaqueVndOmaLwm2m:
 		return true
 	}
@@ -173,5 +204,5 @@ func ValidCoapMediaTypeCode(mt MediaType) bool {
 }
 
 func logMsg(a ...interface{}) (n int, err error) {
-	return fmt.Println(a)
+	return fmt.Println(a...)
 }
@@ -30,6 +30,9 @@ func TestGenerateToken(t *testing.T) {
 		assert.NotEqual(t, "", tok)
 		assert.Equal(t, i, len(tok))
 	}
+
+	// tokens aren't predictable from one another
+	assert.NotEqual(t, GenerateToken(8), GenerateToken(8))
 }
 
 func TestCoreResourceUtil(t *testing.T) {
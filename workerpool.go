@@ -0,0 +1,112 @@
+package canopus
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Defaults for the pool of workers handling incoming messages
+const (
+	DefaultWorkerCount = 32
+	DefaultQueueSize   = 1024
+)
+
+var ErrQueueFull = errors.New("Incoming message queue is full, message dropped")
+
+// inboundPacket is a datagram received from a session, waiting to be handled
+type inboundPacket struct {
+	session Session
+	data    []byte
+}
+
+func newWorkerPool(workers, queueSize int, handler func(Session, []byte)) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	return &workerPool{
+		workers: workers,
+		queue:   make(chan inboundPacket, queueSize),
+		quit:    make(chan struct{}),
+		handler: handler,
+	}
+}
+
+// workerPool handles incoming messages with a fixed number of goroutines.
+// Messages are queued up to the queue size, after which they are dropped
+// and left for the remote endpoint to retransmit
+type workerPool struct {
+	// number of messages queued or being handled
+	pending int32
+
+	workers int
+	queue   chan inboundPacket
+	quit    chan struct{}
+	handler func(Session, []byte)
+
+	start sync.Once
+	stop  sync.Once
+	wg    sync.WaitGroup
+}
+
+func (p *workerPool) run() {
+	p.start.Do(func() {
+		p.wg.Add(p.workers)
+		for i := 0; i < p.workers; i++ {
+			go p.work()
+		}
+	})
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case pkt := <-p.queue:
+			p.handler(pkt.session, pkt.data)
+			atomic.AddInt32(&p.pending, -1)
+
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// submit queues a message without blocking, returning ErrQueueFull if there
+// is no room left
+func (p *workerPool) submit(session Session, data []byte) error {
+	atomic.AddInt32(&p.pending, 1)
+
+	select {
+	case p.queue <- inboundPacket{session, data}:
+		return nil
+
+	default:
+		atomic.AddInt32(&p.pending, -1)
+		return ErrQueueFull
+	}
+}
+
+// idle checks if no message is queued or being handled
+func (p *workerPool) idle() bool {
+	return atomic.LoadInt32(&p.pending) == 0
+}
+
+// close stops the workers once they have finished the messages they are
+// handling. Queued messages which haven't been picked up are discarded
+func (p *workerPool) close() {
+	p.stop.Do(func() {
+		close(p.quit)
+	})
+}
+
+// wait blocks until all workers have stopped
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,176 @@
+package canopus
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestServer serves s on a loopback port and returns its address
+func startTestServer(t *testing.T, s CoapServer) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go s.Serve(pc)
+
+	return pc.LocalAddr().String()
+}
+
+func TestWorkerPoolQueueFull(t *testing.T) {
+	started := make(chan bool, 2)
+	release := make(chan bool)
+	handled := make(chan bool, 2)
+	p := newWorkerPool(1, 1, func(Session, []byte) {
+		started <- true
+		<-release
+		handled <- true
+	})
+	p.run()
+
+	// one message being handled and one queued
+	assert.Nil(t, p.submit(nil, nil))
+	<-started
+	assert.Nil(t, p.submit(nil, nil))
+	assert.Equal(t, ErrQueueFull, p.submit(nil, nil))
+
+	close(release)
+	<-handled
+	<-handled
+
+	p.close()
+	p.wait()
+}
+
+func TestServerConcurrentClients(t *testing.T) {
+	s := NewServer()
+	s.SetWorkerPool(8, 256)
+
+	s.Get("/echo/:id", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.SetStringPayload(req.GetAttribute("id"))
+		return NewResponseWithMessage(msg)
+	})
+
+	s.Post("/observed", func(req Request) Response {
+		s.NotifyChange("observed", "changed", false)
+		return NewResponseWithMessage(ChangedMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment))
+	})
+
+	addr := startTestServer(t, s)
+	defer s.Stop()
+
+	clients := 20
+	requests := 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients*requests)
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+
+			conn, err := Dial(addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetTransmissionParams(testTransmissionParams())
+
+			for r := 0; r < requests; r++ {
+				session := &UDPServerSession{addr: &net.UDPAddr{Port: c*requests + r}, server: s}
+				s.AddObservation("observed", GenerateToken(8), session)
+
+				id := fmt.Sprintf("%d-%d", c, r)
+				req := NewRequest(MessageConfirmable, Get)
+				req.SetRequestURI("/echo/" + id)
+
+				resp, err := conn.Send(req)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if resp.GetMessage().GetPayload().String() != id {
+					errs <- fmt.Errorf("expected %s, got %s", id, resp.GetMessage().GetPayload().String())
+				}
+
+				post := NewRequest(MessageConfirmable, Post)
+				post.SetRequestURI("/observed")
+				if _, err = conn.Send(post); err != nil {
+					errs <- err
+				}
+
+				s.RemoveObservation("observed", session.GetAddress())
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+}
+
+func TestServerAutoAcknowledgeSingleWorker(t *testing.T) {
+	s := NewServer()
+	s.SetWorkerPool(1, 16)
+	s.SetTransmissionParams(testTransmissionParams())
+
+	errs := make(chan error, 1)
+	s.OnError(func(err error) {
+		errs <- err
+	})
+
+	route := s.Get("/auto", func(req Request) Response {
+		msg := ContentMessage(req.GetMessage().GetMessageId(), MessageAcknowledgment)
+		msg.SetStringPayload("later")
+		return NewResponseWithMessage(msg)
+	})
+	route.(*RegExRoute).AutoAck = true
+
+	addr := startTestServer(t, s)
+	defer s.Stop()
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer peer.Close()
+	serverAddr, _ := net.ResolveUDPAddr("udp", addr)
+
+	req := NewRequest(MessageConfirmable, Get)
+	req.SetRequestURI("/auto")
+	b, _ := MessageToBytes(req.GetMessage())
+	peer.WriteTo(b, serverAddr)
+
+	buf := make([]byte, MaxPacketSize)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	ack, _ := BytesToMessage(buf[:n])
+	assert.True(t, isEmptyAcknowledgement(ack))
+
+	n, _, err = peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	resp, _ := BytesToMessage(buf[:n])
+	assert.Equal(t, MessageConfirmable, int(resp.GetMessageType()))
+	assert.Equal(t, "later", resp.GetPayload().String())
+
+	// the only worker is sending the response, the acknowledgement completes
+	// it without being queued behind it
+	b, _ = MessageToBytes(NewEmptyMessage(resp.GetMessageId()))
+	peer.WriteTo(b, serverAddr)
+
+	peer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = peer.ReadFrom(buf)
+	assert.NotNil(t, err, "response retransmitted")
+
+	select {
+	case err := <-errs:
+		t.Error(err)
+	default:
+	}
+}